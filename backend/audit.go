@@ -0,0 +1,182 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	AuditSuccess  = "success"
+	AuditAccepted = "accepted"
+	AuditFinished = "finished"
+	AuditFailed   = "failed"
+)
+
+// AuditEntry is a record of the audit log, which is saved as a json line
+type AuditEntry struct {
+	Time   time.Time         `json:"time"`
+	User   string            `json:"user"`
+	Addr   string            `json:"addr"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+	Status int               `json:"status,omitempty"`
+	Result string            `json:"result"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// AuditFilter filters the audit entries by the time range [Start, End), the user and the action,
+// the zero values mean no filter, and only the latest Limit entries are returned if Limit is positive
+type AuditFilter struct {
+	Start  time.Time
+	End    time.Time
+	User   string
+	Action string
+	Limit  int
+}
+
+func (af *AuditFilter) Match(entry *AuditEntry) bool {
+	if !af.Start.IsZero() && entry.Time.Before(af.Start) {
+		return false
+	}
+	if !af.End.IsZero() && !entry.Time.Before(af.End) {
+		return false
+	}
+	if af.User != "" && entry.User != af.User {
+		return false
+	}
+	if af.Action != "" && entry.Action != af.Action {
+		return false
+	}
+	return true
+}
+
+// AuditLog is the append-only audit log of the administrative and destructive operations,
+// which is rotated when the file reaches 100 MB, and the latest 10 rotated files are kept
+type AuditLog struct {
+	filename string
+	logger   *lumberjack.Logger
+}
+
+func NewAuditLog(filename string) (al *AuditLog, err error) {
+	if err = util.MakeDir(filepath.Dir(filename)); err != nil {
+		return
+	}
+	al = &AuditLog{
+		filename: filename,
+		logger: &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    100,
+			MaxBackups: 10,
+		},
+	}
+	return
+}
+
+// Record appends the entry to the audit log, the nil audit log means disabled
+func (al *AuditLog) Record(entry *AuditEntry) {
+	if al == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit log marshal error: %s", err)
+		return
+	}
+	// the entry is written by one call so that the lines are not interleaved
+	if _, err = al.logger.Write(append(b, '\n')); err != nil {
+		log.Printf("audit log write error: %s, entry: %s", err, b)
+	}
+}
+
+// Query returns the matched entries in chronological order from the rotated files and the current file
+func (al *AuditLog) Query(filter *AuditFilter) ([]*AuditEntry, error) {
+	ext := filepath.Ext(al.filename)
+	backups, err := filepath.Glob(strings.TrimSuffix(al.filename, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	// the timestamps of the rotated files are sortable
+	sort.Strings(backups)
+	entries := make([]*AuditEntry, 0)
+	for _, file := range append(backups, al.filename) {
+		if !filter.Start.IsZero() && file != al.filename {
+			if fi, err := os.Stat(file); err == nil && fi.ModTime().Before(filter.Start) {
+				continue
+			}
+		}
+		entries, err = readAuditFile(file, filter, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+func readAuditFile(file string, filter *AuditFilter, entries []*AuditEntry) ([]*AuditEntry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			entry := &AuditEntry{}
+			// the partial line being written is skipped
+			if json.Unmarshal(line, entry) == nil && filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (al *AuditLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	return al.logger.Close()
+}
+
+// AuditStatement returns the head statement of the query which modifies the data, schema, users or queries,
+// or empty if the query is not audited, such as select and show
+func AuditStatement(q string) string {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return ""
+	}
+	tokens := ScanTokens(q, 0)
+	if CheckSelectOrShowFromTokens(tokens) {
+		return ""
+	}
+	return StatementType(tokens)
+}
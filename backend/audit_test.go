@@ -0,0 +1,92 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	al, err := NewAuditLog(filepath.Join(dir, "audit", "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	backup := `{"time":"2020-12-31T23:00:00Z","user":"admin","addr":"127.0.0.1:1","action":"cleanup","result":"accepted"}
+{"time":"2020-12-31T23:30:00Z","user":"admin","addr":"127.0.0.1:1","action":"cleanup","result":"finished"}
+`
+	err = ioutil.WriteFile(filepath.Join(dir, "audit", "audit-2021-01-01T00-00-00.000.log"), []byte(backup), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Record(&AuditEntry{Time: base.Add(time.Minute), User: "admin", Action: "rebalance", Params: map[string]string{"circle_id": "0"}, Status: 202, Result: AuditAccepted})
+	al.Record(&AuditEntry{Time: base.Add(2 * time.Minute), User: "alice", Action: "query", Params: map[string]string{"q": "drop database db1"}, Status: 403, Result: AuditFailed, Error: "not authorized"})
+	al.Record(&AuditEntry{Time: base.Add(3 * time.Minute), User: "admin", Action: "query", Params: map[string]string{"q": "drop database db2"}, Result: AuditSuccess})
+
+	tests := []struct {
+		name   string
+		filter *AuditFilter
+		want   []string
+	}{
+		{name: "all", filter: &AuditFilter{}, want: []string{"cleanup", "cleanup", "rebalance", "query", "query"}},
+		{name: "start", filter: &AuditFilter{Start: base}, want: []string{"rebalance", "query", "query"}},
+		{name: "end", filter: &AuditFilter{End: base.Add(2 * time.Minute)}, want: []string{"cleanup", "cleanup", "rebalance"}},
+		{name: "user", filter: &AuditFilter{User: "alice"}, want: []string{"query"}},
+		{name: "action", filter: &AuditFilter{User: "admin", Action: "query"}, want: []string{"query"}},
+		{name: "limit", filter: &AuditFilter{Limit: 2}, want: []string{"query", "query"}},
+	}
+	for _, tt := range tests {
+		entries, err := al.Query(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got := make([]string, len(entries))
+		for i, entry := range entries {
+			got[i] = entry.Action
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+
+	entries, _ := al.Query(&AuditFilter{User: "alice"})
+	if len(entries) == 1 && (entries[0].Status != 403 || entries[0].Error != "not authorized" || entries[0].Params["q"] != "drop database db1") {
+		t.Errorf("entry not matched: %+v", entries[0])
+	}
+}
+
+func TestAuditStatement(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{q: "select * from cpu", want: ""},
+		{q: "show databases", want: ""},
+		{q: "", want: ""},
+		{q: "drop database db1", want: "drop database"},
+		{q: "DELETE FROM cpu WHERE time < now()", want: "delete from"},
+		{q: "create retention policy rp1 on db1 duration 1d replication 1", want: "create retention policy"},
+		{q: "create subscription s1 on db1.autogen destinations all 'http://127.0.0.1:9090'", want: "create subscription"},
+		{q: "create user bob with password 'secret'", want: "create user"},
+		{q: "kill query 1", want: "kill query"},
+	}
+	for _, tt := range tests {
+		if got := AuditStatement(tt.q); got != tt.want {
+			t.Errorf("AuditStatement(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	ErrNotAuthorized        = errors.New("not authorized")
+	ErrEmptyUserName        = errors.New("user name cannot be empty")
+	ErrDuplicatedUserName   = errors.New("user name duplicated")
+	ErrInvalidRole          = errors.New("invalid role, require read, write or all")
+)
+
+type PrivilegeConfig struct {
+	Db   string `mapstructure:"db" json:"db"`
+	Role string `mapstructure:"role" json:"role"`
+}
+
+type UserConfig struct {
+	Name         string             `mapstructure:"name" json:"name"`
+	PasswordHash string             `mapstructure:"password_hash" json:"password_hash"`
+	Admin        bool               `mapstructure:"admin" json:"admin"`
+	Privileges   []*PrivilegeConfig `mapstructure:"privileges" json:"privileges"`
+}
+
+type Privilege int
+
+const (
+	NoPrivileges Privilege = iota
+	ReadPrivilege
+	WritePrivilege
+	AllPrivileges
+)
+
+func (p Privilege) String() string {
+	switch p {
+	case ReadPrivilege:
+		return "READ"
+	case WritePrivilege:
+		return "WRITE"
+	case AllPrivileges:
+		return "ALL PRIVILEGES"
+	}
+	return "NO PRIVILEGES"
+}
+
+func ParsePrivilege(role string) (Privilege, error) {
+	switch role {
+	case "read":
+		return ReadPrivilege, nil
+	case "write":
+		return WritePrivilege, nil
+	case "all":
+		return AllPrivileges, nil
+	}
+	return NoPrivileges, ErrInvalidRole
+}
+
+// User is a user of the proxy, the admin user has all privileges on all databases and the admin endpoints
+type User struct {
+	Name       string
+	Admin      bool
+	privileges map[string]Privilege
+	hash       []byte
+}
+
+// Authorize checks whether the user has the privilege on the database
+func (u *User) Authorize(db string, p Privilege) bool {
+	if u.Admin {
+		return true
+	}
+	up := u.privileges[db]
+	return up == AllPrivileges || up == p
+}
+
+// UserStore is the users loaded from config and the users file, the passwords are saved as bcrypt hashes
+type UserStore struct {
+	users    map[string]*User
+	lock     sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+func NewUserStore(cfgs []*UserConfig, file string) (us *UserStore, err error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var fcfgs []*UserConfig
+		if err = json.Unmarshal(b, &fcfgs); err != nil {
+			return nil, fmt.Errorf("parse users file %s error: %s", file, err)
+		}
+		cfgs = append(cfgs[:len(cfgs):len(cfgs)], fcfgs...)
+	}
+	us = &UserStore{users: make(map[string]*User), verified: make(map[string][sha256.Size]byte)}
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, ErrEmptyUserName
+		}
+		if _, ok := us.users[cfg.Name]; ok {
+			return nil, ErrDuplicatedUserName
+		}
+		if _, err = bcrypt.Cost([]byte(cfg.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("invalid password hash of user %s: %s", cfg.Name, err)
+		}
+		u := &User{Name: cfg.Name, Admin: cfg.Admin, privileges: make(map[string]Privilege), hash: []byte(cfg.PasswordHash)}
+		for _, pc := range cfg.Privileges {
+			p, err := ParsePrivilege(pc.Role)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %s", cfg.Name, err)
+			}
+			u.privileges[pc.Db] = p
+		}
+		us.users[cfg.Name] = u
+	}
+	return us, nil
+}
+
+// Authenticate returns the user if the password matches, the verified password is remembered
+// as sha256 digest to avoid the costly bcrypt comparison for every request
+func (us *UserStore) Authenticate(name, password string) (*User, error) {
+	u, ok := us.users[name]
+	if !ok {
+		return nil, ErrAuthenticationFailed
+	}
+	digest := sha256.Sum256([]byte(password))
+	us.lock.Lock()
+	verified, ok := us.verified[name]
+	us.lock.Unlock()
+	if ok && verified == digest {
+		return u, nil
+	}
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	us.lock.Lock()
+	us.verified[name] = digest
+	us.lock.Unlock()
+	return u, nil
+}
+
+// Lookup returns the user without password, which is used for the user authenticated by jwt
+func (us *UserStore) Lookup(name string) (*User, bool) {
+	u, ok := us.users[name]
+	return u, ok
+}
+
+func (us *UserStore) Len() int {
+	return len(us.users)
+}
+
+type userContextKey struct{}
+
+// WithUser returns the context with the authenticated user
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, u)
+}
+
+// UserFromContext returns the authenticated user, or nil if the user store is not enabled
+func UserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userContextKey{}).(*User)
+	return u
+}
+
+type userNameContextKey struct{}
+
+// WithUserName returns the context with the name of the authenticated proxy user, which is not in the user store
+func WithUserName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userNameContextKey{}, name)
+}
+
+// AuthorizeDatabase checks the privilege of the user on the database, the nil user is not restricted
+func AuthorizeDatabase(u *User, db string, p Privilege) error {
+	if u == nil || u.Authorize(db, p) {
+		return nil
+	}
+	return fmt.Errorf("%w: user %s requires %s on %s", ErrNotAuthorized, u.Name, p, db)
+}
+
+// AuthorizeQuery checks the privileges of the user on the databases the statement touches,
+// the statements which manage the cluster require admin
+func AuthorizeQuery(u *User, tokens []string, db string) error {
+	if u == nil || u.Admin {
+		return nil
+	}
+	stmt2 := GetHeadStmtFromTokens(tokens, 2)
+	stmt3 := GetHeadStmtFromTokens(tokens, 3)
+	switch {
+	case stmt2 == "show databases":
+		// the databases are filtered by the read privilege
+		return nil
+	case CheckUserFromTokens(tokens), CheckContinuousQueryFromTokens(tokens), CheckKillQueryFromTokens(tokens),
+		stmt2 == "create database", stmt2 == "drop database", stmt2 == "show queries", stmt2 == "show stats", stmt2 == "show diagnostics",
+		stmt3 == "create retention policy", stmt3 == "alter retention policy", stmt3 == "drop retention policy":
+		return fmt.Errorf("%w: user %s requires admin privilege", ErrNotAuthorized, u.Name)
+	case CheckSelectIntoFromTokens(tokens):
+		tdb, _, _, _ := GetIntoTargetFromTokens(tokens)
+		if tdb == "" {
+			tdb = db
+		}
+		if err := AuthorizeDatabase(u, db, ReadPrivilege); err != nil {
+			return err
+		}
+		return AuthorizeDatabase(u, tdb, WritePrivilege)
+	case CheckSelectOrShowFromTokens(tokens):
+		return AuthorizeDatabase(u, db, ReadPrivilege)
+	}
+	return AuthorizeDatabase(u, db, WritePrivilege)
+}
+
+// filterDatabases removes the databases which the user can't read from the show databases response
+func filterDatabases(rsp *Response, u *User) {
+	if u == nil || u.Admin {
+		return
+	}
+	for _, result := range rsp.Results {
+		for _, row := range result.Series {
+			values := row.Values[:0]
+			for _, value := range row.Values {
+				if len(value) > 0 && u.Authorize(util.CastString(value[0]), ReadPrivilege) {
+					values = append(values, value)
+				}
+			}
+			row.Values = values
+		}
+	}
+}
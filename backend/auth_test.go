@@ -0,0 +1,85 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUserStore(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	file := filepath.Join(t.TempDir(), "users.json")
+	b, _ := json.Marshal([]*UserConfig{{Name: "reader", PasswordHash: string(hash), Privileges: []*PrivilegeConfig{{Db: "db1", Role: "read"}}}})
+	ioutil.WriteFile(file, b, 0600)
+	us, err := NewUserStore([]*UserConfig{{Name: "admin", PasswordHash: string(hash), Admin: true}}, file)
+	if err != nil {
+		t.Fatalf("new user store error: %s", err)
+	}
+	if us.Len() != 2 {
+		t.Errorf("users = %d, want 2", us.Len())
+	}
+	for i := 0; i < 2; i++ {
+		if u, err := us.Authenticate("reader", "secret"); err != nil || u.Name != "reader" || u.Admin {
+			t.Errorf("authenticate reader: %v, %v", u, err)
+		}
+	}
+	if _, err := us.Authenticate("reader", "wrong"); err != ErrAuthenticationFailed {
+		t.Errorf("authenticate with wrong password: %v", err)
+	}
+	if _, err := us.Authenticate("nobody", "secret"); err != ErrAuthenticationFailed {
+		t.Errorf("authenticate unknown user: %v", err)
+	}
+
+	if _, err := NewUserStore([]*UserConfig{{Name: "u", PasswordHash: "secret"}}, ""); err == nil {
+		t.Error("plain password should be rejected")
+	}
+	if _, err := NewUserStore([]*UserConfig{{Name: "u", PasswordHash: string(hash), Privileges: []*PrivilegeConfig{{Db: "db1", Role: "admin"}}}}, ""); err == nil {
+		t.Error("invalid role should be rejected")
+	}
+}
+
+func TestAuthorizeQuery(t *testing.T) {
+	u := &User{Name: "u", privileges: map[string]Privilege{"db1": ReadPrivilege, "db2": WritePrivilege, "db3": AllPrivileges}}
+	tests := []struct {
+		q      string
+		db     string
+		denied bool
+	}{
+		{`SELECT * FROM cpu`, "db1", false},
+		{`SELECT * FROM cpu`, "db2", true},
+		{`SHOW MEASUREMENTS`, "db3", false},
+		{`SHOW DATABASES`, "", false},
+		{`SELECT * INTO db2..cpu_copy FROM cpu`, "db1", false},
+		{`SELECT * INTO cpu_copy FROM cpu`, "db1", true},
+		{`DELETE FROM cpu`, "db2", false},
+		{`DROP MEASUREMENT cpu`, "db1", true},
+		{`CREATE DATABASE db1`, "db1", true},
+		{`CREATE RETENTION POLICY rp1 ON db3 DURATION 1d REPLICATION 1`, "db3", true},
+		{`SHOW USERS`, "", true},
+		{`KILL QUERY 1`, "", true},
+	}
+	for _, tt := range tests {
+		err := AuthorizeQuery(u, ScanTokens(tt.q, 0), tt.db)
+		if (err != nil) != tt.denied || (err != nil && !errors.Is(err, ErrNotAuthorized)) {
+			t.Errorf("authorize %s on %s: %v", tt.q, tt.db, err)
+		}
+		if err := AuthorizeQuery(&User{Name: "admin", Admin: true}, ScanTokens(tt.q, 0), tt.db); err != nil {
+			t.Errorf("admin should be authorized: %s", err)
+		}
+	}
+
+	rsp := ResponseFromSeries(models.Rows{{Name: "databases", Columns: []string{"name"}, Values: [][]interface{}{{"db1"}, {"db2"}, {"db3"}, {"db4"}}}})
+	filterDatabases(rsp, u)
+	if values := rsp.Results[0].Series[0].Values; len(values) != 2 || values[0][0] != "db1" || values[1][0] != "db3" {
+		t.Errorf("unexpected databases: %v", values)
+	}
+}
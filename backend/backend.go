@@ -6,6 +6,7 @@ package backend
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"net/url"
@@ -37,9 +38,13 @@ type Backend struct {
 	wg              sync.WaitGroup
 }
 
-func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend) {
+func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend, err error) {
+	hb, err := NewHttpBackend(cfg, pxcfg)
+	if err != nil {
+		return
+	}
 	ib = &Backend{
-		HttpBackend:     NewHttpBackend(cfg, pxcfg),
+		HttpBackend:     hb,
 		flushSize:       pxcfg.FlushSize,
 		flushTime:       pxcfg.FlushTime,
 		rewriteInterval: pxcfg.RewriteInterval,
@@ -49,22 +54,25 @@ func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend) {
 	}
 	ib.running.Store(true)
 
-	var err error
 	ib.fb, err = NewFileBackend(cfg.Name, pxcfg.DataDir)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("open file buffer of backend %s error: %w", cfg.Name, err)
 	}
 	ib.pool, err = ants.NewPool(pxcfg.ConnPoolSize)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	go ib.worker()
 	return
 }
 
-func NewSimpleBackend(cfg *BackendConfig) *Backend {
-	return &Backend{HttpBackend: NewSimpleHttpBackend(cfg)}
+func NewSimpleBackend(cfg *BackendConfig) (*Backend, error) {
+	hb, err := NewSimpleHttpBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{HttpBackend: hb}, nil
 }
 
 func (ib *Backend) worker() {
@@ -300,7 +308,10 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 		Active    bool        `json:"active"`
 		Backlog   bool        `json:"backlog"`
 		Rewriting bool        `json:"rewriting"`
+		Journal   int         `json:"journal"`
 		WriteOnly bool        `json:"write_only"`
+		Latency   string      `json:"latency"`
+		Inflight  int64       `json:"inflight"`
 		Healthy   bool        `json:"healthy,omitempty"`
 		Stats     interface{} `json:"stats,omitempty"`
 	}{
@@ -309,7 +320,10 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 		Active:    ib.IsActive(),
 		Backlog:   ib.fb.IsData(),
 		Rewriting: ib.IsRewriting(),
+		Journal:   ib.JournalLen(),
 		WriteOnly: ib.IsWriteOnly(),
+		Latency:   ib.latency.Latency().String(),
+		Inflight:  ib.latency.Inflight(),
 	}
 	if !withStats {
 		return health
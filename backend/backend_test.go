@@ -0,0 +1,39 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewProxyJournalError(t *testing.T) {
+	dir := t.TempDir()
+	// the journal can't be read if its path is a directory
+	if err := os.Mkdir(filepath.Join(dir, "b2.ddl"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ProxyConfig{
+		DataDir: dir,
+		Circles: []*CircleConfig{
+			{Name: "c1", Backends: []*BackendConfig{{Name: "b1", Url: "http://127.0.0.1:8086"}, {Name: "b2", Url: "http://127.0.0.1:8087"}}},
+		},
+		HashKey:         "idx",
+		CheckInterval:   1,
+		ConnPoolSize:    1,
+		FlushSize:       1,
+		FlushTime:       1,
+		RewriteInterval: 1,
+	}
+	ip, err := NewProxy(cfg)
+	if err == nil || ip != nil {
+		t.Fatal("new proxy should fail if the journal can't be loaded")
+	}
+	if !strings.Contains(err.Error(), "backend b2") {
+		t.Errorf("error should tell the backend: %s", err)
+	}
+}
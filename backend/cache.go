@@ -0,0 +1,312 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+var cacheHeaders = []string{"Content-Type", "Content-Encoding"}
+
+// maxCacheGenerations is the maximum number of the generations kept, which are reset once it's exceeded
+var maxCacheGenerations = 100000
+
+type CacheStats struct {
+	Entries       int   `json:"entries"`
+	Size          int   `json:"size"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+type cacheEntry struct {
+	key     string
+	meas    string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (ce *cacheEntry) size() int {
+	return len(ce.key) + len(ce.body)
+}
+
+// QueryCache is an in-memory lru cache of query results, which is invalidated by writes to the measurement
+type QueryCache struct {
+	lock    sync.RWMutex
+	ttl     time.Duration
+	nowTTL  time.Duration
+	maxSize int
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+	index   map[string]map[string]bool
+	// generations counts the invalidations of the queried databases and measurements, keyed by GetKey,
+	// so that the result of a query which the invalidation happens during isn't cached. the generations are
+	// taken from the clock which only increases, so the generation removed and created again is always newer
+	genLock     sync.Mutex
+	generations map[string]uint64
+	clock       uint64
+
+	hits          int64
+	misses        int64
+	evictions     int64
+	invalidations int64
+}
+
+func NewQueryCache(cfg *ProxyConfig) *QueryCache {
+	return &QueryCache{
+		ttl:         time.Duration(cfg.QueryCacheTTL) * time.Second,
+		nowTTL:      time.Duration(cfg.QueryCacheNowTTL) * time.Second,
+		maxSize:     cfg.QueryCacheMaxSize * 1024 * 1024,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+		index:       make(map[string]map[string]bool),
+		generations: make(map[string]uint64),
+	}
+}
+
+// Key returns the cache key by db, normalized query, epoch, user and response format,
+// and returns empty string if the query is not cacheable
+func (qc *QueryCache) Key(req *http.Request, tokens []string, db string) string {
+	if req.FormValue("chunked") == "true" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(db)
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(tokens, " "))
+	b.WriteByte('\n')
+	b.WriteString(req.FormValue("epoch"))
+	b.WriteByte('\n')
+	b.WriteString(GetRequestUser(req))
+	b.WriteByte('\n')
+	b.WriteString(req.FormValue("pretty"))
+	b.WriteByte('\n')
+	b.WriteString(req.Header.Get("Accept"))
+	b.WriteByte('\n')
+	b.WriteString(req.Header.Get("Accept-Encoding"))
+	return b.String()
+}
+
+// TTL returns the ttl by the time range of the query parsed by influxql, which is shorter unless the time range
+// has an upper bound in the past and doesn't depend on now(), since the result changes as new points arrive
+func (qc *QueryCache) TTL(q string) time.Duration {
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		return qc.nowTTL
+	}
+	now := time.Now()
+	for _, stmt := range query.Statements {
+		if !pastTimeRange(stmt, now) {
+			return qc.nowTTL
+		}
+	}
+	return qc.ttl
+}
+
+// pastTimeRange checks whether the statement selects a time range which ends before now and doesn't depend on now()
+func pastTimeRange(stmt influxql.Statement, now time.Time) bool {
+	sel, ok := stmt.(*influxql.SelectStatement)
+	if !ok {
+		return false
+	}
+	relative := false
+	influxql.WalkFunc(sel, func(node influxql.Node) {
+		if call, ok := node.(*influxql.Call); ok && strings.ToLower(call.Name) == "now" {
+			relative = true
+		}
+	})
+	if relative {
+		return false
+	}
+	_, tr, err := influxql.ConditionExpr(sel.Condition, &influxql.NowValuer{Now: now})
+	return err == nil && !tr.Max.IsZero() && tr.Max.Before(now)
+}
+
+// Generation returns the invalidation generation of the measurement, which is taken before querying the backends
+// on a cache miss, and passed to Set to skip caching the result if the measurement is invalidated meanwhile
+func (qc *QueryCache) Generation(db, meas string) uint64 {
+	return qc.generation(GetKey(db, "")) + qc.generation(GetKey(db, meas))
+}
+
+func (qc *QueryCache) generation(key string) uint64 {
+	qc.genLock.Lock()
+	defer qc.genLock.Unlock()
+	gen, ok := qc.generations[key]
+	if !ok {
+		if len(qc.generations) >= maxCacheGenerations {
+			qc.generations = make(map[string]uint64)
+			qc.clock++
+		}
+		gen = qc.clock
+		qc.generations[key] = gen
+	}
+	return gen
+}
+
+// bump increases the generation of the key if it has been queried
+func (qc *QueryCache) bump(key string) {
+	qc.genLock.Lock()
+	defer qc.genLock.Unlock()
+	if _, ok := qc.generations[key]; ok {
+		qc.clock++
+		qc.generations[key] = qc.clock
+	}
+}
+
+// forget removes the generations of the keys matched, which are created again when they're queried
+func (qc *QueryCache) forget(match func(key string) bool) {
+	qc.genLock.Lock()
+	defer qc.genLock.Unlock()
+	for key := range qc.generations {
+		if match(key) {
+			delete(qc.generations, key)
+		}
+	}
+	qc.clock++
+}
+
+func (qc *QueryCache) Get(key string, w http.ResponseWriter) ([]byte, bool) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	elem, ok := qc.entries[key]
+	if !ok {
+		atomic.AddInt64(&qc.misses, 1)
+		return nil, false
+	}
+	ce := elem.Value.(*cacheEntry)
+	if time.Now().After(ce.expires) {
+		qc.remove(elem)
+		atomic.AddInt64(&qc.misses, 1)
+		return nil, false
+	}
+	qc.lru.MoveToFront(elem)
+	atomic.AddInt64(&qc.hits, 1)
+	CopyHeader(w.Header(), ce.header)
+	return ce.body, true
+}
+
+func (qc *QueryCache) Set(key, db, meas string, gen uint64, header http.Header, body []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	ce := &cacheEntry{
+		key:     key,
+		meas:    GetKey(db, meas),
+		header:  http.Header{},
+		body:    body,
+		expires: time.Now().Add(ttl),
+	}
+	for _, h := range cacheHeaders {
+		if v := header.Get(h); v != "" {
+			ce.header.Set(h, v)
+		}
+	}
+	if ce.size() > qc.maxSize {
+		return
+	}
+
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	// the invalidation bumps the generation before taking the lock, so it's checked under the lock
+	if qc.Generation(db, meas) != gen {
+		return
+	}
+	if elem, ok := qc.entries[key]; ok {
+		qc.remove(elem)
+	}
+	qc.entries[key] = qc.lru.PushFront(ce)
+	if _, ok := qc.index[ce.meas]; !ok {
+		qc.index[ce.meas] = make(map[string]bool)
+	}
+	qc.index[ce.meas][key] = true
+	qc.size += ce.size()
+	for qc.size > qc.maxSize {
+		qc.remove(qc.lru.Back())
+		atomic.AddInt64(&qc.evictions, 1)
+	}
+}
+
+// Invalidate removes all the entries of the measurement, it's called on every write
+func (qc *QueryCache) Invalidate(db, meas string) {
+	key := GetKey(db, meas)
+	qc.bump(key)
+	qc.lock.RLock()
+	_, ok := qc.index[key]
+	qc.lock.RUnlock()
+	if !ok {
+		return
+	}
+
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.invalidate(key)
+}
+
+// Drop removes all the entries and the generation of the measurement, it's called on delete or drop measurement
+func (qc *QueryCache) Drop(db, meas string) {
+	key := GetKey(db, meas)
+	qc.forget(func(k string) bool { return k == key })
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.invalidate(key)
+}
+
+// InvalidateDatabase removes all the entries and the generations of the database
+func (qc *QueryCache) InvalidateDatabase(db string) {
+	prefix := GetKey(db, "")
+	qc.forget(func(k string) bool { return strings.HasPrefix(k, prefix) })
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	for key := range qc.index {
+		if strings.HasPrefix(key, prefix) {
+			qc.invalidate(key)
+		}
+	}
+}
+
+func (qc *QueryCache) invalidate(key string) {
+	for ckey := range qc.index[key] {
+		if elem, ok := qc.entries[ckey]; ok {
+			qc.remove(elem)
+			atomic.AddInt64(&qc.invalidations, 1)
+		}
+	}
+	delete(qc.index, key)
+}
+
+func (qc *QueryCache) remove(elem *list.Element) {
+	ce := qc.lru.Remove(elem).(*cacheEntry)
+	delete(qc.entries, ce.key)
+	if keys, ok := qc.index[ce.meas]; ok {
+		delete(keys, ce.key)
+		if len(keys) == 0 {
+			delete(qc.index, ce.meas)
+		}
+	}
+	qc.size -= ce.size()
+}
+
+func (qc *QueryCache) GetStats() *CacheStats {
+	qc.lock.RLock()
+	defer qc.lock.RUnlock()
+	return &CacheStats{
+		Entries:       len(qc.entries),
+		Size:          qc.size,
+		Hits:          atomic.LoadInt64(&qc.hits),
+		Misses:        atomic.LoadInt64(&qc.misses),
+		Evictions:     atomic.LoadInt64(&qc.evictions),
+		Invalidations: atomic.LoadInt64(&qc.invalidations),
+	}
+}
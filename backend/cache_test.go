@@ -0,0 +1,133 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryCache(t *testing.T) {
+	qc := NewQueryCache(&ProxyConfig{QueryCacheTTL: 60, QueryCacheNowTTL: 10, QueryCacheMaxSize: 1})
+	req := httptest.NewRequest("GET", "/query?db=db1&u=user1&q=select+*+from+cpu", nil)
+	tokens := ScanTokens(req.FormValue("q"), 0)
+	key := qc.Key(req, tokens, "db1")
+	if key == "" {
+		t.Fatal("query should be cacheable")
+	}
+
+	w := httptest.NewRecorder()
+	if _, ok := qc.Get(key, w); ok {
+		t.Error("query cache should miss")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	qc.Set(key, "db1", "cpu", qc.Generation("db1", "cpu"), w.Header(), []byte("body"), time.Minute)
+	w = httptest.NewRecorder()
+	if body, ok := qc.Get(key, w); !ok || string(body) != "body" || w.Header().Get("Content-Type") != "application/json" {
+		t.Error("query cache should hit")
+	}
+
+	qc.Invalidate("db1", "mem")
+	if _, ok := qc.Get(key, w); !ok {
+		t.Error("query cache should hit after writing another measurement")
+	}
+	qc.Invalidate("db1", "cpu")
+	if _, ok := qc.Get(key, w); ok {
+		t.Error("query cache should miss after writing the measurement")
+	}
+
+	gen := qc.Generation("db1", "cpu")
+	qc.Set(key, "db1", "cpu", gen, w.Header(), make([]byte, 768*1024), time.Minute)
+	qc.Set(key+"2", "db1", "cpu", gen, w.Header(), make([]byte, 768*1024), time.Minute)
+	stats := qc.GetStats()
+	if stats.Entries != 1 || stats.Evictions != 1 || stats.Hits != 2 || stats.Misses != 2 || stats.Invalidations != 1 {
+		t.Errorf("query cache stats wrong: %+v", stats)
+	}
+}
+
+func TestQueryCacheGeneration(t *testing.T) {
+	qc := NewQueryCache(&ProxyConfig{QueryCacheTTL: 60, QueryCacheNowTTL: 10, QueryCacheMaxSize: 1})
+	tests := []struct {
+		name       string
+		invalidate func()
+		cached     bool
+	}{
+		{"no write", func() {}, true},
+		{"write to the measurement", func() { qc.Invalidate("db1", "cpu") }, false},
+		{"write to another measurement", func() { qc.Invalidate("db1", "mem") }, true},
+		{"drop the measurement", func() { qc.Drop("db1", "cpu") }, false},
+		{"drop another measurement", func() { qc.Drop("db1", "mem") }, true},
+		{"drop the database", func() { qc.InvalidateDatabase("db1") }, false},
+		{"drop another database", func() { qc.InvalidateDatabase("db2") }, true},
+	}
+	for _, tt := range tests {
+		key := "key of " + tt.name
+		// the invalidation happens while the backend query is running
+		gen := qc.Generation("db1", "cpu")
+		tt.invalidate()
+		qc.Set(key, "db1", "cpu", gen, httptest.NewRecorder().Header(), []byte("body"), time.Minute)
+		if _, ok := qc.Get(key, httptest.NewRecorder()); ok != tt.cached {
+			t.Errorf("%s: cached %t != %t", tt.name, ok, tt.cached)
+		}
+	}
+}
+
+func TestQueryCacheGenerationLimit(t *testing.T) {
+	limit := maxCacheGenerations
+	maxCacheGenerations = 4
+	defer func() { maxCacheGenerations = limit }()
+
+	qc := NewQueryCache(&ProxyConfig{QueryCacheTTL: 60, QueryCacheNowTTL: 10, QueryCacheMaxSize: 1})
+	gen := qc.Generation("db1", "cpu")
+	qc.Generation("db2", "mem")
+	if n := len(qc.generations); n != 4 {
+		t.Fatalf("generations = %d, want 4", n)
+	}
+	qc.Drop("db2", "mem")
+	qc.InvalidateDatabase("db2")
+	if n := len(qc.generations); n != 2 {
+		t.Errorf("generations after drop = %d, want 2", n)
+	}
+
+	// the generations are reset once the limit is exceeded, and the query in flight isn't cached
+	for i := 0; i < 10; i++ {
+		qc.Generation("db3", fmt.Sprintf("m%d", i))
+	}
+	if n := len(qc.generations); n > 4 {
+		t.Errorf("generations = %d, want at most 4", n)
+	}
+	qc.Set("key", "db1", "cpu", gen, httptest.NewRecorder().Header(), []byte("body"), time.Minute)
+	if _, ok := qc.Get("key", httptest.NewRecorder()); ok {
+		t.Error("query in flight during the reset shouldn't be cached")
+	}
+}
+
+func TestQueryCacheTTL(t *testing.T) {
+	qc := NewQueryCache(&ProxyConfig{QueryCacheTTL: 60, QueryCacheNowTTL: 10, QueryCacheMaxSize: 1})
+	tests := []struct {
+		q   string
+		ttl time.Duration
+	}{
+		{"select * from cpu", 10 * time.Second},
+		{"select * from cpu where time > now() - 1h", 10 * time.Second},
+		{"select * from cpu where time >= '2021-01-01T00:00:00Z'", 10 * time.Second},
+		{"select * from cpu where time >= '2021-01-01T00:00:00Z' and time < '2021-01-02T00:00:00Z'", 60 * time.Second},
+		{"select * from cpu where time >= now() - 1h", 10 * time.Second},
+		{"select * from cpu where time >= now() - 2h and time < now() - 1h", 10 * time.Second},
+		{"select * from cpu where time >= 1609459200000000000 and time <= 1609545600000000000", 60 * time.Second},
+		{"SELECT * FROM cpu WHERE host = 'a' AND time >= '2021-01-01T00:00:00Z' AND time < '2021-01-02T00:00:00Z'", 60 * time.Second},
+		{"select * from cpu where time < '2999-01-01T00:00:00Z'", 10 * time.Second},
+		{"select * from cpu where time < '2021-01-02T00:00:00Z'; select * from mem", 10 * time.Second},
+		{"show tag keys from cpu", 10 * time.Second},
+		{"select * from", 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if ttl := qc.TTL(tt.q); ttl != tt.ttl {
+			t.Errorf("ttl wrong: %s, %s != %s", tt.q, ttl, tt.ttl)
+		}
+	}
+}
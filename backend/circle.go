@@ -20,7 +20,7 @@ type Circle struct {
 	mapToBackend map[string]*Backend
 }
 
-func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle) { // nolint:golint
+func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle, err error) { // nolint:golint
 	ic = &Circle{
 		CircleId:     circleId,
 		Name:         cfg.Name,
@@ -30,7 +30,10 @@ func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle)
 	}
 	ic.router.NumberOfReplicas = 256
 	for idx, bkcfg := range cfg.Backends {
-		ic.Backends[idx] = NewBackend(bkcfg, pxcfg)
+		ic.Backends[idx], err = NewBackend(bkcfg, pxcfg)
+		if err != nil {
+			return nil, err
+		}
 		ic.addRouter(ic.Backends[idx], idx, pxcfg.HashKey)
 	}
 	return
@@ -6,6 +6,7 @@ package backend
 
 import (
 	"errors"
+	"fmt"
 	"log"
 
 	"github.com/chengshiwen/influx-proxy/util"
@@ -25,6 +26,7 @@ var (
 	ErrEmptyBackendName      = errors.New("backend name cannot be empty")
 	ErrDuplicatedBackendName = errors.New("backend name duplicated")
 	ErrInvalidHashKey        = errors.New("invalid hash_key, require idx, exi, name or url")
+	ErrJWTWithoutUsers       = errors.New("jwt requires username and password or users to map the token to")
 )
 
 type BackendConfig struct { // nolint:golint
@@ -34,6 +36,12 @@ type BackendConfig struct { // nolint:golint
 	Password    string `mapstructure:"password"`
 	AuthEncrypt bool   `mapstructure:"auth_encrypt"`
 	WriteOnly   bool   `mapstructure:"write_only"`
+
+	TLSCA                 string `mapstructure:"tls_ca"`
+	TLSCert               string `mapstructure:"tls_cert"`
+	TLSKey                string `mapstructure:"tls_key"`
+	TLSServerName         string `mapstructure:"tls_server_name"`
+	TLSInsecureSkipVerify bool   `mapstructure:"tls_insecure_skip_verify"`
 }
 
 type CircleConfig struct {
@@ -42,28 +50,52 @@ type CircleConfig struct {
 }
 
 type ProxyConfig struct {
-	Circles         []*CircleConfig `mapstructure:"circles"`
-	ListenAddr      string          `mapstructure:"listen_addr"`
-	DBList          []string        `mapstructure:"db_list"`
-	DataDir         string          `mapstructure:"data_dir"`
-	TLogDir         string          `mapstructure:"tlog_dir"`
-	HashKey         string          `mapstructure:"hash_key"`
-	FlushSize       int             `mapstructure:"flush_size"`
-	FlushTime       int             `mapstructure:"flush_time"`
-	CheckInterval   int             `mapstructure:"check_interval"`
-	RewriteInterval int             `mapstructure:"rewrite_interval"`
-	ConnPoolSize    int             `mapstructure:"conn_pool_size"`
-	WriteTimeout    int             `mapstructure:"write_timeout"`
-	IdleTimeout     int             `mapstructure:"idle_timeout"`
-	Username        string          `mapstructure:"username"`
-	Password        string          `mapstructure:"password"`
-	AuthEncrypt     bool            `mapstructure:"auth_encrypt"`
-	WriteTracing    bool            `mapstructure:"write_tracing"`
-	QueryTracing    bool            `mapstructure:"query_tracing"`
-	PprofEnabled    bool            `mapstructure:"pprof_enabled"`
-	HTTPSEnabled    bool            `mapstructure:"https_enabled"`
-	HTTPSCert       string          `mapstructure:"https_cert"`
-	HTTPSKey        string          `mapstructure:"https_key"`
+	Circles                     []*CircleConfig        `mapstructure:"circles"`
+	ListenAddr                  string                 `mapstructure:"listen_addr"`
+	DBList                      []string               `mapstructure:"db_list"`
+	DataDir                     string                 `mapstructure:"data_dir"`
+	TLogDir                     string                 `mapstructure:"tlog_dir"`
+	HashKey                     string                 `mapstructure:"hash_key"`
+	FlushSize                   int                    `mapstructure:"flush_size"`
+	FlushTime                   int                    `mapstructure:"flush_time"`
+	CheckInterval               int                    `mapstructure:"check_interval"`
+	RewriteInterval             int                    `mapstructure:"rewrite_interval"`
+	ConnPoolSize                int                    `mapstructure:"conn_pool_size"`
+	WriteTimeout                int                    `mapstructure:"write_timeout"`
+	IdleTimeout                 int                    `mapstructure:"idle_timeout"`
+	Username                    string                 `mapstructure:"username"`
+	Password                    string                 `mapstructure:"password"`
+	AuthEncrypt                 bool                   `mapstructure:"auth_encrypt"`
+	CipherKeyFile               string                 `mapstructure:"cipher_key_file"`
+	Users                       []*UserConfig          `mapstructure:"users"`
+	UsersFile                   string                 `mapstructure:"users_file"`
+	JWTSharedSecret             string                 `mapstructure:"jwt_shared_secret"`
+	JWTJwksFile                 string                 `mapstructure:"jwt_jwks_file"`
+	JWTUsernameClaim            string                 `mapstructure:"jwt_username_claim"`
+	WriteTracing                bool                   `mapstructure:"write_tracing"`
+	QueryTracing                bool                   `mapstructure:"query_tracing"`
+	AuditLogFile                string                 `mapstructure:"audit_log_file"`
+	QueryCacheEnabled           bool                   `mapstructure:"query_cache_enabled"`
+	QueryCacheTTL               int                    `mapstructure:"query_cache_ttl"`
+	QueryCacheNowTTL            int                    `mapstructure:"query_cache_now_ttl"`
+	QueryCacheMaxSize           int                    `mapstructure:"query_cache_max_size"`
+	QueryTimeout                int                    `mapstructure:"query_timeout"`
+	MaxConcurrentQueries        int                    `mapstructure:"max_concurrent_queries"`
+	MaxConcurrentQueriesPerUser int                    `mapstructure:"max_concurrent_queries_per_user"`
+	HedgeEnabled                bool                   `mapstructure:"hedge_enabled"`
+	HedgePercentile             float64                `mapstructure:"hedge_percentile"`
+	QueryPolicies               []*QueryPolicyConfig   `mapstructure:"query_policies"`
+	StatementRules              []*StatementRuleConfig `mapstructure:"statement_rules"`
+	RateLimits                  []*RateLimitConfig     `mapstructure:"rate_limits"`
+	PprofEnabled                bool                   `mapstructure:"pprof_enabled"`
+	HTTPSEnabled                bool                   `mapstructure:"https_enabled"`
+	HTTPSCert                   string                 `mapstructure:"https_cert"`
+	HTTPSKey                    string                 `mapstructure:"https_key"`
+	HTTPSClientCA               string                 `mapstructure:"https_client_ca"`
+	HTTPSClientAuthRequired     bool                   `mapstructure:"https_client_auth_required"`
+	HTTPSPeerCA                 string                 `mapstructure:"https_peer_ca"`
+	HTTPSPeerCert               string                 `mapstructure:"https_peer_cert"`
+	HTTPSPeerKey                string                 `mapstructure:"https_peer_key"`
 }
 
 func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
@@ -79,9 +111,58 @@ func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
 	}
 	cfg.setDefault()
 	err = cfg.checkConfig()
+	if err != nil {
+		return
+	}
+	err = cfg.loadCipherKey()
 	return
 }
 
+// loadCipherKey sets the cipher key and checks the encrypted credentials,
+// the credentials encrypted by the legacy cipher are still readable but should be encrypted again
+func (cfg *ProxyConfig) loadCipherKey() error {
+	key, err := util.LoadCipherKey(cfg.CipherKeyFile)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		if err = util.SetCipherKey(key); err != nil {
+			return err
+		}
+	}
+	check := func(name, value string) error {
+		if _, err := util.Decrypt(value); err != nil {
+			return fmt.Errorf("decrypt %s error: %s", name, err)
+		}
+		if util.IsLegacyCiphertext(value) {
+			log.Printf("%s is encrypted by the legacy cipher, please encrypt it again by /encrypt", name)
+		}
+		return nil
+	}
+	if cfg.AuthEncrypt {
+		if err = check("username", cfg.Username); err != nil {
+			return err
+		}
+		if err = check("password", cfg.Password); err != nil {
+			return err
+		}
+	}
+	for _, circle := range cfg.Circles {
+		for _, backend := range circle.Backends {
+			if !backend.AuthEncrypt {
+				continue
+			}
+			if err = check(fmt.Sprintf("username of backend %s", backend.Name), backend.Username); err != nil {
+				return err
+			}
+			if err = check(fmt.Sprintf("password of backend %s", backend.Name), backend.Password); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (cfg *ProxyConfig) setDefault() {
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = ":7076"
@@ -116,6 +197,21 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 10
 	}
+	if cfg.QueryCacheTTL <= 0 {
+		cfg.QueryCacheTTL = 60
+	}
+	if cfg.QueryCacheNowTTL <= 0 {
+		cfg.QueryCacheNowTTL = 10
+	}
+	if cfg.QueryCacheMaxSize <= 0 {
+		cfg.QueryCacheMaxSize = 64
+	}
+	if cfg.JWTUsernameClaim == "" {
+		cfg.JWTUsernameClaim = "username"
+	}
+	if cfg.HedgePercentile <= 0 || cfg.HedgePercentile > 100 {
+		cfg.HedgePercentile = 95
+	}
 }
 
 func (cfg *ProxyConfig) checkConfig() (err error) {
@@ -135,11 +231,48 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 				return ErrDuplicatedBackendName
 			}
 			set.Add(backend.Name)
+			if _, err = NewBackendTLSConfig(backend); err != nil {
+				return fmt.Errorf("tls config of backend %s error: %s", backend.Name, err)
+			}
 		}
 	}
 	if cfg.HashKey != "idx" && cfg.HashKey != "exi" && cfg.HashKey != "name" && cfg.HashKey != "url" {
 		return ErrInvalidHashKey
 	}
+	_, err = NewQueryPolicies(cfg.QueryPolicies)
+	if err != nil {
+		return
+	}
+	_, err = NewStatementRules(cfg.StatementRules)
+	if err != nil {
+		return
+	}
+	_, err = NewRateLimiter(cfg.RateLimits)
+	if err != nil {
+		return
+	}
+	if len(cfg.Users) > 0 || cfg.UsersFile != "" {
+		_, err = NewUserStore(cfg.Users, cfg.UsersFile)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.HTTPSEnabled {
+		_, err = NewServerTLSConfig(cfg)
+		if err != nil {
+			return
+		}
+		_, err = NewPeerTLSConfig(cfg)
+		if err != nil {
+			return fmt.Errorf("tls config of ha peers error: %s", err)
+		}
+	}
+	if cfg.JWTEnabled() {
+		if cfg.Username == "" && cfg.Password == "" && len(cfg.Users) == 0 && cfg.UsersFile == "" {
+			return ErrJWTWithoutUsers
+		}
+		_, err = NewJWTValidator(cfg.JWTSharedSecret, cfg.JWTJwksFile, cfg.JWTUsernameClaim)
+	}
 	return
 }
 
@@ -153,6 +286,40 @@ func (cfg *ProxyConfig) PrintSummary() {
 		log.Printf("db list: %v", cfg.DBList)
 	}
 	log.Printf("auth: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "", cfg.AuthEncrypt)
+	if len(cfg.Users) > 0 || cfg.UsersFile != "" {
+		log.Printf("users: %d loaded from config, file: %s", len(cfg.Users), cfg.UsersFile)
+	}
+	if cfg.HTTPSEnabled && cfg.HTTPSClientCA != "" {
+		log.Printf("https client ca: %s, client auth required: %t", cfg.HTTPSClientCA, cfg.HTTPSClientAuthRequired)
+	}
+	if cfg.JWTEnabled() {
+		log.Printf("jwt: shared secret %t, jwks file: %s, username claim: %s", cfg.JWTSharedSecret != "", cfg.JWTJwksFile, cfg.JWTUsernameClaim)
+	}
+	if cfg.AuditLogFile != "" {
+		log.Printf("audit log file: %s", cfg.AuditLogFile)
+	}
+	if cfg.QueryCacheEnabled {
+		log.Printf("query cache: ttl %ds, now ttl %ds, max size %dMB", cfg.QueryCacheTTL, cfg.QueryCacheNowTTL, cfg.QueryCacheMaxSize)
+	}
+	if cfg.QueryTimeout > 0 || cfg.MaxConcurrentQueries > 0 || cfg.MaxConcurrentQueriesPerUser > 0 {
+		log.Printf("query timeout: %ds, max concurrent queries: %d, per user: %d", cfg.QueryTimeout, cfg.MaxConcurrentQueries, cfg.MaxConcurrentQueriesPerUser)
+	}
+	if cfg.HedgeEnabled {
+		log.Printf("hedged query: percentile %g", cfg.HedgePercentile)
+	}
+	if len(cfg.QueryPolicies) > 0 {
+		log.Printf("%d query policies loaded", len(cfg.QueryPolicies))
+	}
+	if len(cfg.StatementRules) > 0 {
+		log.Printf("%d statement rules loaded", len(cfg.StatementRules))
+	}
+	if len(cfg.RateLimits) > 0 {
+		log.Printf("%d rate limits loaded", len(cfg.RateLimits))
+	}
+}
+
+func (cfg *ProxyConfig) JWTEnabled() bool {
+	return cfg.JWTSharedSecret != "" || cfg.JWTJwksFile != ""
 }
 
 func (cfg *ProxyConfig) String() string {
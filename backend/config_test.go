@@ -0,0 +1,108 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// legacyEncrypt encrypts the text as the previous versions, by AES-CBC with the fixed key as iv and zero padding
+func legacyEncrypt(text string) string {
+	key := []byte("consistentcipher")
+	block, _ := aes.NewCipher(key)
+	b := []byte(text)
+	for len(b)%block.BlockSize() != 0 {
+		b = append(b, 0)
+	}
+	cipher.NewCBCEncrypter(block, key).CryptBlocks(b, b)
+	return base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_!").WithPadding(base64.NoPadding).EncodeToString(b)
+}
+
+func TestLoadCipherKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cipher.key")
+	ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))+"\n"), 0600)
+	cfg := &ProxyConfig{CipherKeyFile: file}
+	if err := cfg.loadCipherKey(); err != nil {
+		t.Fatalf("load cipher key error: %s", err)
+	}
+
+	encrypt, err := util.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt error: %s", err)
+	}
+	if again, _ := util.Encrypt("secret"); again == encrypt || util.IsLegacyCiphertext(encrypt) {
+		t.Errorf("ciphertexts should be versioned with random nonces: %s, %s", encrypt, again)
+	}
+	if decrypt, err := util.Decrypt(encrypt); err != nil || decrypt != "secret" {
+		t.Errorf("decrypt = %s, %v", decrypt, err)
+	}
+	tampered := []byte(encrypt)
+	if tampered[10] == 'A' {
+		tampered[10] = 'B'
+	} else {
+		tampered[10] = 'A'
+	}
+	if _, err := util.Decrypt(string(tampered)); err != util.ErrInvalidCiphertext {
+		t.Errorf("tampered ciphertext should be rejected: %v", err)
+	}
+	legacy := legacyEncrypt("admin")
+	if decrypt, err := util.Decrypt(legacy); err != nil || decrypt != "admin" || !util.IsLegacyCiphertext(legacy) {
+		t.Errorf("legacy decrypt = %s, %v", decrypt, err)
+	}
+
+	cfg = &ProxyConfig{
+		AuthEncrypt:   true,
+		Username:      legacy,
+		Password:      encrypt,
+		Circles:       []*CircleConfig{{Backends: []*BackendConfig{{Name: "b1", AuthEncrypt: true, Username: encrypt, Password: "v2:invalid"}}}},
+		CipherKeyFile: file,
+	}
+	if err := cfg.loadCipherKey(); err == nil {
+		t.Error("invalid ciphertext of backend should be rejected")
+	}
+	cfg.Circles[0].Backends[0].Password = encrypt
+	if err := cfg.loadCipherKey(); err != nil {
+		t.Errorf("load cipher key error: %s", err)
+	}
+
+	ioutil.WriteFile(file, []byte("short"), 0600)
+	if err := cfg.loadCipherKey(); err != util.ErrInvalidCipherKey {
+		t.Errorf("invalid key error = %v", err)
+	}
+}
+
+func TestCheckJWTConfig(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	tests := []struct {
+		name     string
+		username string
+		users    []*UserConfig
+		err      error
+	}{
+		{name: "jwt alone", err: ErrJWTWithoutUsers},
+		{name: "proxy user", username: "admin"},
+		{name: "users", users: []*UserConfig{{Name: "alice", PasswordHash: string(hash)}}},
+	}
+	for _, tt := range tests {
+		cfg := &ProxyConfig{
+			Circles:         []*CircleConfig{{Backends: []*BackendConfig{{Name: "b1", Url: "http://127.0.0.1:8086"}}}},
+			HashKey:         "idx",
+			Username:        tt.username,
+			Users:           tt.users,
+			JWTSharedSecret: "secret",
+		}
+		if err := cfg.checkConfig(); err != tt.err {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
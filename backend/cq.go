@@ -0,0 +1,326 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrContinuousQueryExists   = errors.New("continuous query already exists")
+	ErrContinuousQueryNotFound = errors.New("continuous query not found")
+	ErrContinuousQueryGroupBy  = errors.New("continuous query must contain a group by time clause")
+)
+
+var groupByTimeOffsetReg = regexp.MustCompile(`(?i)\btime\s*\(\s*(\d+[a-zµ]+)\s*(?:,\s*(-?\d+[a-zµ]+)\s*)?\)`)
+
+// ContinuousQuery is a continuous query managed by the proxy, the select into statement is run on the backend
+// which owns the source measurement, and the result is written through the proxy so that it's sharded correctly
+type ContinuousQuery struct {
+	Name  string `json:"name"`
+	Db    string `json:"db"`
+	Query string `json:"query"`
+
+	selectQ  string
+	interval time.Duration
+	offset   time.Duration
+	every    time.Duration
+	forDur   time.Duration
+
+	running     bool
+	nextRun     time.Time
+	lastRun     time.Time
+	lastStatus  string
+	lastError   string
+	lastWritten int
+}
+
+// ParseContinuousQuery parses the statement:
+// CREATE CONTINUOUS QUERY <name> ON <db> [RESAMPLE [EVERY <interval>] [FOR <interval>]] BEGIN <select into> END
+func ParseContinuousQuery(q string) (cq *ContinuousQuery, err error) {
+	q = strings.TrimRight(strings.TrimSpace(q), ";")
+	begin := FindKeyword(q, "begin")
+	if begin < 0 {
+		return nil, ErrIllegalQL
+	}
+	head := ScanTokens(q[:begin], 0)
+	if len(head) < 6 || GetHeadStmtFromTokens(head, 3) != "create continuous query" || strings.ToLower(head[4]) != "on" {
+		return nil, ErrIllegalQL
+	}
+	cq = &ContinuousQuery{Name: trimQuotes(head[3]), Db: trimQuotes(head[5]), Query: q}
+	if len(head) > 6 {
+		if strings.ToLower(head[6]) != "resample" || len(head)%2 != 1 {
+			return nil, ErrIllegalQL
+		}
+		for i := 7; i+1 < len(head); i += 2 {
+			d, err := ParseDuration(head[i+1])
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid resample duration: %s", head[i+1])
+			}
+			switch strings.ToLower(head[i]) {
+			case "every":
+				cq.every = d
+			case "for":
+				cq.forDur = d
+			default:
+				return nil, ErrIllegalQL
+			}
+		}
+	}
+
+	body := q[begin+len("begin"):]
+	end := FindKeyword(body, "end")
+	if end < 0 || strings.TrimSpace(body[end+len("end"):]) != "" {
+		return nil, ErrIllegalQL
+	}
+	cq.selectQ = strings.TrimSpace(body[:end])
+	if !CheckSelectIntoFromTokens(ScanTokens(cq.selectQ, 0)) {
+		return nil, errors.New("continuous query must contain a select into statement")
+	}
+	group := FindKeyword(cq.selectQ, "group")
+	if group < 0 {
+		return nil, ErrContinuousQueryGroupBy
+	}
+	m := groupByTimeOffsetReg.FindStringSubmatch(cq.selectQ[group:])
+	if m == nil {
+		return nil, ErrContinuousQueryGroupBy
+	}
+	cq.interval, err = ParseDuration(m[1])
+	if err != nil || cq.interval <= 0 {
+		return nil, fmt.Errorf("invalid group by time interval: %s", m[1])
+	}
+	if m[2] != "" {
+		offset, err := ParseDuration(strings.TrimPrefix(m[2], "-"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid group by time offset: %s", m[2])
+		}
+		if strings.HasPrefix(m[2], "-") {
+			offset = -offset
+		}
+		cq.offset = offset % cq.interval
+	}
+	if cq.every == 0 {
+		cq.every = cq.interval
+	}
+	if cq.forDur == 0 {
+		cq.forDur = cq.interval
+		if cq.every > cq.forDur {
+			cq.forDur = cq.every
+		}
+	}
+	if cq.forDur < cq.interval {
+		return nil, fmt.Errorf("resample for %s must be greater than or equal to group by time %s", cq.forDur, cq.interval)
+	}
+	return cq, nil
+}
+
+// NextRun returns the first time after now which is the multiple of every since epoch plus the offset
+func (cq *ContinuousQuery) NextRun(now time.Time) time.Time {
+	every := int64(cq.every)
+	ns := now.UnixNano() - int64(cq.offset)
+	return time.Unix(0, ns-ns%every+every+int64(cq.offset))
+}
+
+// SelectQuery returns the select into statement with the time range [start, end)
+func (cq *ContinuousQuery) SelectQuery(start, end time.Time) string {
+	cond := fmt.Sprintf("time >= %d AND time < %d", start.UnixNano(), end.UnixNano())
+	if where := FindKeyword(cq.selectQ, "where"); where >= 0 {
+		group := FindKeyword(cq.selectQ, "group")
+		return cq.selectQ[:where] + "WHERE " + cond + " AND (" + strings.TrimSpace(cq.selectQ[where+len("where"):group]) + ") " + cq.selectQ[group:]
+	}
+	return InsertClause(cq.selectQ, "WHERE "+cond, "group")
+}
+
+// ContinuousQueryStatus is the definition and the last run status of a continuous query
+type ContinuousQueryStatus struct {
+	Name        string
+	Db          string
+	Query       string
+	NextRun     time.Time
+	LastRun     time.Time
+	LastStatus  string
+	LastError   string
+	LastWritten int
+}
+
+// ContinuousQueries is the set of continuous queries managed by the proxy,
+// the definitions are saved as json in the file continuous_queries.json under the data dir
+type ContinuousQueries struct {
+	lock     sync.Mutex
+	filename string
+	cqs      []*ContinuousQuery
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewContinuousQueries(datadir string) (cqs *ContinuousQueries, err error) {
+	cqs = &ContinuousQueries{filename: filepath.Join(datadir, "continuous_queries.json"), done: make(chan struct{})}
+	b, err := ioutil.ReadFile(cqs.filename)
+	if os.IsNotExist(err) {
+		return cqs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var defs []*ContinuousQuery
+	if err = json.Unmarshal(b, &defs); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, def := range defs {
+		cq, err := ParseContinuousQuery(def.Query)
+		if err != nil {
+			log.Printf("continuous query error: %s, file: %s, query: %s", err, cqs.filename, def.Query)
+			continue
+		}
+		cq.nextRun = cq.NextRun(now)
+		cqs.cqs = append(cqs.cqs, cq)
+	}
+	return cqs, nil
+}
+
+func (cqs *ContinuousQueries) Create(cq *ContinuousQuery) error {
+	cqs.lock.Lock()
+	defer cqs.lock.Unlock()
+	for _, c := range cqs.cqs {
+		if c.Db == cq.Db && c.Name == cq.Name {
+			return ErrContinuousQueryExists
+		}
+	}
+	cq.nextRun = cq.NextRun(time.Now())
+	cqs.cqs = append(cqs.cqs, cq)
+	return cqs.save()
+}
+
+func (cqs *ContinuousQueries) Drop(db, name string) error {
+	cqs.lock.Lock()
+	defer cqs.lock.Unlock()
+	for i, c := range cqs.cqs {
+		if c.Db == db && c.Name == name {
+			cqs.cqs = append(cqs.cqs[:i:i], cqs.cqs[i+1:]...)
+			return cqs.save()
+		}
+	}
+	return ErrContinuousQueryNotFound
+}
+
+// DropDatabase drops the continuous queries on the database
+func (cqs *ContinuousQueries) DropDatabase(db string) error {
+	cqs.lock.Lock()
+	defer cqs.lock.Unlock()
+	kept := make([]*ContinuousQuery, 0, len(cqs.cqs))
+	for _, c := range cqs.cqs {
+		if c.Db != db {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(cqs.cqs) {
+		return nil
+	}
+	cqs.cqs = kept
+	return cqs.save()
+}
+
+func (cqs *ContinuousQueries) List() []*ContinuousQueryStatus {
+	cqs.lock.Lock()
+	defer cqs.lock.Unlock()
+	list := make([]*ContinuousQueryStatus, len(cqs.cqs))
+	for i, c := range cqs.cqs {
+		list[i] = &ContinuousQueryStatus{
+			Name:        c.Name,
+			Db:          c.Db,
+			Query:       c.Query,
+			NextRun:     c.nextRun,
+			LastRun:     c.lastRun,
+			LastStatus:  c.lastStatus,
+			LastError:   c.lastError,
+			LastWritten: c.lastWritten,
+		}
+	}
+	return list
+}
+
+// Start runs the continuous queries on their schedule until Close is called,
+// a continuous query is skipped if its last run is not finished yet
+func (cqs *ContinuousQueries) Start(ip *Proxy) {
+	cqs.wg.Add(1)
+	go func() {
+		defer cqs.wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cqs.done:
+				return
+			case now := <-ticker.C:
+				cqs.lock.Lock()
+				for _, c := range cqs.cqs {
+					if c.running || now.Before(c.nextRun) {
+						continue
+					}
+					c.running = true
+					end := c.nextRun
+					c.nextRun = c.NextRun(now)
+					cqs.wg.Add(1)
+					go cqs.run(ip, c, end)
+				}
+				cqs.lock.Unlock()
+			}
+		}
+	}()
+}
+
+func (cqs *ContinuousQueries) run(ip *Proxy, cq *ContinuousQuery, end time.Time) {
+	defer cqs.wg.Done()
+	q := cq.SelectQuery(end.Add(-cq.forDur), end)
+	written, err := selectInto(NewQueryRequest("GET", cq.Db, q, ""), ip, ScanTokens(q, 0), cq.Db)
+	if err != nil {
+		log.Printf("continuous query %s on %s error: %s, the query is %s", cq.Name, cq.Db, err, q)
+	}
+	cqs.lock.Lock()
+	defer cqs.lock.Unlock()
+	cq.running = false
+	cq.lastRun = end
+	cq.lastWritten = written
+	if err != nil {
+		cq.lastStatus, cq.lastError = "error", err.Error()
+	} else {
+		cq.lastStatus, cq.lastError = "success", ""
+	}
+}
+
+func (cqs *ContinuousQueries) Close() {
+	close(cqs.done)
+	cqs.wg.Wait()
+}
+
+func (cqs *ContinuousQueries) save() error {
+	b, err := json.Marshal(cqs.cqs)
+	if err != nil {
+		return err
+	}
+	tmp := cqs.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cqs.filename)
+}
+
+func trimQuotes(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseContinuousQuery(t *testing.T) {
+	tests := []struct {
+		q        string
+		name     string
+		db       string
+		interval time.Duration
+		every    time.Duration
+		forDur   time.Duration
+		err      bool
+	}{
+		{`CREATE CONTINUOUS QUERY cq1 ON db1 BEGIN SELECT mean(v) INTO cpu_1h FROM cpu GROUP BY time(1h), host END`, "cq1", "db1", time.Hour, time.Hour, time.Hour, false},
+		{`create continuous query "cq 2" on "db1" resample every 30m for 2h begin select max(v) into db2.rp.cpu_1h from cpu group by time(1h, 15m) end;`, "cq 2", "db1", time.Hour, 30 * time.Minute, 2 * time.Hour, false},
+		{`CREATE CONTINUOUS QUERY cq3 ON db1 RESAMPLE EVERY 2h BEGIN SELECT mean(v) INTO cpu_1h FROM cpu GROUP BY time(1h) END`, "cq3", "db1", time.Hour, 2 * time.Hour, 2 * time.Hour, false},
+		{`CREATE CONTINUOUS QUERY cq4 ON db1 BEGIN SELECT mean(v) INTO cpu_1h FROM cpu END`, "", "", 0, 0, 0, true},
+		{`CREATE CONTINUOUS QUERY cq5 ON db1 BEGIN SELECT mean(v) FROM cpu GROUP BY time(1h) END`, "", "", 0, 0, 0, true},
+		{`CREATE CONTINUOUS QUERY cq6 ON db1 RESAMPLE FOR 30m BEGIN SELECT mean(v) INTO cpu_1h FROM cpu GROUP BY time(1h) END`, "", "", 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		cq, err := ParseContinuousQuery(tt.q)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parse %s: expected error", tt.q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse %s: %s", tt.q, err)
+			continue
+		}
+		if cq.Name != tt.name || cq.Db != tt.db || cq.interval != tt.interval || cq.every != tt.every || cq.forDur != tt.forDur {
+			t.Errorf("parse %s: got %s %s %s %s %s", tt.q, cq.Name, cq.Db, cq.interval, cq.every, cq.forDur)
+		}
+	}
+}
+
+func TestContinuousQuerySchedule(t *testing.T) {
+	cq, err := ParseContinuousQuery(`CREATE CONTINUOUS QUERY cq1 ON db1 BEGIN SELECT mean(v) INTO cpu_1h FROM cpu WHERE host = 'a' OR host = 'b' GROUP BY time(1h, 15m) END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 1, 1, 10, 20, 0, 0, time.UTC)
+	if next := cq.NextRun(now); !next.Equal(time.Date(2021, 1, 1, 11, 15, 0, 0, time.UTC)) {
+		t.Errorf("next run = %s", next)
+	}
+	end := time.Date(2021, 1, 1, 10, 15, 0, 0, time.UTC)
+	want := `SELECT mean(v) INTO cpu_1h FROM cpu WHERE time >= 1609492500000000000 AND time < 1609496100000000000 AND (host = 'a' OR host = 'b') GROUP BY time(1h, 15m)`
+	if q := cq.SelectQuery(end.Add(-cq.forDur), end); q != want {
+		t.Errorf("select query = %s, want %s", q, want)
+	}
+}
+
+func TestContinuousQueries(t *testing.T) {
+	dir := t.TempDir()
+	cqs, err := NewContinuousQueries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`CREATE CONTINUOUS QUERY cq1 ON db1 BEGIN SELECT mean(v) INTO cpu_1h FROM cpu GROUP BY time(1h) END`,
+		`CREATE CONTINUOUS QUERY cq2 ON db2 BEGIN SELECT mean(v) INTO mem_1h FROM mem GROUP BY time(1h) END`,
+	} {
+		cq, _ := ParseContinuousQuery(q)
+		if err := cqs.Create(cq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cq, _ := ParseContinuousQuery(`CREATE CONTINUOUS QUERY cq1 ON db1 BEGIN SELECT max(v) INTO cpu_1h FROM cpu GROUP BY time(1h) END`)
+	if err := cqs.Create(cq); err != ErrContinuousQueryExists {
+		t.Errorf("create duplicate error = %v", err)
+	}
+	if err := cqs.Drop("db1", "cq3"); err != ErrContinuousQueryNotFound {
+		t.Errorf("drop missing error = %v", err)
+	}
+	if err := cqs.Drop("db1", "cq1"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(cqs.filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("continuous queries file should be private: %v, %v", fi, err)
+	}
+
+	cqs, err = NewContinuousQueries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := cqs.List()
+	if len(list) != 1 || list[0].Name != "cq2" || list[0].Db != "db2" || list[0].NextRun.IsZero() {
+		t.Errorf("unexpected continuous queries after reload: %+v", list)
+	}
+}
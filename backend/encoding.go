@@ -0,0 +1,349 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// ResponseEncoder encodes a response into the format requested by the client
+type ResponseEncoder interface {
+	ContentType() string
+	Encode(rsp *Response) []byte
+}
+
+// NewResponseEncoder returns the encoder of the first supported media type in the Accept header, json by default
+func NewResponseEncoder(req *http.Request) ResponseEncoder {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/csv", "text/csv":
+			return &csvEncoder{}
+		case "application/x-msgpack":
+			return &msgpackEncoder{}
+		case "application/json", "*/*":
+			return &jsonEncoder{pretty: req.URL.Query().Get("pretty") == "true"}
+		}
+	}
+	return &jsonEncoder{pretty: req.URL.Query().Get("pretty") == "true"}
+}
+
+type jsonEncoder struct {
+	pretty bool
+}
+
+func (je *jsonEncoder) ContentType() string {
+	return "application/json"
+}
+
+func (je *jsonEncoder) Encode(rsp *Response) []byte {
+	return util.MarshalJSON(rsp, je.pretty)
+}
+
+// csvEncoder encodes the response in the same way as the csv format of influxdb
+type csvEncoder struct {
+	statementID int
+	columns     []string
+}
+
+func (ce *csvEncoder) ContentType() string {
+	return "text/csv"
+}
+
+func (ce *csvEncoder) Encode(rsp *Response) []byte {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if rsp.Err != "" {
+		cw.Write([]string{"error"})
+		cw.Write([]string{rsp.Err})
+		cw.Flush()
+		return buf.Bytes()
+	}
+	for _, result := range rsp.Results {
+		if result.Err != "" {
+			cw.Write([]string{"error"})
+			cw.Write([]string{result.Err})
+			continue
+		}
+		if result.StatementID != ce.statementID || ce.columns == nil {
+			if len(result.Series) == 0 {
+				continue
+			}
+			if ce.columns != nil {
+				cw.Flush()
+				buf.WriteByte('\n')
+			}
+			ce.statementID = result.StatementID
+			ce.columns = nil
+		}
+		for _, row := range result.Series {
+			if len(ce.columns) != len(row.Columns)+2 {
+				ce.columns = make([]string, len(row.Columns)+2)
+				ce.columns[0], ce.columns[1] = "name", "tags"
+				copy(ce.columns[2:], row.Columns)
+				cw.Write(ce.columns)
+			}
+			tags := csvTags(row)
+			for _, values := range row.Values {
+				ce.columns[0], ce.columns[1] = row.Name, tags
+				for i, value := range values {
+					if i+2 >= len(ce.columns) {
+						break
+					}
+					if value == nil {
+						ce.columns[i+2] = ""
+					} else {
+						ce.columns[i+2] = util.CastString(value)
+					}
+				}
+				cw.Write(ce.columns)
+			}
+		}
+	}
+	cw.Flush()
+	return buf.Bytes()
+}
+
+func csvTags(row *models.Row) string {
+	keys := make([]string, 0, len(row.Tags))
+	for k := range row.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]string, len(keys))
+	for i, k := range keys {
+		tags[i] = k + "=" + row.Tags[k]
+	}
+	return strings.Join(tags, ",")
+}
+
+// msgpackEncoder encodes the response in the same layout as the msgpack format of influxdb
+type msgpackEncoder struct {
+	buf bytes.Buffer
+}
+
+func (me *msgpackEncoder) ContentType() string {
+	return "application/x-msgpack"
+}
+
+func (me *msgpackEncoder) Encode(rsp *Response) []byte {
+	me.buf.Reset()
+	me.writeMapHeader(1)
+	if rsp.Err != "" {
+		me.writeString("error")
+		me.writeString(rsp.Err)
+		return me.buf.Bytes()
+	}
+	me.writeString("results")
+	me.writeArrayHeader(len(rsp.Results))
+	for _, result := range rsp.Results {
+		if result.Err != "" {
+			me.writeMapHeader(1)
+			me.writeString("error")
+			me.writeString(result.Err)
+			continue
+		}
+		size := 2
+		if len(result.Messages) > 0 {
+			size++
+		}
+		if result.Partial {
+			size++
+		}
+		me.writeMapHeader(size)
+		me.writeString("statement_id")
+		me.writeInt(int64(result.StatementID))
+		if len(result.Messages) > 0 {
+			me.writeString("messages")
+			me.writeArrayHeader(len(result.Messages))
+			for _, msg := range result.Messages {
+				me.writeMapHeader(2)
+				me.writeString("level")
+				me.writeString(msg.Level)
+				me.writeString("text")
+				me.writeString(msg.Text)
+			}
+		}
+		me.writeString("series")
+		me.writeArrayHeader(len(result.Series))
+		for _, row := range result.Series {
+			me.writeRow(row)
+		}
+		if result.Partial {
+			me.writeString("partial")
+			me.writeValue(true)
+		}
+	}
+	return me.buf.Bytes()
+}
+
+func (me *msgpackEncoder) writeRow(row *models.Row) {
+	size := 2
+	if row.Name != "" {
+		size++
+	}
+	if len(row.Tags) > 0 {
+		size++
+	}
+	if row.Partial {
+		size++
+	}
+	me.writeMapHeader(size)
+	if row.Name != "" {
+		me.writeString("name")
+		me.writeString(row.Name)
+	}
+	if len(row.Tags) > 0 {
+		me.writeString("tags")
+		me.writeMapHeader(len(row.Tags))
+		for k, v := range row.Tags {
+			me.writeString(k)
+			me.writeString(v)
+		}
+	}
+	me.writeString("columns")
+	me.writeArrayHeader(len(row.Columns))
+	for _, column := range row.Columns {
+		me.writeString(column)
+	}
+	me.writeString("values")
+	me.writeArrayHeader(len(row.Values))
+	for _, values := range row.Values {
+		me.writeArrayHeader(len(values))
+		for _, value := range values {
+			me.writeValue(value)
+		}
+	}
+	if row.Partial {
+		me.writeString("partial")
+		me.writeValue(true)
+	}
+}
+
+func (me *msgpackEncoder) writeValue(v interface{}) {
+	switch tv := v.(type) {
+	case nil:
+		me.buf.WriteByte(0xc0)
+	case bool:
+		if tv {
+			me.buf.WriteByte(0xc3)
+		} else {
+			me.buf.WriteByte(0xc2)
+		}
+	case string:
+		me.writeString(tv)
+	case int:
+		me.writeInt(int64(tv))
+	case int64:
+		me.writeInt(tv)
+	case float64:
+		me.writeFloat(tv)
+	case json.Number:
+		if i, err := tv.Int64(); err == nil {
+			me.writeInt(i)
+		} else if f, err := tv.Float64(); err == nil {
+			me.writeFloat(f)
+		} else {
+			me.writeString(tv.String())
+		}
+	default:
+		s := util.CastString(v)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			me.writeInt(i)
+		} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+			me.writeFloat(f)
+		} else {
+			me.writeString(s)
+		}
+	}
+}
+
+func (me *msgpackEncoder) writeInt(i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		me.buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		me.buf.WriteByte(byte(i))
+	default:
+		me.buf.WriteByte(0xd3)
+		me.writeUint64(uint64(i))
+	}
+}
+
+func (me *msgpackEncoder) writeFloat(f float64) {
+	me.buf.WriteByte(0xcb)
+	me.writeUint64(math.Float64bits(f))
+}
+
+func (me *msgpackEncoder) writeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		me.buf.WriteByte(0xa0 | byte(n))
+	case n < 1<<8:
+		me.buf.Write([]byte{0xd9, byte(n)})
+	case n < 1<<16:
+		me.buf.WriteByte(0xda)
+		me.writeUint16(uint16(n))
+	default:
+		me.buf.WriteByte(0xdb)
+		me.writeUint32(uint32(n))
+	}
+	me.buf.WriteString(s)
+}
+
+func (me *msgpackEncoder) writeArrayHeader(n int) {
+	me.writeHeader(n, 0x90, 0xdc, 0xdd)
+}
+
+func (me *msgpackEncoder) writeMapHeader(n int) {
+	me.writeHeader(n, 0x80, 0xde, 0xdf)
+}
+
+func (me *msgpackEncoder) writeHeader(n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		me.buf.WriteByte(fix | byte(n))
+	case n < 1<<16:
+		me.buf.WriteByte(b16)
+		me.writeUint16(uint16(n))
+	default:
+		me.buf.WriteByte(b32)
+		me.writeUint32(uint32(n))
+	}
+}
+
+func (me *msgpackEncoder) writeUint16(n uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], n)
+	me.buf.Write(b[:])
+}
+
+func (me *msgpackEncoder) writeUint32(n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	me.buf.Write(b[:])
+}
+
+func (me *msgpackEncoder) writeUint64(n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	me.buf.Write(b[:])
+}
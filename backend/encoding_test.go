@@ -0,0 +1,78 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestNewResponseEncoder(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: "application/json"},
+		{accept: "application/csv", want: "text/csv"},
+		{accept: "text/csv; charset=utf-8", want: "text/csv"},
+		{accept: "application/x-msgpack", want: "application/x-msgpack"},
+		{accept: "text/html, application/x-msgpack;q=0.9", want: "application/x-msgpack"},
+		{accept: "*/*", want: "application/json"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/query", nil)
+		req.Header.Set("Accept", tt.accept)
+		if got := NewResponseEncoder(req).ContentType(); got != tt.want {
+			t.Errorf("NewResponseEncoder(%q) = %s, want %s", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCsvEncoder(t *testing.T) {
+	rsp := ResponseFromResults([]*Result{
+		{StatementID: 0, Series: models.Rows{
+			{Name: "cpu", Tags: map[string]string{"region": "us", "host": "a"}, Columns: []string{"time", "value"}, Values: [][]interface{}{{json.Number("1"), json.Number("0.5")}, {json.Number("2"), nil}}},
+		}},
+		{StatementID: 1, Series: models.Rows{
+			{Name: "databases", Columns: []string{"name"}, Values: [][]interface{}{{"db1"}}},
+		}},
+	})
+	want := "name,tags,time,value\ncpu,\"host=a,region=us\",1,0.5\ncpu,\"host=a,region=us\",2,\n\nname,tags,name\ndatabases,,db1\n"
+	if got := string((&csvEncoder{}).Encode(rsp)); got != want {
+		t.Errorf("csv encode = %q, want %q", got, want)
+	}
+	if got := string((&csvEncoder{}).Encode(ResponseFromError("bad query"))); got != "error\nbad query\n" {
+		t.Errorf("csv encode error = %q", got)
+	}
+}
+
+func TestMsgpackEncoder(t *testing.T) {
+	got := (&msgpackEncoder{}).Encode(ResponseFromError("err"))
+	want := []byte{0x81, 0xa5, 'e', 'r', 'r', 'o', 'r', 0xa3, 'e', 'r', 'r'}
+	if !bytes.Equal(got, want) {
+		t.Errorf("msgpack encode error = %x, want %x", got, want)
+	}
+	rsp := ResponseFromSeries(models.Rows{{Columns: []string{"v"}, Values: [][]interface{}{{json.Number("1"), json.Number("1.5"), "s", true, nil}}}})
+	got = (&msgpackEncoder{}).Encode(rsp)
+	var b bytes.Buffer
+	b.Write([]byte{0x81, 0xa7})
+	b.WriteString("results")
+	b.Write([]byte{0x91, 0x82, 0xac})
+	b.WriteString("statement_id")
+	b.Write([]byte{0x00, 0xa6})
+	b.WriteString("series")
+	b.Write([]byte{0x91, 0x82, 0xa7})
+	b.WriteString("columns")
+	b.Write([]byte{0x91, 0xa1, 'v', 0xa6})
+	b.WriteString("values")
+	b.Write([]byte{0x91, 0x95, 0x01, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xa1, 's', 0xc3, 0xc0})
+	if !bytes.Equal(got, b.Bytes()) {
+		t.Errorf("msgpack encode = %x, want %x", got, b.Bytes())
+	}
+}
@@ -6,12 +6,19 @@ package backend
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
@@ -26,26 +33,55 @@ var (
 )
 
 func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, err error) {
-	// pass non-active, rewriting or write-only.
-	perms := rand.Perm(len(ip.Circles))
-	for _, p := range perms {
-		be := ip.Circles[p].GetBackend(key)
-		if !be.IsActive() || be.IsRewriting() || be.IsWriteOnly() {
-			continue
+	// pass non-active, rewriting or write-only, and prefer the fastest and least loaded backend.
+	backends := ip.GetBackends(key)
+	candidates := make([]*Backend, 0, len(backends))
+	for _, p := range rand.Perm(len(backends)) {
+		be := backends[p]
+		if be.IsActive() && !be.IsRewriting() && !be.IsWriteOnly() {
+			candidates = append(candidates, be)
+		}
+	}
+	sortByScore(candidates)
+	// buffer the request body, so that each retry sends the whole body again
+	var rbody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		rbody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+	}
+	resetBody := func() {
+		if rbody != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(rbody))
+		}
+	}
+	// hedged query buffers the response, so it's not used for chunked query
+	if ip.hedgeEnabled && len(candidates) > 1 && req.FormValue("chunked") != "true" {
+		if delay := candidates[0].GetLatencyStats().Percentile(ip.hedgePercentile); delay > 0 {
+			resetBody()
+			body, err = hedgedQuery(w, req, delay, candidates[0], candidates[1], fn)
+			if err == nil {
+				return
+			}
+			candidates = candidates[2:]
 		}
-		body, err = fn(be, req, w)
+	}
+	for _, be := range candidates {
+		resetBody()
+		body, err = queryBackend(be, req, w, fn)
 		if err == nil {
 			return
 		}
 	}
 
 	// pass non-active, non-writing (excluding rewriting and write-only).
-	backends := ip.GetBackends(key)
 	for _, be := range backends {
 		if !be.IsActive() || !(be.IsRewriting() || be.IsWriteOnly()) {
 			continue
 		}
-		body, err = fn(be, req, w)
+		resetBody()
+		body, err = queryBackend(be, req, w, fn)
 		if err == nil {
 			return
 		}
@@ -57,12 +93,90 @@ func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn f
 	return nil, ErrBackendsUnavailable
 }
 
+func sortByScore(backends []*Backend) {
+	scores := make(map[*Backend]float64, len(backends))
+	for _, be := range backends {
+		scores[be] = be.GetLatencyStats().Score()
+	}
+	sort.SliceStable(backends, func(i, j int) bool {
+		return scores[backends[i]] < scores[backends[j]]
+	})
+}
+
+func queryBackend(be *Backend, req *http.Request, w http.ResponseWriter, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) ([]byte, error) {
+	ls := be.GetLatencyStats()
+	ls.Begin()
+	start := time.Now()
+	body, err := fn(be, req, w)
+	ls.End(time.Since(start), err, req.Context().Err() != nil)
+	return body, err
+}
+
+type hedgedResult struct {
+	body []byte
+	err  error
+	rb   *responseBuffer
+}
+
+// hedgedQuery sends the query to the primary backend, and sends the same query to the secondary backend
+// if the primary doesn't respond within the delay, then returns whichever answers first
+func hedgedQuery(w http.ResponseWriter, req *http.Request, delay time.Duration, primary, secondary *Backend, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, err error) {
+	var rbody []byte
+	if req.Body != nil {
+		rbody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(rbody))
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	ch := make(chan *hedgedResult, 2)
+	send := func(be *Backend) {
+		cr := req.Clone(ctx)
+		cr.Body = ioutil.NopCloser(bytes.NewReader(rbody))
+		cr.Header.Set(HeaderQueryOrigin, QueryParallel)
+		rb := newResponseBuffer()
+		body, err := queryBackend(be, cr, rb, fn)
+		ch <- &hedgedResult{body: body, err: err, rb: rb}
+	}
+
+	go send(primary)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	hedged := false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				pending++
+				go send(secondary)
+			}
+		case hr := <-ch:
+			pending--
+			if hr.err == nil {
+				hr.rb.CopyTo(w)
+				return hr.body, nil
+			}
+			err = hr.err
+			if !hedged {
+				hedged = true
+				pending++
+				go send(secondary)
+			}
+		}
+	}
+	return
+}
+
 func ReadProm(w http.ResponseWriter, req *http.Request, ip *Proxy, db, meas string) (err error) {
 	// all circles -> backend by key(db,meas) -> select or show
 	key := GetKey(db, meas)
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
-		err = be.ReadProm(req, w)
-		return nil, err
+		e := be.ReadProm(req, w)
+		return nil, e
 	}
 	_, err = query(w, req, ip, key, fn)
 	return
@@ -72,8 +186,8 @@ func QueryFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, bucket, meas
 	// all circles -> backend by key(org,bucket,meas) -> query flux
 	key := GetKey(bucket, meas)
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
-		err = be.QueryFlux(req, w)
-		return nil, err
+		e := be.QueryFlux(req, w)
+		return nil, e
 	}
 	_, err = query(w, req, ip, key, fn)
 	return
@@ -85,24 +199,262 @@ func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if err != nil {
 		return nil, ErrGetMeasurement
 	}
+	var ckey string
+	var gen uint64
+	if ip.cache != nil && meas != "" && meas[0] != '/' {
+		ckey = ip.cache.Key(req, tokens, db)
+		if ckey != "" {
+			if body, ok := ip.cache.Get(ckey, w); ok {
+				return body, nil
+			}
+			gen = ip.cache.Generation(db, meas)
+		}
+	}
 	key := GetKey(db, meas)
+	chunked := req.FormValue("chunked") == "true"
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		if chunked {
+			// stream the response to the client, and return nil body as it has been written
+			resp, err := be.QueryStream(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			return nil, CopyResponse(w, resp)
+		}
 		qr := be.Query(req, w, false)
 		return qr.Body, qr.Err
 	}
 	body, err = query(w, req, ip, key, fn)
+	if err == nil && ckey != "" {
+		ip.cache.Set(ckey, db, meas, gen, w.Header(), body, ip.cache.TTL(req.FormValue("q")))
+	}
+	return
+}
+
+// QueryIntoQL runs the select part of the select into statement on the backend of source measurement,
+// converts the result into line protocol and writes it into the target measurement, which may belong to
+// another backend. the field types are taken from the source measurement if the columns are the source fields.
+func QueryIntoQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+	written, err := selectInto(req, ip, tokens, db)
+	if err != nil {
+		return nil, err
+	}
+	var tm interface{} = "1970-01-01T00:00:00Z"
+	if req.FormValue("epoch") != "" {
+		tm = json.Number("0")
+	}
+	rsp := ResponseFromSeries(models.Rows{{
+		Name:    "result",
+		Columns: []string{"time", "written"},
+		Values:  [][]interface{}{{tm, json.Number(strconv.Itoa(written))}},
+	}})
+	enc := NewResponseEncoder(req)
+	w.Header().Set("Content-Type", enc.ContentType())
+	return enc.Encode(rsp), nil
+}
+
+// selectInto runs the select into statement and returns the number of points written
+func selectInto(req *http.Request, ip *Proxy, tokens []string, db string) (written int, err error) {
+	// backend by key(db,meas) -> select; all circles -> backend by key(target db,target meas) -> write
+	tdb, trp, tmeas, err := GetIntoTargetFromTokens(tokens)
+	if err != nil {
+		return
+	}
+	if tdb == "" {
+		tdb = db
+	}
+	if tmeas == "" {
+		return 0, ErrGetMeasurement
+	}
+	if ip.IsForbiddenDB(tdb) {
+		return 0, fmt.Errorf("database forbidden: %s", tdb)
+	}
+	meas, err := GetMeasurementFromTokens(tokens)
+	if err != nil || meas == "" || meas[0] == '/' || meas[0] == '(' {
+		return 0, ErrGetMeasurement
+	}
+	rp, _ := GetRetentionPolicyFromTokens(tokens)
+
+	q := strings.TrimSpace(req.FormValue("q"))
+	into, from := FindKeyword(q, "into"), FindKeyword(q, "from")
+	if into < 0 || from < into {
+		return 0, ErrIllegalQL
+	}
+	sq := q[:into] + q[from:]
+	cr := CloneQueryRequest(req)
+	cr.Form.Set("q", sq)
+	cr.Form.Set("epoch", "ns")
+	cr.Form.Del("chunked")
+	cr.Header.Set("Accept", "application/json")
+	cr.Header.Del("Accept-Encoding")
+	sbody, err := QueryFromQL(newResponseBuffer(), cr, ip, ScanTokens(sq, 0), db)
+	if err != nil {
+		return
+	}
+	results, err := ResultsFromResponseBytes(sbody)
+	if err != nil {
+		return
+	}
+
+	fieldTypes := getFieldTypes(ip.GetBackends(GetKey(db, meas)), db, rp, meas)
+	var buf bytes.Buffer
+	for _, result := range results {
+		if result.Err != "" {
+			return 0, errors.New(result.Err)
+		}
+		for _, row := range result.Series {
+			target := tmeas
+			if target == ":MEASUREMENT" {
+				target = row.Name
+			}
+			fieldMap := make(map[string]string, len(row.Columns))
+			for _, value := range row.Values {
+				for i := 1; i < len(value) && i < len(row.Columns); i++ {
+					if _, ok := fieldMap[row.Columns[i]]; !ok && value[i] != nil {
+						fieldMap[row.Columns[i]] = valueFieldType(value[i], fieldTypes[row.Columns[i]])
+					}
+				}
+			}
+			cols := NewColumns(row.Columns, nil, fieldMap)
+			for _, value := range row.Values {
+				line := RowToLine(target, row.Tags, cols, value)
+				if line != "" {
+					buf.WriteString(line)
+					buf.WriteByte('\n')
+					written++
+				}
+			}
+		}
+	}
+	if buf.Len() > 0 {
+		err = ip.Write(buf.Bytes(), tdb, trp, "ns")
+	}
 	return
 }
 
+// QueryContinuousQL creates, drops or shows the continuous queries managed by the proxy
+func QueryContinuousQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+	var rsp *Response
+	switch GetHeadStmtFromTokens(tokens, 1) {
+	case "create":
+		cq, err := ParseContinuousQuery(req.FormValue("q"))
+		if err != nil {
+			return nil, err
+		}
+		if err = ip.cqs.Create(cq); err != nil {
+			return nil, err
+		}
+		rsp = ResponseFromResults([]*Result{{}})
+	case "drop":
+		if len(tokens) < 4 {
+			return nil, ErrIllegalQL
+		}
+		if err = ip.cqs.Drop(db, trimQuotes(tokens[3])); err != nil {
+			return nil, err
+		}
+		rsp = ResponseFromResults([]*Result{{}})
+	default:
+		// show continuous queries -> one series per database with the definitions and the last run status
+		var series models.Rows
+		index := make(map[string]*models.Row)
+		formatTime := func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+		for _, cq := range ip.cqs.List() {
+			if ip.IsForbiddenDB(cq.Db) {
+				continue
+			}
+			row, ok := index[cq.Db]
+			if !ok {
+				row = &models.Row{Name: cq.Db, Columns: []string{"name", "query", "next_run", "last_run", "last_status", "last_error", "last_written"}}
+				index[cq.Db] = row
+				series = append(series, row)
+			}
+			row.Values = append(row.Values, []interface{}{cq.Name, cq.Query, formatTime(cq.NextRun), formatTime(cq.LastRun), cq.LastStatus, cq.LastError, json.Number(strconv.Itoa(cq.LastWritten))})
+		}
+		rsp = ResponseFromSeries(series)
+	}
+	enc := NewResponseEncoder(req)
+	w.Header().Set("Content-Type", enc.ContentType())
+	return enc.Encode(rsp), nil
+}
+
+// getFieldTypes returns the field types of the measurement from the first active backend
+func getFieldTypes(backends []*Backend, db, rp, meas string) map[string]string {
+	fieldTypes := make(map[string]string)
+	q := fmt.Sprintf("show field keys from \"%s\"", util.EscapeIdentifier(meas))
+	if rp != "" {
+		q = fmt.Sprintf("show field keys from \"%s\".\"%s\"", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas))
+	}
+	for _, be := range backends {
+		if !be.IsActive() || be.IsWriteOnly() {
+			continue
+		}
+		qr := be.Query(NewQueryRequest("GET", db, q, ""), nil, true)
+		if qr.Err != nil {
+			continue
+		}
+		series, _ := SeriesFromResponseBytes(qr.Body)
+		for _, s := range series {
+			for _, v := range s.Values {
+				if len(v) >= 2 && fieldTypes[util.CastString(v[0])] == "" {
+					fieldTypes[util.CastString(v[0])] = util.CastString(v[1])
+				}
+			}
+		}
+		break
+	}
+	return fieldTypes
+}
+
+// valueFieldType returns the field type of the value. a number is an integer only if the source field is an integer,
+// since the json response doesn't tell an integer from a float without fraction
+func valueFieldType(v interface{}, sourceType string) string {
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	}
+	if sourceType == "integer" {
+		return "integer"
+	}
+	return "float"
+}
+
 func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
 	// all circles -> all backends -> show
-	// remove support of query parameter `chunked`
-	req.Form.Del("chunked")
+	// the merged response is encoded by proxy, so backends always reply json
+	enc := NewResponseEncoder(req)
+	req.Header.Set("Accept", "application/json")
 	backends := ip.GetAllBackends()
-	bodies, inactive, err := QueryInParallel(backends, req, w, true)
+	stmt2 := GetHeadStmtFromTokens(tokens, 2)
+	stmt3 := GetHeadStmtFromTokens(tokens, 3)
+	byValues := stmt2 == "show measurements" || stmt2 == "show series" || stmt2 == "show databases"
+	bySeries := stmt3 == "show field keys" || stmt3 == "show tag keys" || stmt3 == "show tag values"
+	user := UserFromContext(req.Context())
+	filtered := stmt2 == "show databases" && user != nil && !user.Admin
+	if req.FormValue("chunked") == "true" && !CheckCardinalityFromTokens(tokens) && (byValues || bySeries) && !filtered {
+		// stream the response to the client, and return nil body as it has been written
+		return nil, streamShowQL(w, req, backends, enc)
+	}
+	// other show queries are small and merged in memory
+	req.Form.Del("chunked")
+	req.Form.Del("chunk_size")
+	results, inactive, err := QueryResultsInParallel(backends, req, w, true)
 	if err != nil {
 		return
 	}
+	bodies := make([][]byte, 0, len(results))
+	for _, qr := range results {
+		if qr != nil {
+			bodies = append(bodies, qr.Body)
+		}
+	}
 	if inactive > 0 {
 		log.Printf("query: %s, inactive: %d/%d backends unavailable", req.FormValue("q"), inactive, inactive+len(bodies))
 		if len(bodies) == 0 {
@@ -111,16 +463,26 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	}
 
 	var rsp *Response
-	stmt2 := GetHeadStmtFromTokens(tokens, 2)
-	stmt3 := GetHeadStmtFromTokens(tokens, 3)
-	if stmt2 == "show measurements" || stmt2 == "show series" || stmt2 == "show databases" {
+	if CheckCardinalityFromTokens(tokens) {
+		// the estimated cardinality is reduced as the exact one, or listed by backends if by_backend is true
+		if !CheckExactCardinalityFromTokens(tokens) && req.FormValue("by_backend") == "true" {
+			rsp, err = concatByBackends(backends, results)
+		} else {
+			rsp, err = reduceByCardinality(ip.Circles, results)
+		}
+	} else if byValues {
 		rsp, err = reduceByValues(bodies)
-	} else if stmt3 == "show field keys" || stmt3 == "show tag keys" || stmt3 == "show tag values" {
+	} else if bySeries {
 		rsp, err = reduceBySeries(bodies)
 	} else if stmt3 == "show retention policies" {
 		rsp, err = attachByValues(bodies)
 	} else if stmt2 == "show stats" {
-		rsp, err = concatByResults(bodies)
+		rsp, err = concatByResults(backends, results)
+	} else if stmt2 == "show queries" {
+		rsp, err = concatByQueries(backends, results)
+	} else {
+		// the passed through statements, such as show shards, are tagged by the backends
+		rsp, err = concatByResults(backends, results)
 	}
 	if err != nil {
 		return
@@ -128,8 +490,11 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if rsp == nil {
 		rsp = ResponseFromSeries(nil)
 	}
-	pretty := req.URL.Query().Get("pretty") == "true"
-	body = util.MarshalJSON(rsp, pretty)
+	if filtered {
+		filterDatabases(rsp, user)
+	}
+	body = enc.Encode(rsp)
+	w.Header().Set("Content-Type", enc.ContentType())
 	if w.Header().Get("Content-Encoding") == "gzip" {
 		var buf bytes.Buffer
 		err = Compress(&buf, body)
@@ -142,6 +507,42 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	return
 }
 
+// QueryPassthroughQL runs the statement which isn't supported by the proxy but allowed by the statement rules,
+// the select and show statements are concatenated from all backends, and the others are broadcast to all backends
+func QueryPassthroughQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
+	if CheckSelectOrShowFromTokens(tokens) {
+		return QueryShowQL(w, req, ip, tokens)
+	}
+	return QueryBackends(ip.GetAllBackends(), req, w)
+}
+
+// QueryDiagnosticsQL runs show diagnostics on all backends, the diagnostics of each backend is tagged by its name
+func QueryDiagnosticsQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
+	// all circles -> all backends -> show diagnostics, concatenated by backends
+	return QueryShowQL(w, req, ip, tokens)
+}
+
+func QueryKillQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
+	// all circles -> backend by proxy query id -> kill query
+	pid, err := strconv.ParseInt(tokens[2], 10, 64)
+	if err != nil || pid < 0 {
+		return nil, fmt.Errorf("invalid query id: %s", tokens[2])
+	}
+	backends := ip.GetAllBackends()
+	m := queryIdMultiplier(len(backends))
+	idx := pid % m
+	if idx >= int64(len(backends)) {
+		return nil, fmt.Errorf("invalid query id: %s", tokens[2])
+	}
+	be, qid := backends[idx], pid/m
+	if !be.IsActive() {
+		return nil, fmt.Errorf("backend %s(%s) unavailable", be.Name, be.Url)
+	}
+	req.Form.Set("q", fmt.Sprintf("kill query %d", qid))
+	qr := be.Query(req, w, false)
+	return qr.Body, qr.Err
+}
+
 func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
 	// all circles -> backend by key(db,meas) -> delete or drop measurement/series
 	meas, err := GetMeasurementFromTokens(tokens)
@@ -150,59 +551,273 @@ func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, to
 	}
 	key := GetKey(db, meas)
 	backends := ip.GetBackends(key)
+	if ip.cache != nil {
+		ip.cache.Drop(db, meas)
+	}
 	return QueryBackends(backends, req, w)
 }
 
-func QueryAlterQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
+// QueryDeleteOrDropSeriesQL broadcasts the delete or drop series statement without from clause to all backends
+func QueryDeleteOrDropSeriesQL(w http.ResponseWriter, req *http.Request, ip *Proxy, db string) (body []byte, err error) {
+	// all circles -> all backends -> delete or drop series
+	backends := ip.GetAllBackends()
+	if ip.cache != nil {
+		ip.cache.InvalidateDatabase(db)
+	}
+	return QueryBackends(backends, req, w)
+}
+
+func QueryAlterQL(w http.ResponseWriter, req *http.Request, ip *Proxy, db string) (body []byte, err error) {
 	// all circles -> all backends -> create or drop database; create, alter or drop retention policy
 	backends := ip.GetAllBackends()
+	if ip.cache != nil && db != "" {
+		ip.cache.InvalidateDatabase(db)
+	}
 	return QueryBackends(backends, req, w)
 }
 
+// QueryBackends applies the statement to all active backends, and queues it in the journal of the backends
+// which are inactive or unreachable, so that it's replayed when they are active again. The partial failures
+// and the disagreements between backends are reported as warnings.
 func QueryBackends(backends []*Backend, req *http.Request, w http.ResponseWriter) (body []byte, err error) {
 	if len(backends) == 0 {
 		return nil, ErrGetBackends
 	}
-	for _, be := range backends {
+	db, q := req.FormValue("db"), strings.TrimSpace(req.FormValue("q"))
+	enc := NewResponseEncoder(req)
+	req.Header.Set("Accept", "application/json")
+	var wg sync.WaitGroup
+	qrs := make([]*QueryResult, len(backends))
+	for i, be := range backends {
 		if !be.IsActive() {
-			return nil, fmt.Errorf("backend %s(%s) unavailable", be.Name, be.Url)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			qrs[i] = be.Query(CloneQueryRequest(req), nil, true)
+		}(i, be)
+	}
+	wg.Wait()
+
+	var rsp *Response
+	var first []byte
+	var messages []*Message
+	var failure error
+	succeeded := 0
+	for i, be := range backends {
+		qr := qrs[i]
+		if qr == nil || (qr.Err != nil && qr.Status == 0) {
+			if err := be.AddJournal(db, q); err != nil {
+				messages = append(messages, &Message{Level: "warning", Text: fmt.Sprintf("backend %s(%s) unavailable, queue statement error: %s", be.Name, be.Url, err)})
+			} else {
+				messages = append(messages, &Message{Level: "warning", Text: fmt.Sprintf("backend %s(%s) unavailable, the statement is queued and will be replayed when it's active", be.Name, be.Url)})
+			}
+			continue
+		}
+		if qr.Err != nil {
+			if failure == nil {
+				failure = qr.Err
+			}
+			messages = append(messages, &Message{Level: "warning", Text: fmt.Sprintf("backend %s(%s) failed: %s", be.Name, be.Url, qr.Err)})
+			continue
+		}
+		succeeded++
+		b := bytes.TrimSpace(qr.Body)
+		if first == nil {
+			first = b
+			rsp, err = ResponseFromResponseBytes(b)
+			if err != nil {
+				return nil, err
+			}
+		} else if !bytes.Equal(first, b) {
+			messages = append(messages, &Message{Level: "warning", Text: fmt.Sprintf("backend %s(%s) replied differently: %s", be.Name, be.Url, b)})
+		}
+	}
+	if succeeded == 0 && failure != nil {
+		return nil, failure
+	}
+	if rsp == nil {
+		rsp = ResponseFromResults(nil)
+	}
+	if len(messages) > 0 {
+		log.Printf("query: %s, db: %s, %d/%d backends succeeded", MaskPassword(q), db, succeeded, len(backends))
+		if len(rsp.Results) == 0 {
+			rsp.Results = []*Result{{}}
+		}
+		rsp.Results[0].Messages = append(rsp.Results[0].Messages, messages...)
+	}
+	w.Header().Set("Content-Type", enc.ContentType())
+	return enc.Encode(rsp), nil
+}
+
+// QueryUserQL broadcasts the user and privilege statements to all backends like the other ddl statements,
+// and merges the results of show users and show grants
+func QueryUserQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
+	// all circles -> all backends -> create, drop, set password, grant, revoke or show users/grants
+	backends := ip.GetAllBackends()
+	if GetHeadStmtFromTokens(tokens, 1) != "show" {
+		return QueryBackends(backends, req, w)
+	}
+	enc := NewResponseEncoder(req)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(HeaderQueryOrigin, QueryParallel)
+	var wg sync.WaitGroup
+	qrs := make([]*QueryResult, len(backends))
+	for i, be := range backends {
+		if !be.IsActive() {
+			continue
 		}
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			qrs[i] = be.Query(CloneQueryRequest(req), nil, true)
+		}(i, be)
 	}
-	bodies, _, err := QueryInParallel(backends, req, w, false)
+	wg.Wait()
+	rsp, err := mergeShowUsers(backends, qrs)
 	if err != nil {
 		return nil, err
 	}
-	return bodies[0], nil
+	w.Header().Set("Content-Type", enc.ContentType())
+	return enc.Encode(rsp), nil
+}
+
+// mergeShowUsers merges the users or grants of all backends by the first column, the items which are missing on
+// some backends or not the same on all backends, and the failed backends are reported as warnings
+func mergeShowUsers(backends []*Backend, qrs []*QueryResult) (rsp *Response, err error) {
+	var columns []string
+	var keys []string
+	var messages []*Message
+	var failure error
+	values := make(map[string][]interface{})
+	seen := make(map[string]map[string][]string) // key -> the other columns -> backend names
+	succeeded := 0
+	for i, be := range backends {
+		qr := qrs[i]
+		if qr == nil {
+			messages = append(messages, &Message{Level: "warning", Text: fmt.Sprintf("backend %s(%s) unavailable", be.Name, be.Url)})
+			continue
+		}
+		var results []*Result
+		err = qr.Err
+		if err == nil {
+			results, err = ResultsFromResponseBytes(qr.Body)
+		}
+		if err == nil && len(results) > 0 && results[0].Err != "" {
+			err = errors.New(results[0].Err)
+		}
+		if err != nil {
+			if failure == nil {
+				failure = err
+			}
+			messages = append(messages, &Message{Level: "warning", Text: fmt.Sprintf("backend %s(%s) failed: %s", be.Name, be.Url, err)})
+			continue
+		}
+		succeeded++
+		if len(results) == 0 {
+			continue
+		}
+		for _, row := range results[0].Series {
+			if columns == nil {
+				columns = row.Columns
+			}
+			for _, value := range row.Values {
+				if len(value) == 0 {
+					continue
+				}
+				key := util.CastString(value[0])
+				vals := make([]string, len(value)-1)
+				for j, v := range value[1:] {
+					vals[j] = util.CastString(v)
+				}
+				if _, ok := seen[key]; !ok {
+					seen[key] = make(map[string][]string)
+					values[key] = value
+					keys = append(keys, key)
+				}
+				sig := strings.Join(vals, ", ")
+				seen[key][sig] = append(seen[key][sig], be.Name)
+			}
+		}
+	}
+	if succeeded == 0 {
+		if failure == nil {
+			failure = ErrBackendsUnavailable
+		}
+		return nil, failure
+	}
+
+	sort.Strings(keys)
+	result := &Result{}
+	if columns != nil {
+		row := &models.Row{Columns: columns}
+		for _, key := range keys {
+			row.Values = append(row.Values, values[key])
+			var parts []string
+			count := 0
+			sigs := make([]string, 0, len(seen[key]))
+			for sig := range seen[key] {
+				sigs = append(sigs, sig)
+			}
+			sort.Strings(sigs)
+			for _, sig := range sigs {
+				parts = append(parts, fmt.Sprintf("[%s] on %s", sig, strings.Join(seen[key][sig], ", ")))
+				count += len(seen[key][sig])
+			}
+			if len(parts) > 1 || count < succeeded {
+				if count < succeeded {
+					parts = append(parts, fmt.Sprintf("missing on %d backends", succeeded-count))
+				}
+				messages = append(messages, &Message{Level: "warning", Text: fmt.Sprintf("%s %q is inconsistent across backends: %s", columns[0], key, strings.Join(parts, "; "))})
+			}
+		}
+		result.Series = models.Rows{row}
+	}
+	result.Messages = messages
+	return ResponseFromResults([]*Result{result}), nil
 }
 
 func QueryInParallel(backends []*Backend, req *http.Request, w http.ResponseWriter, decompress bool) (bodies [][]byte, inactive int, err error) {
+	results, inactive, err := QueryResultsInParallel(backends, req, w, decompress)
+	if err != nil {
+		return
+	}
+	for _, qr := range results {
+		if qr != nil {
+			bodies = append(bodies, qr.Body)
+		}
+	}
+	return
+}
+
+// QueryResultsInParallel returns the query results in the same order as backends, and the result of inactive backend is nil
+func QueryResultsInParallel(backends []*Backend, req *http.Request, w http.ResponseWriter, decompress bool) (results []*QueryResult, inactive int, err error) {
 	var wg sync.WaitGroup
 	var header http.Header
 	req.Header.Set(HeaderQueryOrigin, QueryParallel)
-	ch := make(chan *QueryResult, len(backends))
-	for _, be := range backends {
+	results = make([]*QueryResult, len(backends))
+	for i, be := range backends {
 		if !be.IsActive() {
 			inactive++
 			continue
 		}
 		wg.Add(1)
-		go func(be *Backend) {
+		go func(i int, be *Backend) {
 			defer wg.Done()
 			cr := CloneQueryRequest(req)
-			ch <- be.Query(cr, nil, decompress)
-		}(be)
-	}
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-	for qr := range ch {
+			results[i] = be.Query(cr, nil, decompress)
+		}(i, be)
+	}
+	wg.Wait()
+	for _, qr := range results {
+		if qr == nil {
+			continue
+		}
 		if qr.Err != nil {
-			err = qr.Err
-			return
+			return nil, inactive, qr.Err
 		}
 		header = qr.Header
-		bodies = append(bodies, qr.Body)
 	}
 	if w != nil {
 		CopyHeader(w.Header(), header)
@@ -288,16 +903,183 @@ func attachByValues(bodies [][]byte) (rsp *Response, err error) {
 	return ResponseFromSeries(series), nil
 }
 
-func concatByResults(bodies [][]byte) (rsp *Response, err error) {
+func concatByResults(backends []*Backend, qrs []*QueryResult) (rsp *Response, err error) {
 	var results []*Result
-	for _, b := range bodies {
-		_results, err := ResultsFromResponseBytes(b)
+	for i, qr := range qrs {
+		if qr == nil {
+			continue
+		}
+		_results, err := ResultsFromResponseBytes(qr.Body)
 		if err != nil {
 			return nil, err
 		}
 		if len(_results) == 1 {
+			// tag each row with the backend it came from
+			for _, serie := range _results[0].Series {
+				if serie.Tags == nil {
+					serie.Tags = make(map[string]string)
+				}
+				serie.Tags["backend"] = backends[i].Name
+			}
 			results = append(results, _results[0])
 		}
 	}
 	return ResponseFromResults(results), nil
 }
+
+// concatByBackends concats the series of all backends into one result, each series is tagged by its backend.
+// it's for the estimated cardinality listed by backends, to inspect the estimates before they're reduced
+func concatByBackends(backends []*Backend, qrs []*QueryResult) (rsp *Response, err error) {
+	var series models.Rows
+	for i, qr := range qrs {
+		if qr == nil {
+			continue
+		}
+		_series, err := SeriesFromResponseBytes(qr.Body)
+		if err != nil {
+			return nil, err
+		}
+		for _, serie := range _series {
+			if serie.Tags == nil {
+				serie.Tags = make(map[string]string)
+			}
+			serie.Tags["backend"] = backends[i].Name
+			series = append(series, serie)
+		}
+	}
+	return ResponseFromSeries(series), nil
+}
+
+// queryIdMultiplier returns the multiplier to make a proxy query id, which is unique across all backends:
+// proxy query id = query id * multiplier + backend index, where the multiplier is a power of 10
+func queryIdMultiplier(n int) int64 { // nolint:golint
+	m := int64(10)
+	for m < int64(n) {
+		m *= 10
+	}
+	return m
+}
+
+// concatByQueries concats the running queries of all backends, the query ids are replaced with proxy query ids
+// and the backend names are attached, so that KILL QUERY can be routed to the backend that owns the query
+func concatByQueries(backends []*Backend, qrs []*QueryResult) (rsp *Response, err error) {
+	var series models.Rows
+	m := queryIdMultiplier(len(backends))
+	for i, qr := range qrs {
+		if qr == nil {
+			continue
+		}
+		_series, err := SeriesFromResponseBytes(qr.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(_series) != 1 {
+			continue
+		}
+		values := _series[0].Values
+		if series == nil {
+			series = _series
+			series[0].Values = nil
+			series[0].Columns = append(series[0].Columns, "backend")
+		}
+		for _, value := range values {
+			if qid, err := strconv.ParseInt(util.CastString(value[0]), 10, 64); err == nil {
+				value[0] = json.Number(strconv.FormatInt(qid*m+int64(i), 10))
+			}
+			series[0].Values = append(series[0].Values, append(value, backends[i].Name))
+		}
+	}
+	return ResponseFromSeries(series), nil
+}
+
+// reduceByCardinality merges the exact or estimated cardinality of all backends. the backends in the same circle
+// hold different measurements, so the counts of them are summed up; the circles are replicas of each other, so the
+// maximum count among the circles is taken, which is the most complete one if some circle is lacking data.
+func reduceByCardinality(circles []*Circle, qrs []*QueryResult) (rsp *Response, err error) {
+	var series models.Rows
+	seriesMap := make(map[string]*models.Row)
+	offset := 0
+	for _, circle := range circles {
+		circleMap := make(map[string]*models.Row)
+		for i := range circle.Backends {
+			qr := qrs[offset+i]
+			if qr == nil {
+				continue
+			}
+			_series, err := SeriesFromResponseBytes(qr.Body)
+			if err != nil {
+				return nil, err
+			}
+			for _, serie := range _series {
+				key := serieKey(serie)
+				if s, ok := circleMap[key]; ok {
+					mergeCardinality(s, serie, addNumber)
+				} else {
+					circleMap[key] = serie
+				}
+			}
+		}
+		offset += len(circle.Backends)
+		for key, serie := range circleMap {
+			if s, ok := seriesMap[key]; ok {
+				mergeCardinality(s, serie, maxNumber)
+			} else {
+				seriesMap[key] = serie
+				series = append(series, serie)
+			}
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Name < series[j].Name
+	})
+	return ResponseFromSeries(series), nil
+}
+
+func serieKey(serie *models.Row) string {
+	if len(serie.Tags) == 0 {
+		return serie.Name
+	}
+	tags := make([]string, 0, len(serie.Tags))
+	for k, v := range serie.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return serie.Name + "," + strings.Join(tags, ",")
+}
+
+func mergeCardinality(dst, src *models.Row, fn func(a, b interface{}) interface{}) {
+	if len(dst.Values) == 0 {
+		dst.Values = src.Values
+		return
+	}
+	if len(src.Values) == 0 {
+		return
+	}
+	dv, sv := dst.Values[0], src.Values[0]
+	for i := 0; i < len(dv) && i < len(sv); i++ {
+		dv[i] = fn(dv[i], sv[i])
+	}
+}
+
+func addNumber(a, b interface{}) interface{} {
+	ai, aerr := strconv.ParseInt(util.CastString(a), 10, 64)
+	bi, berr := strconv.ParseInt(util.CastString(b), 10, 64)
+	if aerr == nil && berr == nil {
+		return json.Number(strconv.FormatInt(ai+bi, 10))
+	}
+	af, aerr := strconv.ParseFloat(util.CastString(a), 64)
+	bf, berr := strconv.ParseFloat(util.CastString(b), 64)
+	if aerr == nil && berr == nil {
+		return json.Number(strconv.FormatFloat(af+bf, 'f', -1, 64))
+	}
+	return a
+}
+
+func maxNumber(a, b interface{}) interface{} {
+	af, aerr := strconv.ParseFloat(util.CastString(a), 64)
+	bf, berr := strconv.ParseFloat(util.CastString(b), 64)
+	if aerr == nil && berr == nil && bf > af {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,326 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func newTestCircles(sizes ...int) []*Circle {
+	circles := make([]*Circle, len(sizes))
+	for i, size := range sizes {
+		circles[i] = &Circle{CircleId: i, Backends: make([]*Backend, size)}
+		for j := 0; j < size; j++ {
+			circles[i].Backends[j] = &Backend{HttpBackend: &HttpBackend{Name: fmt.Sprintf("influxdb-%d-%d", i+1, j+1)}}
+		}
+	}
+	return circles
+}
+
+func newTestHttpBackend(name, url string) *HttpBackend { // nolint:golint
+	hb, err := NewSimpleHttpBackend(&BackendConfig{Name: name, Url: url})
+	if err != nil {
+		panic(err)
+	}
+	return hb
+}
+
+func TestReduceByCardinality(t *testing.T) {
+	circles := newTestCircles(2, 2)
+	qrs := []*QueryResult{
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[3]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[4]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[5]]}]}]}`)},
+		nil,
+	}
+	rsp, err := reduceByCardinality(circles, qrs)
+	if err != nil {
+		t.Fatalf("reduce by cardinality error: %s", err)
+	}
+	if got := util.CastString(rsp.Results[0].Series[0].Values[0][0]); got != "7" {
+		t.Errorf("total cardinality wrong: %s != 7", got)
+	}
+
+	qrs = []*QueryResult{
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["count"],"values":[[10]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["count"],"values":[[2.5]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["count"],"values":[[8]]},{"name":"mem","columns":["count"],"values":[[2.5]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["count"],"values":[[1]]}]}]}`)},
+	}
+	rsp, err = reduceByCardinality(circles, qrs)
+	if err != nil {
+		t.Fatalf("reduce by cardinality error: %s", err)
+	}
+	want := map[string]string{"cpu": "10", "mem": "3.5"}
+	series := rsp.Results[0].Series
+	if len(series) != len(want) {
+		t.Fatalf("series length wrong: %d != %d", len(series), len(want))
+	}
+	for _, serie := range series {
+		if got := util.CastString(serie.Values[0][0]); got != want[serie.Name] {
+			t.Errorf("cardinality of %s wrong: %s != %s", serie.Name, got, want[serie.Name])
+		}
+	}
+}
+
+func TestConcatByBackends(t *testing.T) {
+	circles := newTestCircles(2)
+	qrs := []*QueryResult{
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[3]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[4]]}]}]}`)},
+	}
+	rsp, err := concatByBackends(circles[0].Backends, qrs)
+	if err != nil {
+		t.Fatalf("concat by backends error: %s", err)
+	}
+	series := rsp.Results[0].Series
+	if len(rsp.Results) != 1 || len(series) != 2 {
+		t.Fatalf("cardinality listed by backends shouldn't be merged: %v", series)
+	}
+	for i, want := range []string{"3", "4"} {
+		if got := util.CastString(series[i].Values[0][0]); got != want || series[i].Tags["backend"] != circles[0].Backends[i].Name {
+			t.Errorf("estimated cardinality wrong: %s %v != %s", got, series[i].Tags, want)
+		}
+	}
+}
+
+func TestQueryShowCardinality(t *testing.T) {
+	newServer := func(count int) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[%d]]}]}]}`, count)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	newBackend := func(name string, count int) *Backend {
+		be := &Backend{HttpBackend: newTestHttpBackend(name, newServer(count).URL)}
+		be.active.Store(true)
+		return be
+	}
+	ip := &Proxy{Circles: []*Circle{
+		{Backends: []*Backend{newBackend("b1", 3), newBackend("b2", 4)}},
+		{Backends: []*Backend{newBackend("b3", 5)}},
+	}}
+	tests := []struct {
+		name string
+		q    string
+		form string
+		want []string
+	}{
+		{name: "exact", q: "show series exact cardinality", want: []string{"7"}},
+		{name: "estimated", q: "show series cardinality", want: []string{"7"}},
+		{name: "estimated by backend", q: "show series cardinality", form: "&by_backend=true", want: []string{"3", "4", "5"}},
+		{name: "exact by backend", q: "show series exact cardinality", form: "&by_backend=true", want: []string{"7"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/query?db=db1&q="+url.QueryEscape(tt.q)+tt.form, nil)
+		req.ParseForm()
+		body, err := QueryShowQL(httptest.NewRecorder(), req, ip, ScanTokens(tt.q, 0))
+		if err != nil {
+			t.Fatalf("%s: query error: %s", tt.name, err)
+		}
+		rsp, _ := ResponseFromResponseBytes(body)
+		var got []string
+		for _, serie := range rsp.Results[0].Series {
+			got = append(got, util.CastString(serie.Values[0][0]))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: cardinality = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConcatByResults(t *testing.T) {
+	circles := newTestCircles(2)
+	qrs := []*QueryResult{
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"name":"runtime","columns":["Alloc"],"values":[[1]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"name":"runtime","tags":{"path":"x"},"columns":["Alloc"],"values":[[2]]}]}]}`)},
+	}
+	rsp, err := concatByResults(circles[0].Backends, qrs)
+	if err != nil {
+		t.Fatalf("concat by results error: %s", err)
+	}
+	for i, result := range rsp.Results {
+		if tag := result.Series[0].Tags["backend"]; tag != circles[0].Backends[i].Name {
+			t.Errorf("backend tag wrong: %s != %s", tag, circles[0].Backends[i].Name)
+		}
+	}
+}
+
+func TestConcatByQueries(t *testing.T) {
+	circles := newTestCircles(2)
+	qrs := []*QueryResult{
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["qid","query","database","duration","status"],"values":[[5,"SHOW QUERIES","","50µs","running"]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["qid","query","database","duration","status"],"values":[[7,"SELECT * FROM cpu","db1","2s","running"]]}]}]}`)},
+	}
+	rsp, err := concatByQueries(circles[0].Backends, qrs)
+	if err != nil {
+		t.Fatalf("concat by queries error: %s", err)
+	}
+	serie := rsp.Results[0].Series[0]
+	if len(serie.Columns) != 6 || serie.Columns[5] != "backend" || len(serie.Values) != 2 {
+		t.Fatalf("queries wrong: %v", serie)
+	}
+	for i, want := range []string{"50", "71"} {
+		if pid := util.CastString(serie.Values[i][0]); pid != want || serie.Values[i][5] != circles[0].Backends[i].Name {
+			t.Errorf("proxy query id wrong: %s != %s", pid, want)
+		}
+	}
+}
+
+func TestQueryKillQL(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		queries = append(queries, req.FormValue("q"))
+		lock.Unlock()
+		io.WriteString(w, `{"results":[{"statement_id":0}]}`)
+	}))
+	defer server.Close()
+	newBackend := func(name string) *Backend {
+		return &Backend{HttpBackend: newTestHttpBackend(name, server.URL)}
+	}
+	ip := &Proxy{Circles: []*Circle{
+		{Backends: []*Backend{newBackend("b1"), newBackend("b2")}},
+		{Backends: []*Backend{newBackend("b3")}},
+	}}
+
+	tests := []struct {
+		pid   string
+		query string
+		err   bool
+	}{
+		{pid: "52", query: "kill query 5"},
+		{pid: "7", err: true},
+		{pid: "13", err: true},
+		{pid: "-1", err: true},
+		{pid: "x", err: true},
+	}
+	for _, tt := range tests {
+		lock.Lock()
+		queries = nil
+		lock.Unlock()
+		req := httptest.NewRequest("POST", "/query?q=kill+query+"+tt.pid, nil)
+		req.ParseForm()
+		_, err := QueryKillQL(httptest.NewRecorder(), req, ip, []string{"kill", "query", tt.pid})
+		if (err != nil) != tt.err {
+			t.Errorf("kill query %s error: %v, want error: %t", tt.pid, err, tt.err)
+			continue
+		}
+		if !tt.err && (len(queries) != 1 || queries[0] != tt.query) {
+			t.Errorf("kill query %s wrong: %v != %s", tt.pid, queries, tt.query)
+		}
+	}
+}
+
+func TestQueryBackends(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		queries = append(queries, req.FormValue("q"))
+		lock.Unlock()
+		io.WriteString(w, `{"results":[{"statement_id":0}]}`)
+	}))
+	defer ok.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":"database not found: db1"}`)
+	}))
+	defer bad.Close()
+	dir := t.TempDir()
+	newBackend := func(name, url string, active bool) *Backend {
+		be := &Backend{HttpBackend: newTestHttpBackend(name, url)}
+		be.journal, _ = NewJournal(name, dir)
+		be.active.Store(active)
+		return be
+	}
+	ip := &Proxy{Circles: []*Circle{
+		{Backends: []*Backend{newBackend("b1", ok.URL, true), newBackend("b2", bad.URL, true)}},
+		{Backends: []*Backend{newBackend("b3", ok.URL, false)}},
+	}}
+
+	req := httptest.NewRequest("POST", "/query?db=db1&q=drop+series+where+host%3D%27a%27", nil)
+	req.ParseForm()
+	body, err := QueryDeleteOrDropSeriesQL(httptest.NewRecorder(), req, ip, "db1")
+	if err != nil {
+		t.Fatalf("query error: %s", err)
+	}
+	rsp, _ := ResponseFromResponseBytes(body)
+	if len(rsp.Results) != 1 || len(rsp.Results[0].Messages) != 2 ||
+		!strings.Contains(rsp.Results[0].Messages[0].Text, "b2") || !strings.Contains(rsp.Results[0].Messages[1].Text, "b3") {
+		t.Errorf("unexpected response: %s", body)
+	}
+	b3 := ip.Circles[1].Backends[0]
+	if b3.JournalLen() != 1 || len(queries) != 1 {
+		t.Fatalf("journal: %d, queries: %v", b3.JournalLen(), queries)
+	}
+	if j, _ := NewJournal("b3", dir); j.Len() != 1 || j.Front().Db != "db1" {
+		t.Error("journal should be persistent")
+	}
+
+	if !b3.ReplayJournal() || b3.JournalLen() != 0 || len(queries) != 2 || queries[1] != "drop series where host='a'" {
+		t.Errorf("replay wrong, journal: %d, queries: %v", b3.JournalLen(), queries)
+	}
+	if j, _ := NewJournal("b3", dir); j.Len() != 0 {
+		t.Error("replayed journal should be removed")
+	}
+
+	ip.Circles = ip.Circles[:1]
+	ip.Circles[0].Backends = ip.Circles[0].Backends[1:]
+	if _, err = QueryDeleteOrDropSeriesQL(httptest.NewRecorder(), req, ip, "db1"); err == nil {
+		t.Error("query should fail if all backends failed")
+	}
+}
+
+func TestMergeShowUsers(t *testing.T) {
+	backends := []*Backend{
+		{HttpBackend: &HttpBackend{Name: "b1"}},
+		{HttpBackend: &HttpBackend{Name: "b2"}},
+		{HttpBackend: &HttpBackend{Name: "b3"}},
+		{HttpBackend: &HttpBackend{Name: "b4"}},
+	}
+	qrs := []*QueryResult{
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["user","admin"],"values":[["admin",true],["reader",false]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"series":[{"columns":["user","admin"],"values":[["admin",false],["reader",false],["writer",false]]}]}]}`)},
+		{Body: []byte(`{"results":[{"statement_id":0,"error":"authorization failed"}]}`)},
+		nil,
+	}
+	rsp, err := mergeShowUsers(backends, qrs)
+	if err != nil {
+		t.Fatalf("merge error: %s", err)
+	}
+	result := rsp.Results[0]
+	if len(result.Series) != 1 || len(result.Series[0].Values) != 3 {
+		t.Fatalf("unexpected series: %+v", result.Series)
+	}
+	var texts []string
+	for _, m := range result.Messages {
+		texts = append(texts, m.Text)
+	}
+	want := []string{
+		"backend b3() failed: authorization failed",
+		"backend b4() unavailable",
+		`user "admin" is inconsistent across backends: [false] on b2; [true] on b1`,
+		`user "writer" is inconsistent across backends: [false] on b2; missing on 1 backends`,
+	}
+	if !reflect.DeepEqual(texts, want) {
+		t.Errorf("messages = %q, want %q", texts, want)
+	}
+	if _, err = mergeShowUsers(backends[2:], qrs[2:]); err == nil {
+		t.Error("merge should fail if all backends failed")
+	}
+}
@@ -29,6 +29,8 @@ var (
 	ErrNotFound     = errors.New("not found")
 	ErrInternal     = errors.New("internal error")
 	ErrUnknown      = errors.New("unknown error")
+
+	ErrJournalUnavailable = errors.New("journal unavailable")
 )
 
 const (
@@ -57,19 +59,34 @@ type HttpBackend struct { // nolint:golint
 	rewriting   atomic.Value
 	transferIn  atomic.Value
 	writeOnly   bool
+	latency     LatencyStats
+	journal     *Journal
 }
 
-func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) { // nolint:golint
-	hb = NewSimpleHttpBackend(cfg)
-	hb.client = NewClient(strings.HasPrefix(cfg.Url, "https"), pxcfg.WriteTimeout)
+func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend, err error) { // nolint:golint
+	hb, err = NewSimpleHttpBackend(cfg)
+	if err != nil {
+		return
+	}
+	hb.client = NewClient(hb.transport.TLSClientConfig, pxcfg.WriteTimeout)
 	hb.interval = pxcfg.CheckInterval
+	hb.journal, err = NewJournal(cfg.Name, pxcfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("load write journal of backend %s error: %w", cfg.Name, err)
+	}
 	go hb.CheckActive()
 	return
 }
 
-func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { // nolint:golint
+// NewSimpleHttpBackend returns the backend without the write journal and the active check,
+// the tls files are validated when the config is loaded, but the backends of the requests are not
+func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend, err error) { // nolint:golint
+	tlsConfig, err := NewBackendTLSConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("tls config of backend %s error: %w", cfg.Name, err)
+	}
 	hb = &HttpBackend{
-		transport:   NewTransport(strings.HasPrefix(cfg.Url, "https")),
+		transport:   NewTransport(tlsConfig),
 		Name:        cfg.Name,
 		Url:         cfg.Url,
 		username:    cfg.Username,
@@ -84,11 +101,11 @@ func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { // nolint:goli
 	return
 }
 
-func NewClient(tlsSkip bool, timeout int) *http.Client {
-	return &http.Client{Transport: NewTransport(tlsSkip), Timeout: time.Duration(timeout) * time.Second}
+func NewClient(tlsConfig *tls.Config, timeout int) *http.Client {
+	return &http.Client{Transport: NewTransport(tlsConfig), Timeout: time.Duration(timeout) * time.Second}
 }
 
-func NewTransport(tlsSkip bool) *http.Transport {
+func NewTransport(tlsConfig *tls.Config) *http.Transport {
 	return &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   time.Second * 30,
@@ -99,7 +116,7 @@ func NewTransport(tlsSkip bool) *http.Transport {
 		IdleConnTimeout:       time.Second * 90,
 		TLSHandshakeTimeout:   time.Second * 10,
 		ExpectContinueTimeout: time.Second * 1,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: tlsSkip},
+		TLSClientConfig:       tlsConfig,
 	}
 }
 
@@ -114,7 +131,7 @@ func NewQueryRequest(method, db, q, epoch string) *http.Request {
 	if epoch != "" {
 		form.Set("epoch", epoch)
 	}
-	return &http.Request{Method: method, Form: form, Header: header}
+	return &http.Request{Method: method, URL: &url.URL{}, Form: form, Header: header}
 }
 
 func CloneQueryRequest(r *http.Request) *http.Request {
@@ -152,6 +169,24 @@ func SetBasicAuth(req *http.Request, username string, password string, authEncry
 	}
 }
 
+// GetRequestUser returns the name of the authenticated user, or empty if the auth is disabled,
+// the names provided by the client are not trusted until they are authenticated
+func GetRequestUser(req *http.Request) string {
+	if u := UserFromContext(req.Context()); u != nil {
+		return u.Name
+	}
+	name, _ := req.Context().Value(userNameContextKey{}).(string)
+	return name
+}
+
+// removeBearerAuth removes the jwt of the client which has been validated by the proxy,
+// so that it's not forwarded to the backend, the backend credentials are used instead
+func removeBearerAuth(req *http.Request) {
+	if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		req.Header.Del("Authorization")
+	}
+}
+
 func (hb *HttpBackend) SetBasicAuth(req *http.Request) {
 	SetBasicAuth(req, hb.username, hb.password, hb.authEncrypt)
 }
@@ -168,11 +203,56 @@ func (hb *HttpBackend) SetTokenAuth(req *http.Request) {
 
 func (hb *HttpBackend) CheckActive() {
 	for hb.running.Load().(bool) {
-		hb.active.Store(hb.Ping())
+		active := hb.Ping()
+		if active && hb.JournalLen() > 0 {
+			// replay the missed statements before the backend is active, so that queries and backlog data come after them
+			active = hb.ReplayJournal()
+		}
+		hb.active.Store(active)
 		time.Sleep(time.Duration(hb.interval) * time.Second)
 	}
 }
 
+// AddJournal queues the statement which is applied when the backend is active again
+func (hb *HttpBackend) AddJournal(db, q string) error {
+	if hb.journal == nil {
+		return ErrJournalUnavailable
+	}
+	return hb.journal.Append(db, q)
+}
+
+func (hb *HttpBackend) JournalLen() int {
+	if hb.journal == nil {
+		return 0
+	}
+	return hb.journal.Len()
+}
+
+// ReplayJournal applies the queued statements in order, the statement rejected by the backend is dropped.
+// It returns false if the backend is unreachable, and the remaining statements are replayed next time.
+func (hb *HttpBackend) ReplayJournal() bool {
+	for hb.running.Load().(bool) {
+		entry := hb.journal.Front()
+		if entry == nil {
+			return true
+		}
+		qr := hb.Query(NewQueryRequest("POST", entry.Db, entry.Q, ""), nil, true)
+		if qr.Err != nil && qr.Status < 400 {
+			log.Printf("replay journal error: %s, url: %s, db: %s, query: %s", qr.Err, hb.Url, entry.Db, MaskPassword(entry.Q))
+			return false
+		}
+		if qr.Err != nil {
+			log.Printf("replay journal rejected, drop it: %s, url: %s, db: %s, query: %s", qr.Err, hb.Url, entry.Db, MaskPassword(entry.Q))
+		} else {
+			log.Printf("replay journal done, url: %s, db: %s, query: %s", hb.Url, entry.Db, MaskPassword(entry.Q))
+		}
+		if err := hb.journal.Pop(entry); err != nil {
+			log.Printf("save journal error: %s, url: %s", err, hb.Url)
+		}
+	}
+	return false
+}
+
 func (hb *HttpBackend) IsActive() (b bool) {
 	return hb.active.Load().(bool)
 }
@@ -193,6 +273,10 @@ func (hb *HttpBackend) IsWriteOnly() (b bool) {
 	return hb.writeOnly || hb.transferIn.Load().(bool)
 }
 
+func (hb *HttpBackend) GetLatencyStats() *LatencyStats {
+	return &hb.latency
+}
+
 func (hb *HttpBackend) Ping() bool {
 	resp, err := hb.client.Get(hb.Url + "/ping")
 	if err != nil {
@@ -278,6 +362,7 @@ func (hb *HttpBackend) ReadProm(req *http.Request, w http.ResponseWriter) (err e
 	}
 	req.Form.Del("u")
 	req.Form.Del("p")
+	removeBearerAuth(req)
 	if hb.username != "" || hb.password != "" {
 		hb.SetBasicAuth(req)
 	}
@@ -294,21 +379,11 @@ func (hb *HttpBackend) ReadProm(req *http.Request, w http.ResponseWriter) (err e
 		return
 	}
 	defer resp.Body.Close()
-
-	CopyHeader(w.Header(), resp.Header)
-
-	p, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("prometheus read body error: %s", err)
-		return
-	}
-
-	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(p)
-	return
+	return CopyResponse(w, resp)
 }
 
 func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter) (err error) {
+	removeBearerAuth(req)
 	if hb.username != "" || hb.password != "" {
 		hb.SetTokenAuth(req)
 	}
@@ -325,34 +400,32 @@ func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter) (err
 		return
 	}
 	defer resp.Body.Close()
-
-	CopyHeader(w.Header(), resp.Header)
-
-	p, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("flux read body error: %s", err)
-		return
-	}
-	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(p)
-	return
+	return CopyResponse(w, resp)
 }
 
-func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
-	qr = &QueryResult{}
+func (hb *HttpBackend) prepareQuery(req *http.Request) (err error) {
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
 	req.Form.Del("u")
 	req.Form.Del("p")
 	req.ContentLength = 0
+	removeBearerAuth(req)
 	if hb.username != "" || hb.password != "" {
 		hb.SetBasicAuth(req)
 	}
 
-	req.URL, qr.Err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
+	req.URL, err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
+	if err != nil {
+		log.Print("internal url parse error: ", err)
+	}
+	return
+}
+
+func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
+	qr = &QueryResult{}
+	qr.Err = hb.prepareQuery(req)
 	if qr.Err != nil {
-		log.Print("internal url parse error: ", qr.Err)
 		return
 	}
 
@@ -361,7 +434,7 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 	if err != nil {
 		if req.Header.Get(HeaderQueryOrigin) != QueryParallel || err.Error() != "context canceled" {
 			qr.Err = err
-			log.Printf("query error: %s, the query is %s", err, q)
+			log.Printf("query error: %s, the query is %s", err, MaskPassword(q))
 		}
 		return
 	}
@@ -384,7 +457,7 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 
 	qr.Body, qr.Err = ioutil.ReadAll(respBody)
 	if qr.Err != nil {
-		log.Printf("read body error: %s, the query is %s", qr.Err, q)
+		log.Printf("read body error: %s, the query is %s", qr.Err, MaskPassword(q))
 		return
 	}
 	if resp.StatusCode >= 400 {
@@ -459,7 +532,96 @@ func (hb *HttpBackend) DropMeasurement(db, meas string) ([]byte, error) {
 	return qr.Body, qr.Err
 }
 
+// DeleteMeasurement deletes the points of the measurement within [start, end) in nanoseconds,
+// zero start or end means unlimited, and at least one of them is required
+func (hb *HttpBackend) DeleteMeasurement(db, meas string, start, end int64) ([]byte, error) {
+	conds := make([]string, 0, 2)
+	if start > 0 {
+		conds = append(conds, fmt.Sprintf("time >= %d", start))
+	}
+	if end > 0 {
+		conds = append(conds, fmt.Sprintf("time < %d", end))
+	}
+	q := fmt.Sprintf("delete from \"%s\" where %s", util.EscapeIdentifier(meas), strings.Join(conds, " and "))
+	qr := hb.Query(NewQueryRequest("POST", db, q, ""), nil, true)
+	return qr.Body, qr.Err
+}
+
 func (hb *HttpBackend) Close() {
 	hb.running.Store(false)
 	hb.transport.CloseIdleConnections()
 }
+
+// QueryStream sends the query and returns the response without reading the body, which must be closed by the caller.
+// An error response is read and returned as error, so that nothing has been written to the client yet.
+func (hb *HttpBackend) QueryStream(req *http.Request) (resp *http.Response, err error) {
+	err = hb.prepareQuery(req)
+	if err != nil {
+		return
+	}
+	q := strings.TrimSpace(req.FormValue("q"))
+	resp, err = hb.transport.RoundTrip(req)
+	if err != nil {
+		if req.Header.Get(HeaderQueryOrigin) != QueryParallel || err.Error() != "context canceled" {
+			log.Printf("query error: %s, the query is %s", err, MaskPassword(q))
+		}
+		return
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var body []byte
+		body, err = readResponseBody(resp)
+		if err != nil {
+			return nil, err
+		}
+		// the error body from an upstream proxy or load balancer may be not json
+		rsp, err := ResponseFromResponseBytes(body)
+		if err != nil || rsp.Err == "" {
+			return nil, fmt.Errorf("%d: %s", resp.StatusCode, bytes.TrimSpace(body))
+		}
+		return nil, errors.New(rsp.Err)
+	}
+	return
+}
+
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer b.Close()
+		return ioutil.ReadAll(b)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// CopyResponse streams the response to the client and flushes every chunk, so that memory is bounded
+// and a slow client slows down the backend. Errors after the status is written are only logged,
+// since the response has been committed and can't be retried on another backend.
+func CopyResponse(w http.ResponseWriter, resp *http.Response) error {
+	CopyHeader(w.Header(), resp.Header)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				log.Printf("stream response error: %s", werr)
+				return nil
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Printf("stream response error: %s", err)
+			return nil
+		}
+	}
+}
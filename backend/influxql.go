@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"errors"
 	"log"
+	"regexp"
 	"strings"
 
 	"github.com/chengshiwen/influx-proxy/util"
@@ -21,7 +22,20 @@ var SupportCmds = util.NewSet(
 	"show tag keys",
 	"show tag values",
 	"show stats",
+	"show diagnostics",
+	"show series cardinality",
+	"show series exact cardinality",
+	"show measurement cardinality",
+	"show measurement exact cardinality",
+	"show tag key cardinality",
+	"show tag key exact cardinality",
+	"show tag values cardinality",
+	"show tag values exact cardinality",
+	"show field key cardinality",
+	"show field key exact cardinality",
 	"show databases",
+	"show queries",
+	"kill query",
 	"create database",
 	"drop database",
 	"show retention policies",
@@ -29,10 +43,28 @@ var SupportCmds = util.NewSet(
 	"alter retention policy",
 	"drop retention policy",
 	"delete from",
+	"delete where",
 	"drop series from",
+	"drop series where",
 	"drop measurement",
+	"create continuous query",
+	"drop continuous query",
+	"show continuous queries",
+	"create user",
+	"drop user",
+	"set password",
+	"grant all",
+	"grant read",
+	"grant write",
+	"revoke all",
+	"revoke read",
+	"revoke write",
+	"show users",
+	"show grants",
 )
 
+var passwordReg = regexp.MustCompile(`(?i)(\bpassword\s*(?:for\s+\S+\s*=\s*)?)'(?:[^'\\]|\\.)*'`)
+
 var (
 	ErrWrongBackslash = errors.New("wrong backslash")
 	ErrUnmatchedQuote = errors.New("unmatched quote")
@@ -370,9 +402,6 @@ func CheckQuery(q string) (tokens []string, check bool, from bool) {
 	if stmt == "select" {
 		for i := 2; i < len(tokens); i++ {
 			stmt := strings.ToLower(tokens[i])
-			if stmt == "into" {
-				return tokens, false, false
-			}
 			if stmt == "from" {
 				return tokens, true, true
 			}
@@ -388,22 +417,29 @@ func CheckQuery(q string) (tokens []string, check bool, from bool) {
 			}
 		}
 	}
-	stmt2 := GetHeadStmtFromTokens(tokens, 2)
-	if SupportCmds[stmt2] {
-		return tokens, true, stmt2 == "delete from" || stmt2 == "drop measurement"
-	}
-	stmt3 := GetHeadStmtFromTokens(tokens, 3)
-	if SupportCmds[stmt3] {
-		return tokens, true, stmt3 == "drop series from"
+	// match the longest statement first, e.g. "show series cardinality" before "show series"
+	for n := 5; n >= 2; n-- {
+		if n > len(tokens) {
+			continue
+		}
+		stmt := GetHeadStmtFromTokens(tokens, n)
+		if SupportCmds[stmt] {
+			return tokens, true, stmt == "delete from" || stmt == "drop measurement" || stmt == "drop series from"
+		}
 	}
 	return tokens, false, false
 }
 
-func CheckDatabaseFromTokens(tokens []string) (check bool, show bool, alter bool, db string) {
+// CheckDatabaseFromTokens checks the statement which requires no database (nodb), or creates or drops a database (alter)
+func CheckDatabaseFromTokens(tokens []string) (check bool, nodb bool, alter bool, db string) {
 	stmt := GetHeadStmtFromTokens(tokens, 2)
-	show = stmt == "show databases"
+	nodb = stmt == "show databases" || stmt == "show queries" || stmt == "kill query" || stmt == "show continuous"
 	alter = stmt == "create database" || stmt == "drop database"
-	check = show || alter
+	// the user statements are cluster-wide, except granting or revoking the privilege on a database
+	if CheckUserFromTokens(tokens) && !hasToken(tokens, "on") {
+		nodb = true
+	}
+	check = nodb || alter
 	if alter && len(tokens) >= 3 {
 		db = getDatabase(tokens[2:], "database")
 	}
@@ -418,12 +454,104 @@ func CheckRetentionPolicyFromTokens(tokens []string) (check bool) {
 	return
 }
 
+func CheckCardinalityFromTokens(tokens []string) (check bool) {
+	if len(tokens) >= 3 && strings.ToLower(tokens[0]) == "show" {
+		for i := 2; i < len(tokens) && i <= 4; i++ {
+			if strings.ToLower(tokens[i]) == "cardinality" {
+				return true
+			}
+		}
+	}
+	return
+}
+
+// CheckExactCardinalityFromTokens checks the cardinality statement counted exactly, not estimated
+func CheckExactCardinalityFromTokens(tokens []string) (check bool) {
+	if CheckCardinalityFromTokens(tokens) {
+		for i := 2; i < len(tokens) && i <= 3; i++ {
+			if strings.ToLower(tokens[i]) == "exact" {
+				return true
+			}
+		}
+	}
+	return
+}
+
+// CheckDiagnosticsFromTokens checks the show diagnostics statement, which is server-wide and requires no database
+func CheckDiagnosticsFromTokens(tokens []string) (check bool) {
+	return len(tokens) >= 2 && GetHeadStmtFromTokens(tokens, 2) == "show diagnostics"
+}
+
+func CheckKillQueryFromTokens(tokens []string) (check bool) {
+	return len(tokens) >= 3 && GetHeadStmtFromTokens(tokens, 2) == "kill query"
+}
+
+// CheckSelectIntoFromTokens checks the select statement with into clause
+func CheckSelectIntoFromTokens(tokens []string) (check bool) {
+	if strings.ToLower(tokens[0]) != "select" {
+		return
+	}
+	for i := 1; i < len(tokens); i++ {
+		stmt := strings.ToLower(tokens[i])
+		if stmt == "from" {
+			return
+		}
+		if stmt == "into" {
+			return true
+		}
+	}
+	return
+}
+
+// GetIntoTargetFromTokens returns the target database, retention policy and measurement of the into clause,
+// the measurement may be the backreference :MEASUREMENT
+func GetIntoTargetFromTokens(tokens []string) (db, rp, mm string, err error) {
+	for i := 0; i < len(tokens)-1; i++ {
+		if strings.ToLower(tokens[i]) == "into" {
+			target := tokens[i+1:]
+			return getDatabase(target, "from"), getRetentionPolicy(target, "from"), getMeasurement(target, "from"), nil
+		}
+	}
+	return "", "", "", ErrIllegalQL
+}
+
+// CheckContinuousQueryFromTokens checks the create, drop or show continuous query statement
+func CheckContinuousQueryFromTokens(tokens []string) (check bool) {
+	if len(tokens) >= 3 {
+		stmt := GetHeadStmtFromTokens(tokens, 3)
+		return stmt == "create continuous query" || stmt == "drop continuous query" || stmt == "show continuous queries"
+	}
+	return
+}
+
+// CheckUserFromTokens checks the statement which manages the users and privileges
+func CheckUserFromTokens(tokens []string) (check bool) {
+	if len(tokens) >= 2 {
+		switch GetHeadStmtFromTokens(tokens, 2) {
+		case "create user", "drop user", "set password", "grant all", "grant read", "grant write",
+			"revoke all", "revoke read", "revoke write", "show users", "show grants":
+			return true
+		}
+	}
+	return
+}
+
 func CheckSelectOrShowFromTokens(tokens []string) (check bool) {
 	stmt := strings.ToLower(tokens[0])
 	check = stmt == "select" || stmt == "show"
 	return
 }
 
+// CheckDeleteOrDropSeriesWhereFromTokens checks the delete or drop series statement without from clause,
+// which applies to all measurements
+func CheckDeleteOrDropSeriesWhereFromTokens(tokens []string) (check bool) {
+	if len(tokens) >= 3 {
+		stmt := GetHeadStmtFromTokens(tokens, 3)
+		return strings.HasPrefix(stmt, "delete where ") || stmt == "drop series where"
+	}
+	return
+}
+
 func CheckDeleteOrDropMeasurementFromTokens(tokens []string) (check bool) {
 	if len(tokens) >= 3 {
 		stmt := GetHeadStmtFromTokens(tokens, 2)
@@ -431,3 +559,65 @@ func CheckDeleteOrDropMeasurementFromTokens(tokens []string) (check bool) {
 	}
 	return
 }
+
+// FindKeyword returns the index of the first keyword at the top level of the query,
+// skipping quoted strings, quoted identifiers and parentheses, or -1 if not found
+func FindKeyword(q string, keyword string) int {
+	depth := 0
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; c {
+		case '\'', '"':
+			end := i + 1
+			for end < len(q) && q[end] != c {
+				if q[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			i = end
+		case '(':
+			depth++
+		case ')':
+			depth--
+		default:
+			if depth == 0 && (i == 0 || !isIdentChar(q[i-1])) && i+len(keyword) <= len(q) &&
+				strings.EqualFold(q[i:i+len(keyword)], keyword) && (i+len(keyword) == len(q) || !isIdentChar(q[i+len(keyword)])) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// InsertClause inserts the clause before the first top-level keyword in the given keywords, or appends it to the end
+func InsertClause(q string, clause string, keywords ...string) string {
+	q = strings.TrimRight(strings.TrimSpace(q), ";")
+	pos := -1
+	for _, keyword := range keywords {
+		if i := FindKeyword(q, keyword); i >= 0 && (pos < 0 || i < pos) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return q + " " + clause
+	}
+	return q[:pos] + clause + " " + q[pos:]
+}
+
+// MaskPassword masks the passwords in the statement, so that it can be logged
+func MaskPassword(q string) string {
+	return passwordReg.ReplaceAllString(q, "$1'******'")
+}
+
+func hasToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if strings.ToLower(t) == token {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -4,7 +4,10 @@
 
 package backend
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 // ALTER RETENTION POLICY "1h.cpu" ON "mydb" DEFAULT
 // ALTER RETENTION POLICY "policy1" ON "somedb" DURATION 1h REPLICATION 4
@@ -470,3 +473,94 @@ func BenchmarkGetMeasurementFromInfluxQL(b *testing.B) {
 		}
 	}
 }
+
+func TestCheckQuery(t *testing.T) {
+	tests := []struct {
+		q     string
+		check bool
+		from  bool
+	}{
+		{`SHOW SERIES CARDINALITY`, true, false},
+		{`SHOW SERIES EXACT CARDINALITY ON mydb`, true, false},
+		{`SHOW SERIES CARDINALITY FROM "cpu"`, true, true},
+		{`SHOW MEASUREMENT CARDINALITY`, true, false},
+		{`SHOW MEASUREMENT EXACT CARDINALITY ON mydb`, true, false},
+		{`SHOW TAG VALUES CARDINALITY WITH KEY = "myTagKey"`, true, false},
+		{`SHOW TAG VALUES EXACT CARDINALITY FROM "cpu" WITH KEY = "myTagKey"`, true, true},
+		{`SHOW FIELD KEY CARDINALITY`, true, false},
+		{`SHOW FIELD KEY EXACT CARDINALITY ON mydb`, true, false},
+		{`SHOW DIAGNOSTICS`, true, false},
+		{`SHOW SERIES`, true, false},
+		{`SHOW MEASUREMENTS`, true, false},
+		{`DROP SERIES FROM "cpu" WHERE cpu = 'cpu8'`, true, true},
+		{`DELETE FROM "cpu"`, true, true},
+		{`DELETE WHERE host = 'server1'`, true, false},
+		{`DROP SERIES WHERE host = 'server1'`, true, false},
+		{`SHOW SHARDS`, false, false},
+		{`SELECT mean("value") INTO "cpu_1h" FROM "cpu" GROUP BY time(1h)`, true, true},
+		{`CREATE CONTINUOUS QUERY cq1 ON mydb BEGIN SELECT mean("value") INTO "cpu_1h" FROM "cpu" GROUP BY time(1h) END`, true, false},
+		{`SHOW CONTINUOUS QUERIES`, true, false},
+		{`CREATE USER "admin" WITH PASSWORD 'secret' WITH ALL PRIVILEGES`, true, false},
+		{`GRANT READ ON "mydb" TO "reader"`, true, false},
+		{`REVOKE ALL PRIVILEGES FROM "admin"`, true, false},
+		{`SHOW GRANTS FOR "reader"`, true, false},
+	}
+	for _, tt := range tests {
+		tokens, check, from := CheckQuery(tt.q)
+		if check != tt.check || from != tt.from {
+			t.Errorf("check query wrong: %s, (%t, %t) != (%t, %t)", tt.q, check, from, tt.check, tt.from)
+		}
+		if check && !from && CheckCardinalityFromTokens(tokens) != strings.Contains(strings.ToLower(tt.q), "cardinality") {
+			t.Errorf("check cardinality wrong: %s", tt.q)
+		}
+		if check && !from && CheckExactCardinalityFromTokens(tokens) != strings.Contains(strings.ToLower(tt.q), "exact cardinality") {
+			t.Errorf("check exact cardinality wrong: %s", tt.q)
+		}
+		if CheckDiagnosticsFromTokens(tokens) != (tt.q == "SHOW DIAGNOSTICS") {
+			t.Errorf("check diagnostics wrong: %s", tt.q)
+		}
+	}
+}
+
+func TestGetIntoTargetFromTokens(t *testing.T) {
+	tests := []struct {
+		q  string
+		db string
+		rp string
+		mm string
+	}{
+		{`SELECT * INTO "cpu_copy" FROM "cpu"`, "", "", "cpu_copy"},
+		{`SELECT mean("value") INTO "autogen"."cpu_1h" FROM "cpu" GROUP BY time(1h)`, "", "autogen", "cpu_1h"},
+		{`SELECT * INTO "db2"."rp2"."cpu" FROM "db1"."rp1"."cpu"`, "db2", "rp2", "cpu"},
+		{`SELECT * INTO db2..:MEASUREMENT FROM "cpu"`, "db2", "", ":MEASUREMENT"},
+	}
+	for _, tt := range tests {
+		tokens := ScanTokens(tt.q, 0)
+		if !CheckSelectIntoFromTokens(tokens) {
+			t.Errorf("check select into wrong: %s", tt.q)
+		}
+		db, rp, mm, err := GetIntoTargetFromTokens(tokens)
+		if err != nil || db != tt.db || rp != tt.rp || mm != tt.mm {
+			t.Errorf("into target wrong: %s, (%s, %s, %s) != (%s, %s, %s)", tt.q, db, rp, mm, tt.db, tt.rp, tt.mm)
+		}
+	}
+	if CheckSelectIntoFromTokens(ScanTokens(`SELECT * FROM "cpu" WHERE "into" = 'x'`, 0)) {
+		t.Error("select without into clause should not be checked")
+	}
+}
+
+func TestMaskPassword(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{`CREATE USER "admin" WITH PASSWORD 'sec\'ret' WITH ALL PRIVILEGES`, `CREATE USER "admin" WITH PASSWORD '******' WITH ALL PRIVILEGES`},
+		{`set password for "admin" = 'secret'`, `set password for "admin" = '******'`},
+		{`select * from cpu where password = 'a'`, `select * from cpu where password = 'a'`},
+	}
+	for _, tt := range tests {
+		if got := MaskPassword(tt.q); got != tt.want {
+			t.Errorf("mask password: %s, got %s, want %s", tt.q, got, tt.want)
+		}
+	}
+}
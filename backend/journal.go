@@ -0,0 +1,108 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JournalEntry is a statement which is not applied to the backend yet
+type JournalEntry struct {
+	Db   string `json:"db"`
+	Q    string `json:"q"`
+	Time int64  `json:"time"`
+}
+
+// Journal is the persistent queue of ddl statements for a backend which missed them while it was inactive,
+// it's saved as json lines in the file <name>.ddl under the data dir, which is only readable by the owner
+// as the statements may contain passwords
+type Journal struct {
+	lock     sync.Mutex
+	filename string
+	entries  []*JournalEntry
+}
+
+func NewJournal(name string, datadir string) (j *Journal, err error) {
+	j = &Journal{filename: filepath.Join(datadir, name+".ddl")}
+	b, err := ioutil.ReadFile(j.filename)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			log.Printf("journal entry error: %s, file: %s, line: %s", err, j.filename, line)
+			continue
+		}
+		j.entries = append(j.entries, entry)
+	}
+	return j, nil
+}
+
+func (j *Journal) Append(db, q string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.entries = append(j.entries, &JournalEntry{Db: db, Q: q, Time: time.Now().Unix()})
+	return j.save()
+}
+
+// Front returns the oldest entry, or nil if the journal is empty
+func (j *Journal) Front() *JournalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if len(j.entries) == 0 {
+		return nil
+	}
+	return j.entries[0]
+}
+
+// Pop removes the oldest entry if it's the given entry
+func (j *Journal) Pop(entry *JournalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if len(j.entries) == 0 || j.entries[0] != entry {
+		return nil
+	}
+	j.entries = j.entries[1:]
+	return j.save()
+}
+
+func (j *Journal) Len() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.entries)
+}
+
+func (j *Journal) save() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range j.entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	tmp := j.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.filename)
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken      = errors.New("invalid token")
+	ErrTokenExpired      = errors.New("token expired")
+	ErrTokenNotValidYet  = errors.New("token not valid yet")
+	ErrTokenNoExpiration = errors.New("token expiration required")
+	ErrTokenAlgorithm    = errors.New("unsupported token algorithm")
+	ErrTokenSignature    = errors.New("invalid token signature")
+	ErrTokenKeyNotFound  = errors.New("token key not found")
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWTValidator validates the jwt signed by HS256 with the shared secret, or by RS256 with the keys of the jwks file
+type JWTValidator struct {
+	secret        []byte
+	keys          map[string]*rsa.PublicKey
+	usernameClaim string
+}
+
+func NewJWTValidator(secret, jwksFile, usernameClaim string) (v *JWTValidator, err error) {
+	v = &JWTValidator{secret: []byte(secret), keys: make(map[string]*rsa.PublicKey), usernameClaim: usernameClaim}
+	if jwksFile == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &jwks); err != nil {
+		return nil, fmt.Errorf("parse jwks file %s error: %s", jwksFile, err)
+	}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus of jwk %s: %s", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent of jwk %s", k.Kid)
+		}
+		v.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("no RS256 key found in jwks file %s", jwksFile)
+	}
+	return
+}
+
+// Validate validates the signature, exp and nbf of the token, and returns the username claim
+func (v *JWTValidator) Validate(token string, now time.Time) (username string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = decodeSegment(parts[0], &header); err != nil {
+		return "", ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return "", ErrTokenAlgorithm
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", ErrTokenSignature
+		}
+	case "RS256":
+		key, ok := v.keys[header.Kid]
+		if !ok && header.Kid == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				key, ok = k, true
+			}
+		}
+		if !ok {
+			return "", ErrTokenKeyNotFound
+		}
+		hash := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) != nil {
+			return "", ErrTokenSignature
+		}
+	default:
+		return "", ErrTokenAlgorithm
+	}
+
+	claims := make(map[string]interface{})
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return "", ErrInvalidToken
+	}
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return "", ErrTokenNoExpiration
+	}
+	if t, err := exp.Float64(); err != nil || float64(now.Unix()) >= t {
+		return "", ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if t, err := nbf.Float64(); err != nil || float64(now.Unix()) < t {
+			return "", ErrTokenNotValidYet
+		}
+	}
+	username, _ = claims[v.usernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("%w: claim %s not found", ErrInvalidToken, v.usernameClaim)
+	}
+	return username, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
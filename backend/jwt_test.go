@@ -0,0 +1,102 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signToken(header, claims map[string]interface{}, sign func([]byte) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestJWTValidatorHS256(t *testing.T) {
+	v, err := NewJWTValidator("secret", "", "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	hs256 := func(key string) func([]byte) []byte {
+		return func(b []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write(b)
+			return mac.Sum(nil)
+		}
+	}
+	header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{signToken(header, map[string]interface{}{"username": "reader", "exp": now.Unix() + 60}, hs256("secret")), nil},
+		{signToken(header, map[string]interface{}{"username": "reader", "exp": now.Unix()}, hs256("secret")), ErrTokenExpired},
+		{signToken(header, map[string]interface{}{"username": "reader"}, hs256("secret")), ErrTokenNoExpiration},
+		{signToken(header, map[string]interface{}{"username": "reader", "exp": now.Unix() + 60, "nbf": now.Unix() + 30}, hs256("secret")), ErrTokenNotValidYet},
+		{signToken(header, map[string]interface{}{"username": "reader", "exp": now.Unix() + 60}, hs256("other")), ErrTokenSignature},
+		{signToken(map[string]interface{}{"alg": "none"}, map[string]interface{}{"username": "reader", "exp": now.Unix() + 60}, func([]byte) []byte { return nil }), ErrTokenAlgorithm},
+		{"a.b", ErrInvalidToken},
+	}
+	for i, tt := range tests {
+		username, err := v.Validate(tt.token, now)
+		if err != tt.err || (err == nil && username != "reader") {
+			t.Errorf("test %d: username = %s, err = %v, want %v", i, username, err, tt.err)
+		}
+	}
+	if _, err = v.Validate(signToken(header, map[string]interface{}{"user": "reader", "exp": now.Unix() + 60}, hs256("secret")), now); err == nil {
+		t.Error("token without username claim should be rejected")
+	}
+}
+
+func TestJWTValidatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "k1",
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	b, _ := json.Marshal(jwks)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	ioutil.WriteFile(file, b, 0600)
+	v, err := NewJWTValidator("", file, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := func(b []byte) []byte {
+		hash := sha256.Sum256(b)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		return sig
+	}
+	now := time.Now()
+	claims := map[string]interface{}{"sub": "writer", "exp": now.Unix() + 60}
+	if username, err := v.Validate(signToken(map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, rs256), now); err != nil || username != "writer" {
+		t.Errorf("username = %s, err = %v", username, err)
+	}
+	if _, err := v.Validate(signToken(map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims, rs256), now); err != ErrTokenKeyNotFound {
+		t.Errorf("unknown kid: %v", err)
+	}
+	if _, err := v.Validate(signToken(map[string]interface{}{"alg": "HS256"}, claims, rs256), now); err != ErrTokenAlgorithm {
+		t.Errorf("HS256 without shared secret: %v", err)
+	}
+}
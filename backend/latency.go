@@ -0,0 +1,139 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyDecay   = 0.2
+	latencySamples = 128
+)
+
+// LatencyStats tracks the response latency with ewma and recent samples, and the count of in-flight requests
+type LatencyStats struct {
+	lock     sync.Mutex
+	ewma     float64
+	errRate  float64
+	samples  [latencySamples]time.Duration
+	count    int
+	inflight int64
+}
+
+func (ls *LatencyStats) Begin() {
+	atomic.AddInt64(&ls.inflight, 1)
+}
+
+// End records the latency of the request, the latency of a canceled request is ignored
+func (ls *LatencyStats) End(d time.Duration, err error, canceled bool) {
+	atomic.AddInt64(&ls.inflight, -1)
+	if canceled {
+		return
+	}
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	failed := 0.0
+	if err != nil {
+		failed = 1.0
+	}
+	if ls.count == 0 {
+		ls.ewma = float64(d)
+		ls.errRate = failed
+	} else {
+		ls.ewma = latencyDecay*float64(d) + (1-latencyDecay)*ls.ewma
+		ls.errRate = latencyDecay*failed + (1-latencyDecay)*ls.errRate
+	}
+	ls.samples[ls.count%latencySamples] = d
+	ls.count++
+}
+
+func (ls *LatencyStats) Latency() time.Duration {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return time.Duration(ls.ewma)
+}
+
+func (ls *LatencyStats) ErrorRate() float64 {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.errRate
+}
+
+func (ls *LatencyStats) Inflight() int64 {
+	return atomic.LoadInt64(&ls.inflight)
+}
+
+// Percentile returns the p-th percentile of the recent latency samples, or zero if there is no sample
+func (ls *LatencyStats) Percentile(p float64) time.Duration {
+	ls.lock.Lock()
+	n := ls.count
+	if n > latencySamples {
+		n = latencySamples
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, ls.samples[:n])
+	ls.lock.Unlock()
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	idx := int(float64(n)*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= n {
+		idx = n - 1
+	}
+	return samples[idx]
+}
+
+// Score is the expected cost of a new request, the lower the better
+func (ls *LatencyStats) Score() float64 {
+	ls.lock.Lock()
+	ewma, errRate := ls.ewma, ls.errRate
+	ls.lock.Unlock()
+	return ewma * float64(ls.Inflight()+1) * (1 + 10*errRate)
+}
+
+// responseBuffer buffers the response of a backend until it's chosen to reply to the client
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}}
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	if rb.status == 0 {
+		rb.status = http.StatusOK
+	}
+	return rb.body.Write(p)
+}
+
+func (rb *responseBuffer) WriteHeader(status int) {
+	if rb.status == 0 {
+		rb.status = status
+	}
+}
+
+func (rb *responseBuffer) CopyTo(w http.ResponseWriter) {
+	CopyHeader(w.Header(), rb.header)
+	if rb.status != 0 {
+		w.WriteHeader(rb.status)
+		w.Write(rb.body.Bytes())
+	}
+}
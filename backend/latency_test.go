@@ -0,0 +1,129 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	ls := &LatencyStats{}
+	if ls.Percentile(95) != 0 {
+		t.Error("percentile should be zero without samples")
+	}
+	for i := 1; i <= 100; i++ {
+		ls.Begin()
+		ls.End(time.Duration(i)*time.Millisecond, nil, false)
+	}
+	if p := ls.Percentile(95); p != 95*time.Millisecond {
+		t.Errorf("percentile wrong: %s != 95ms", p)
+	}
+	if p := ls.Percentile(100); p != 100*time.Millisecond {
+		t.Errorf("percentile wrong: %s != 100ms", p)
+	}
+	ls.Begin()
+	ls.End(time.Hour, nil, true)
+	if ls.Inflight() != 0 || ls.Latency() > 100*time.Millisecond {
+		t.Errorf("canceled request should be ignored: %d, %s", ls.Inflight(), ls.Latency())
+	}
+	ls.End(time.Millisecond, errors.New("error"), false)
+	if ls.ErrorRate() <= 0 {
+		t.Error("error rate should be positive")
+	}
+}
+
+func TestHedgedQuery(t *testing.T) {
+	circles := newTestCircles(1, 1)
+	primary, secondary := circles[0].Backends[0], circles[1].Backends[0]
+	delays := map[*Backend]time.Duration{primary: time.Second, secondary: 0}
+	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+		select {
+		case <-time.After(delays[be]):
+			w.Header().Set("Backend", be.Name)
+			return []byte(be.Name), nil
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/query?q=select+*+from+cpu", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	body, err := hedgedQuery(w, req, 10*time.Millisecond, primary, secondary, fn)
+	if err != nil || string(body) != secondary.Name || w.Header().Get("Backend") != secondary.Name {
+		t.Errorf("hedged query should be answered by secondary: %s, %s", body, err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Error("hedged query should not wait for primary")
+	}
+
+	delays[primary] = 0
+	w = httptest.NewRecorder()
+	body, err = hedgedQuery(w, req, time.Second, primary, secondary, fn)
+	if err != nil || string(body) != primary.Name {
+		t.Errorf("hedged query should be answered by primary: %s, %s", body, err)
+	}
+}
+
+func TestHedgedReadProm(t *testing.T) {
+	var lock sync.Mutex
+	bodies := make(map[string][]string)
+	newServer := func(name string, fail bool) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			lock.Lock()
+			bodies[name] = append(bodies[name], string(body))
+			lock.Unlock()
+			if fail {
+				// the failed backends answer slowly, so that the hedged queries run concurrently
+				time.Sleep(50 * time.Millisecond)
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	key := GetKey("db1", "cpu")
+	ip := &Proxy{hedgeEnabled: true, hedgePercentile: 50}
+	for i, name := range []string{"b1", "b2", "b3"} {
+		be := &Backend{HttpBackend: newTestHttpBackend(name, newServer(name, name != "b3").URL)}
+		be.active.Store(true)
+		// b1 and b2 look faster than b3, so they are hedged first
+		latency := time.Millisecond
+		if name == "b3" {
+			latency = time.Second
+		}
+		for j := 0; j < 10; j++ {
+			be.GetLatencyStats().Begin()
+			be.GetLatencyStats().End(latency, nil, false)
+		}
+		circle := &Circle{CircleId: i, Backends: []*Backend{be}}
+		circle.routerCache.Store(key, be)
+		ip.Circles = append(ip.Circles, circle)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/prom/read?db=db1", strings.NewReader("payload"))
+	w := httptest.NewRecorder()
+	if err := ReadProm(w, req, ip, "db1", "cpu"); err != nil || w.Body.String() != "b3" {
+		t.Fatalf("read prom should be answered by b3: %s, %v", w.Body, err)
+	}
+	for _, name := range []string{"b1", "b2", "b3"} {
+		if len(bodies[name]) != 1 || bodies[name][0] != "payload" {
+			t.Errorf("%s: bodies = %q, want the whole body", name, bodies[name])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyQueries     = errors.New("max concurrent queries reached")
+	ErrTooManyUserQueries = errors.New("max concurrent queries per user reached")
+)
+
+// QueryLimiter limits the number of concurrent queries globally and per user, zero means unlimited
+type QueryLimiter struct {
+	lock           sync.Mutex
+	maxQueries     int
+	maxUserQueries int
+	timeout        time.Duration
+	running        int
+	userRunning    map[string]int
+}
+
+func NewQueryLimiter(cfg *ProxyConfig) *QueryLimiter {
+	return &QueryLimiter{
+		maxQueries:     cfg.MaxConcurrentQueries,
+		maxUserQueries: cfg.MaxConcurrentQueriesPerUser,
+		timeout:        time.Duration(cfg.QueryTimeout) * time.Second,
+		userRunning:    make(map[string]int),
+	}
+}
+
+// Acquire reserves a query slot for the user, the returned release function must be called when the query is done.
+// The returned request carries a context which is canceled when the client disconnects or the query timeout exceeds.
+func (ql *QueryLimiter) Acquire(req *http.Request) (*http.Request, func(), error) {
+	user := GetRequestUser(req)
+	if user == "" {
+		// the unauthenticated queries are counted by the client ip
+		user = "ip=" + clientIP(req)
+	}
+	ql.lock.Lock()
+	if ql.maxQueries > 0 && ql.running >= ql.maxQueries {
+		ql.lock.Unlock()
+		return req, nil, ErrTooManyQueries
+	}
+	if ql.maxUserQueries > 0 && ql.userRunning[user] >= ql.maxUserQueries {
+		ql.lock.Unlock()
+		return req, nil, ErrTooManyUserQueries
+	}
+	ql.running++
+	ql.userRunning[user]++
+	ql.lock.Unlock()
+
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if ql.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, ql.timeout)
+	}
+	release := func() {
+		cancel()
+		ql.lock.Lock()
+		defer ql.lock.Unlock()
+		ql.running--
+		ql.userRunning[user]--
+		if ql.userRunning[user] <= 0 {
+			delete(ql.userRunning, user)
+		}
+	}
+	return req.WithContext(ctx), release, nil
+}
+
+// CheckTimeout returns a clear error if the query is aborted due to the query timeout
+func (ql *QueryLimiter) CheckTimeout(req *http.Request, err error) error {
+	if err != nil && req.Context().Err() == context.DeadlineExceeded {
+		return fmt.Errorf("query timeout: exceeded %s", ql.timeout)
+	}
+	return err
+}
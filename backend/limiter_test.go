@@ -0,0 +1,80 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	ql := NewQueryLimiter(&ProxyConfig{MaxConcurrentQueries: 3, MaxConcurrentQueriesPerUser: 2})
+	req1 := httptest.NewRequest("GET", "/query", nil)
+	req1 = req1.WithContext(WithUserName(req1.Context(), "user1"))
+	req2 := httptest.NewRequest("GET", "/query", nil)
+	req2 = req2.WithContext(WithUserName(req2.Context(), "user2"))
+
+	_, release1, err := ql.Acquire(req1)
+	if err != nil {
+		t.Fatalf("acquire error: %s", err)
+	}
+	_, release2, _ := ql.Acquire(req1)
+	if _, _, err = ql.Acquire(req1); err != ErrTooManyUserQueries {
+		t.Errorf("acquire should exceed user limit: %v", err)
+	}
+	_, release3, _ := ql.Acquire(req2)
+	if _, _, err = ql.Acquire(req2); err != ErrTooManyQueries {
+		t.Errorf("acquire should exceed global limit: %v", err)
+	}
+	release1()
+	release2()
+	release3()
+	if _, _, err = ql.Acquire(req1); err != nil {
+		t.Errorf("acquire should succeed after release: %s", err)
+	}
+}
+
+func TestQueryLimiterUnauthenticated(t *testing.T) {
+	ql := NewQueryLimiter(&ProxyConfig{MaxConcurrentQueriesPerUser: 1})
+	req1 := httptest.NewRequest("GET", "/query?u=user1", nil)
+	req2 := httptest.NewRequest("GET", "/query?u=user2", nil)
+	req3 := httptest.NewRequest("GET", "/query?u=user1", nil)
+	req3.RemoteAddr = "192.0.2.2:1234"
+
+	_, release, err := ql.Acquire(req1)
+	if err != nil {
+		t.Fatalf("acquire error: %s", err)
+	}
+	defer release()
+	// the claimed users are not trusted, the queries are counted by the client ip
+	if _, _, err = ql.Acquire(req2); err != ErrTooManyUserQueries {
+		t.Errorf("acquire of the same ip should exceed user limit: %v", err)
+	}
+	_, release3, err := ql.Acquire(req3)
+	if err != nil {
+		t.Errorf("acquire of another ip error: %s", err)
+	} else {
+		release3()
+	}
+}
+
+func TestQueryLimiterTimeout(t *testing.T) {
+	ql := NewQueryLimiter(&ProxyConfig{QueryTimeout: 1})
+	req, release, err := ql.Acquire(httptest.NewRequest("GET", "/query", nil))
+	if err != nil {
+		t.Fatalf("acquire error: %s", err)
+	}
+	defer release()
+	deadline, ok := req.Context().Deadline()
+	if !ok || time.Until(deadline) > time.Second {
+		t.Error("query context should have a deadline")
+	}
+	<-req.Context().Done()
+	if err = ql.CheckTimeout(req, context.DeadlineExceeded); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("timeout error should be clear: %v", err)
+	}
+}
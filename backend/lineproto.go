@@ -6,11 +6,14 @@ package backend
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
 )
 
@@ -118,3 +121,66 @@ Loop:
 	}
 	return j-i > 3
 }
+
+// Column is a column of query result, the type is "tag" or the field type,
+// and the column of other type, such as the time, is not converted into the line
+type Column struct {
+	Key  string
+	Type string
+}
+
+// NewColumns returns the columns of query result typed by the tags in tagMap and the field types in fieldMap
+func NewColumns(columns []string, tagMap util.Set, fieldMap map[string]string) []*Column {
+	cols := make([]*Column, len(columns))
+	for i, key := range columns {
+		cols[i] = &Column{Key: key}
+		if tagMap[key] {
+			cols[i].Type = "tag"
+		} else if vtype, ok := fieldMap[key]; ok {
+			cols[i].Type = vtype
+		}
+	}
+	return cols
+}
+
+// RowToLine converts a value of query result into a line of line protocol without the trailing newline.
+// The first value is the time, the other values are converted by the columns in order into tags or
+// fields by the field type, and the tags of the row are converted into tags. It returns an empty string
+// if there is no field, since such a line is invalid.
+func RowToLine(meas string, tags map[string]string, cols []*Column, value []interface{}) string {
+	mtagSet := []string{util.EscapeMeasurement(meas)}
+	fieldSet := make([]string, 0)
+	for i := 1; i < len(value) && i < len(cols); i++ {
+		k := cols[i].Key
+		v := value[i]
+		if v == nil {
+			continue
+		}
+		switch cols[i].Type {
+		case "tag":
+			mtagSet = append(mtagSet, fmt.Sprintf("%s=%s", util.EscapeTag(k), util.EscapeTag(util.CastString(v))))
+		case "float", "boolean":
+			fieldSet = append(fieldSet, fmt.Sprintf("%s=%v", util.EscapeTag(k), v))
+		case "integer":
+			fieldSet = append(fieldSet, fmt.Sprintf("%s=%vi", util.EscapeTag(k), v))
+		case "string":
+			fieldSet = append(fieldSet, fmt.Sprintf("%s=\"%s\"", util.EscapeTag(k), models.EscapeStringField(util.CastString(v))))
+		}
+	}
+	if len(fieldSet) == 0 {
+		return ""
+	}
+	if len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if tags[k] != "" {
+				mtagSet = append(mtagSet, fmt.Sprintf("%s=%s", util.EscapeTag(k), util.EscapeTag(tags[k])))
+			}
+		}
+	}
+	return fmt.Sprintf("%s %s %v", strings.Join(mtagSet, ","), strings.Join(fieldSet, ","), value[0])
+}
@@ -6,10 +6,13 @@ package backend
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
 	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
 )
 
 func TestScanKey(t *testing.T) {
@@ -374,3 +377,33 @@ func BenchmarkRapidCheck(b *testing.B) {
 		RapidCheck(line)
 	}
 }
+
+func TestRowToLine(t *testing.T) {
+	columns := []string{"time", "host", "count", "mean", "ok", "msg"}
+	tagMap := util.NewSetFromSlice([]string{"host"})
+	fieldMap := map[string]string{"count": "integer", "mean": "float", "ok": "boolean", "msg": "string"}
+	tests := []struct {
+		tags  map[string]string
+		value []interface{}
+		want  string
+	}{
+		{
+			value: []interface{}{json.Number("1"), "server 1", json.Number("5"), json.Number("0.5"), true, `say "hi"`},
+			want:  `cpu\ load,host=server\ 1 count=5i,mean=0.5,ok=true,msg="say \"hi\"" 1`,
+		},
+		{
+			tags:  map[string]string{"region": "us", "az": "a", "empty": ""},
+			value: []interface{}{json.Number("2"), nil, nil, json.Number("1"), nil, nil},
+			want:  `cpu\ load,az=a,region=us mean=1 2`,
+		},
+		{
+			value: []interface{}{json.Number("3"), "server1", nil, nil, nil, nil},
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		if got := RowToLine("cpu load", tt.tags, NewColumns(columns, tagMap, fieldMap), tt.value); got != tt.want {
+			t.Errorf("RowToLine(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
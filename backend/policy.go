@@ -0,0 +1,232 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+var ErrInvalidDuration = errors.New("invalid duration")
+
+type QueryPolicyConfig struct {
+	Db                string `mapstructure:"db"`
+	User              string `mapstructure:"user"`
+	MaxTimeRange      string `mapstructure:"max_time_range"`
+	RequireTime       bool   `mapstructure:"require_time"`
+	MaxGroupByBuckets int    `mapstructure:"max_group_by_buckets"`
+	DefaultLimit      int    `mapstructure:"default_limit"`
+}
+
+type QueryPolicy struct {
+	*QueryPolicyConfig
+	maxTimeRange time.Duration
+}
+
+// QueryPolicies is a list of policies for select statements, the first policy matching the db and user is applied
+type QueryPolicies []*QueryPolicy
+
+func NewQueryPolicies(cfgs []*QueryPolicyConfig) (qps QueryPolicies, err error) {
+	for _, cfg := range cfgs {
+		qp := &QueryPolicy{QueryPolicyConfig: cfg}
+		if cfg.MaxTimeRange != "" {
+			qp.maxTimeRange, err = ParseDuration(cfg.MaxTimeRange)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_time_range of query policy: %s", cfg.MaxTimeRange)
+			}
+		}
+		qps = append(qps, qp)
+	}
+	return
+}
+
+func (qps QueryPolicies) Match(db, user string) *QueryPolicy {
+	for _, qp := range qps {
+		if (qp.Db == "" || qp.Db == db) && (qp.User == "" || qp.User == user) {
+			return qp
+		}
+	}
+	return nil
+}
+
+// Apply checks the select query against the policy, and returns the query which may be rewritten,
+// or an error which explains why the query is rejected
+func (qp *QueryPolicy) Apply(q string) (string, error) {
+	sel, err := parseSelect(q)
+	if err != nil {
+		return q, fmt.Errorf("query rejected by policy: %s", err)
+	}
+	now := time.Now()
+	tr, err := selectTimeRange(sel, now)
+	if err != nil {
+		return q, fmt.Errorf("query rejected by policy: %s", err)
+	}
+	lower, upper := tr.Min, tr.Max
+	if upper.IsZero() {
+		upper = now
+	}
+	bounded := !lower.IsZero()
+	if qp.RequireTime && !bounded {
+		return q, errors.New("query rejected by policy: a WHERE time clause with lower bound is required")
+	}
+	if qp.maxTimeRange > 0 {
+		if !bounded {
+			return q, fmt.Errorf("query rejected by policy: time range is unbounded, maximum is %s", qp.MaxTimeRange)
+		}
+		if upper.Sub(lower) > qp.maxTimeRange {
+			return q, fmt.Errorf("query rejected by policy: time range %s exceeds maximum %s", upper.Sub(lower), qp.MaxTimeRange)
+		}
+	}
+	if qp.MaxGroupByBuckets > 0 {
+		interval, err := sel.GroupByInterval()
+		if err != nil {
+			return q, fmt.Errorf("query rejected by policy: %s", err)
+		}
+		if interval > 0 {
+			if !bounded {
+				return q, errors.New("query rejected by policy: group by time requires a WHERE time clause with lower bound")
+			}
+			if buckets := int64(upper.Sub(lower) / interval); buckets > int64(qp.MaxGroupByBuckets) {
+				return q, fmt.Errorf("query rejected by policy: group by time produces %d buckets, maximum is %d", buckets, qp.MaxGroupByBuckets)
+			}
+		}
+	}
+	if qp.DefaultLimit > 0 && FindKeyword(q, "limit") < 0 {
+		q = InsertClause(q, fmt.Sprintf("LIMIT %d", qp.DefaultLimit), "offset", "slimit", "soffset", "tz")
+	}
+	return q, nil
+}
+
+// GetTimeRange returns the time range of the where time conditions in the query parsed by influxql, which is
+// narrowed by the time ranges of the subqueries, the lower bound is zero if absent and the upper bound is now if absent
+func GetTimeRange(q string, now time.Time) (lower time.Time, upper time.Time, err error) {
+	sel, err := parseSelect(q)
+	if err != nil {
+		return
+	}
+	tr, err := selectTimeRange(sel, now)
+	if err != nil {
+		return
+	}
+	lower, upper = tr.Min, tr.Max
+	if upper.IsZero() {
+		upper = now
+	}
+	return
+}
+
+func parseSelect(q string) (*influxql.SelectStatement, error) {
+	stmt, err := influxql.ParseStatement(q)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(*influxql.SelectStatement)
+	if !ok {
+		return nil, fmt.Errorf("not a select statement: %s", q)
+	}
+	return sel, nil
+}
+
+func selectTimeRange(sel *influxql.SelectStatement, now time.Time) (tr influxql.TimeRange, err error) {
+	// influxql intersects the time ranges of both sides of OR, which doesn't bound the query actually
+	var or bool
+	influxql.WalkFunc(sel.Condition, func(node influxql.Node) {
+		if expr, ok := node.(*influxql.BinaryExpr); ok && expr.Op == influxql.OR && hasTimeRef(expr) {
+			or = true
+		}
+	})
+	if or {
+		return tr, errors.New("time condition in OR expression is unsupported")
+	}
+	_, tr, err = influxql.ConditionExpr(sel.Condition, &influxql.NowValuer{Now: now})
+	if err != nil {
+		return
+	}
+	// the query selects the union of the time ranges of the sources, and a measurement source is unbounded
+	var union influxql.TimeRange
+	for i, src := range sel.Sources {
+		var str influxql.TimeRange
+		if sq, ok := src.(*influxql.SubQuery); ok {
+			str, err = selectTimeRange(sq.Statement, now)
+			if err != nil {
+				return
+			}
+		}
+		if i == 0 {
+			union = str
+			continue
+		}
+		if str.Min.IsZero() || str.Min.Before(union.Min) {
+			union.Min = str.Min
+		}
+		if str.Max.IsZero() || (!union.Max.IsZero() && str.Max.After(union.Max)) {
+			union.Max = str.Max
+		}
+	}
+	return tr.Intersect(union), nil
+}
+
+func hasTimeRef(expr influxql.Expr) (found bool) {
+	influxql.WalkFunc(expr, func(node influxql.Node) {
+		if ref, ok := node.(*influxql.VarRef); ok && strings.ToLower(ref.Val) == "time" {
+			found = true
+		}
+	})
+	return
+}
+
+// ParseDuration parses a duration literal of InfluxQL, such as 1h30m, 7d and 2w
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, ErrInvalidDuration
+	}
+	var d time.Duration
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		k := j
+		for k < len(s) && (s[k] < '0' || s[k] > '9') {
+			k++
+		}
+		if j == i || k == j {
+			return 0, ErrInvalidDuration
+		}
+		n, err := strconv.ParseInt(s[i:j], 10, 64)
+		if err != nil {
+			return 0, ErrInvalidDuration
+		}
+		var unit time.Duration
+		switch s[j:k] {
+		case "ns":
+			unit = time.Nanosecond
+		case "u", "µ":
+			unit = time.Microsecond
+		case "ms":
+			unit = time.Millisecond
+		case "s":
+			unit = time.Second
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		case "d":
+			unit = 24 * time.Hour
+		case "w":
+			unit = 7 * 24 * time.Hour
+		default:
+			return 0, ErrInvalidDuration
+		}
+		d += time.Duration(n) * unit
+		i = k
+	}
+	return d, nil
+}
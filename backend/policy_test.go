@@ -0,0 +1,113 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		err  bool
+	}{
+		{s: "10s", want: 10 * time.Second},
+		{s: "1h30m", want: 90 * time.Minute},
+		{s: "7d", want: 7 * 24 * time.Hour},
+		{s: "2w", want: 14 * 24 * time.Hour},
+		{s: "100ms", want: 100 * time.Millisecond},
+		{s: "5u", want: 5 * time.Microsecond},
+		{s: "", err: true},
+		{s: "10", err: true},
+		{s: "1y", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.s)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v, err %t", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestGetTimeRange(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		q     string
+		lower time.Time
+		upper time.Time
+	}{
+		{q: "select * from cpu", upper: now},
+		{q: "select * from cpu where time >= now() - 1h", lower: now.Add(-time.Hour), upper: now},
+		{q: "select * from cpu where host = 'a' and time >= '2021-05-01T00:00:00Z' and time <= '2021-05-02'", lower: now.AddDate(0, -1, 0), upper: now.AddDate(0, -1, 1)},
+		// the exclusive bounds are converted to the inclusive ones
+		{q: "select * from cpu where time>1622332800000000000 and time<now()-1d", lower: now.AddDate(0, 0, -2).Add(1), upper: now.AddDate(0, 0, -1).Add(-1)},
+		{q: "select * from cpu where time = 1622505600s", lower: now, upper: now},
+		{q: "select * from cpu where (time >= now() - 1h) and (host = 'a' or host = 'b')", lower: now.Add(-time.Hour), upper: now},
+		{q: "select * from cpu where msg = 'time > 0'", upper: now},
+		{q: "select * from (select * from cpu where time >= now() - 2h) where time <= now() - 1h", lower: now.Add(-2 * time.Hour), upper: now.Add(-time.Hour)},
+		{q: "select * from (select * from cpu where time >= now() - 2h), mem", upper: now},
+		{q: "select * from (select * from cpu where time >= now() - 2h), (select * from mem where time >= now() - 1h)", lower: now.Add(-2 * time.Hour), upper: now},
+	}
+	for _, tt := range tests {
+		lower, upper, err := GetTimeRange(tt.q, now)
+		if err != nil || !lower.Equal(tt.lower) || !upper.Equal(tt.upper) {
+			t.Errorf("GetTimeRange(%q) = %v, %v, %v, want %v, %v", tt.q, lower, upper, err, tt.lower, tt.upper)
+		}
+	}
+	for _, q := range []string{
+		"select * from cpu where time > 'yesterday'",
+		"select * from cpu where time > now() - 1h or host = 'a'",
+		"select * from (select * from cpu where time > now() - 1h or host = 'a')",
+		"show databases",
+	} {
+		if _, _, err := GetTimeRange(q, now); err == nil {
+			t.Errorf("GetTimeRange(%q) should be an error", q)
+		}
+	}
+}
+
+func TestQueryPolicy(t *testing.T) {
+	qps, err := NewQueryPolicies([]*QueryPolicyConfig{
+		{Db: "db1", User: "admin"},
+		{Db: "db1", MaxTimeRange: "7d", RequireTime: true, MaxGroupByBuckets: 1000, DefaultLimit: 100},
+	})
+	if err != nil {
+		t.Fatalf("new query policies error: %s", err)
+	}
+	if qp := qps.Match("db2", "user"); qp != nil {
+		t.Error("db2 should match no policy")
+	}
+	if qp := qps.Match("db1", "admin"); qp == nil || qp.RequireTime {
+		t.Error("admin should match the first policy")
+	}
+	qp := qps.Match("db1", "user")
+	tests := []struct {
+		q    string
+		want string
+		err  bool
+	}{
+		{q: "select * from cpu", err: true},
+		{q: "select * from cpu where time > now() - 30d", err: true},
+		{q: "select mean(v) from cpu where time > now() - 7d group by time(1m)", err: true},
+		{q: "select mean(v) from cpu where time > now() - 7d group by time(1h)", want: "select mean(v) from cpu where time > now() - 7d group by time(1h) LIMIT 100"},
+		{q: "select * from cpu where time > now() - 1h limit 10", want: "select * from cpu where time > now() - 1h limit 10"},
+		{q: "select * from cpu where time > now() - 1h and host = 'limit' slimit 5;", want: "select * from cpu where time > now() - 1h and host = 'limit' LIMIT 100 slimit 5"},
+		{q: "select * from cpu where time > now() - 1h or host = 'a'", err: true},
+		{q: "select * from cpu where msg = 'time > now() - 1h'", err: true},
+		{q: "select * from (select * from cpu where time > now() - 1h)", want: "select * from (select * from cpu where time > now() - 1h) LIMIT 100"},
+		{q: "select * from (select * from cpu limit 1) where time > now() - 1h tz('UTC')", want: "select * from (select * from cpu limit 1) where time > now() - 1h LIMIT 100 tz('UTC')"},
+	}
+	for _, tt := range tests {
+		got, err := qp.Apply(tt.q)
+		if (err != nil) != tt.err || (!tt.err && got != tt.want) {
+			t.Errorf("Apply(%q) = %q, %v, want %q, err %t", tt.q, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err = NewQueryPolicies([]*QueryPolicyConfig{{MaxTimeRange: "1x"}}); err == nil {
+		t.Error("invalid max_time_range should be an error")
+	}
+}
@@ -18,26 +18,62 @@ import (
 )
 
 type Proxy struct {
-	Circles []*Circle
-	dbSet   util.Set
+	Circles         []*Circle
+	dbSet           util.Set
+	cache           *QueryCache
+	limiter         *QueryLimiter
+	hedgeEnabled    bool
+	hedgePercentile float64
+	policies        QueryPolicies
+	rules           StatementRules
+	rateLimiter     *RateLimiter
+	cqs             *ContinuousQueries
 }
 
-func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
-	err := util.MakeDir(cfg.DataDir)
+// NewProxy returns the proxy of the config, or the error if any backend or component fails to load
+func NewProxy(cfg *ProxyConfig) (ip *Proxy, err error) {
+	err = util.MakeDir(cfg.DataDir)
 	if err != nil {
-		log.Fatalf("create data dir error: %s", err)
-		return
+		return nil, fmt.Errorf("create data dir error: %w", err)
 	}
 	ip = &Proxy{
-		Circles: make([]*Circle, len(cfg.Circles)),
-		dbSet:   util.NewSet(),
+		Circles:         make([]*Circle, len(cfg.Circles)),
+		dbSet:           util.NewSet(),
+		limiter:         NewQueryLimiter(cfg),
+		hedgeEnabled:    cfg.HedgeEnabled,
+		hedgePercentile: cfg.HedgePercentile,
 	}
 	for idx, circfg := range cfg.Circles {
-		ip.Circles[idx] = NewCircle(circfg, cfg, idx)
+		ip.Circles[idx], err = NewCircle(circfg, cfg, idx)
+		if err != nil {
+			return nil, err
+		}
 	}
 	for _, db := range cfg.DBList {
 		ip.dbSet.Add(db)
 	}
+	ip.policies, err = NewQueryPolicies(cfg.QueryPolicies)
+	if err != nil {
+		return nil, fmt.Errorf("create query policies error: %w", err)
+	}
+	ip.rules, err = NewStatementRules(cfg.StatementRules)
+	if err != nil {
+		return nil, fmt.Errorf("create statement rules error: %w", err)
+	}
+	if len(cfg.RateLimits) > 0 {
+		ip.rateLimiter, err = NewRateLimiter(cfg.RateLimits)
+		if err != nil {
+			return nil, fmt.Errorf("create rate limiter error: %w", err)
+		}
+	}
+	if cfg.QueryCacheEnabled {
+		ip.cache = NewQueryCache(cfg)
+	}
+	ip.cqs, err = NewContinuousQueries(cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("load continuous queries error: %w", err)
+	}
+	ip.cqs.Start(ip)
 	rand.Seed(time.Now().UnixNano())
 	return
 }
@@ -85,6 +121,25 @@ func (ip *Proxy) GetHealth(stats bool) []interface{} {
 	return health
 }
 
+func (ip *Proxy) GetCacheStats() *CacheStats {
+	if ip.cache == nil {
+		return nil
+	}
+	return ip.cache.GetStats()
+}
+
+func (ip *Proxy) GetRateLimitStats() *RateLimitStats {
+	if ip.rateLimiter == nil {
+		return nil
+	}
+	return ip.rateLimiter.GetStats()
+}
+
+// AllowWrite checks the rate limits of the write with the points and bytes
+func (ip *Proxy) AllowWrite(req *http.Request, db string, points, bytes int) error {
+	return ip.rateLimiter.AllowWrite(req, db, points, bytes)
+}
+
 func (ip *Proxy) IsForbiddenDB(db string) bool {
 	return len(ip.dbSet) > 0 && !ip.dbSet[db]
 }
@@ -107,7 +162,21 @@ func (ip *Proxy) QueryFlux(w http.ResponseWriter, req *http.Request, qr *QueryRe
 	if meas == "" {
 		return ErrGetMeasurement
 	}
-	return QueryFlux(w, req, ip, bucket, meas)
+	err = AuthorizeDatabase(UserFromContext(req.Context()), bucket, ReadPrivilege)
+	if err != nil {
+		return
+	}
+	err = ip.rateLimiter.AllowQuery(req, bucket)
+	if err != nil {
+		return
+	}
+	req, release, err := ip.limiter.Acquire(req)
+	if err != nil {
+		return
+	}
+	defer release()
+	err = QueryFlux(w, req, ip, bucket, meas)
+	return ip.limiter.CheckTimeout(req, err)
 }
 
 func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, err error) {
@@ -117,18 +186,36 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 	}
 
 	tokens, check, from := CheckQuery(q)
-	if !check {
-		return nil, ErrIllegalQL
-	}
-
-	checkDb, showDb, alterDb, db := CheckDatabaseFromTokens(tokens)
-	if !checkDb {
+	checkDb, noDb, alterDb, db := CheckDatabaseFromTokens(tokens)
+	diagnostics := CheckDiagnosticsFromTokens(tokens)
+	if diagnostics {
+		noDb = true
+	} else if !checkDb {
 		db, _ = GetDatabaseFromTokens(tokens)
 		if db == "" {
 			db = req.FormValue("db")
 		}
 	}
-	if !showDb {
+
+	// the statement not supported is passed through to all backends if it's allowed by the statement rules
+	passthrough := false
+	stmt := StatementType(tokens)
+	user := UserFromContext(req.Context())
+	if sr := ip.rules.Match(stmt, db, GetRequestUser(req)); sr != nil {
+		err = sr.Check(stmt, db, user)
+		if err != nil {
+			return
+		}
+		// the admin rule allows the statement to admins, which is checked for the passthrough below
+		passthrough = !check && (sr.Action == RuleAllow || sr.Action == RuleAdmin)
+	}
+	if !check && !passthrough {
+		return nil, fmt.Errorf("%w: %s is not supported", ErrIllegalQL, stmt)
+	}
+	if passthrough {
+		noDb = noDb || db == ""
+	}
+	if !noDb {
 		if db == "" {
 			return nil, ErrDatabaseNotFound
 		}
@@ -137,15 +224,78 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 		}
 	}
 
+	if passthrough {
+		// the statement unknown to the proxy may manage the cluster
+		if user != nil && !user.Admin {
+			return nil, fmt.Errorf("%w: user %s requires admin privilege for %s", ErrNotAuthorized, user.Name, stmt)
+		}
+	} else {
+		err = AuthorizeQuery(user, tokens, db)
+		if err != nil {
+			return
+		}
+	}
+
+	if strings.ToLower(tokens[0]) == "select" {
+		if qp := ip.policies.Match(db, GetRequestUser(req)); qp != nil {
+			rq, err := qp.Apply(q)
+			if err != nil {
+				return nil, err
+			}
+			if rq != q {
+				req.Form.Set("q", rq)
+				tokens = ScanTokens(rq, 0)
+			}
+		}
+	}
+
+	err = ip.rateLimiter.AllowQuery(req, db)
+	if err != nil {
+		return
+	}
+	req, release, err := ip.limiter.Acquire(req)
+	if err != nil {
+		return
+	}
+	defer release()
+	defer func() {
+		err = ip.limiter.CheckTimeout(req, err)
+	}()
+
+	if passthrough {
+		return QueryPassthroughQL(w, req, ip, tokens)
+	}
+	if CheckKillQueryFromTokens(tokens) {
+		return QueryKillQL(w, req, ip, tokens)
+	}
+	if diagnostics {
+		return QueryDiagnosticsQL(w, req, ip, tokens)
+	}
+	if CheckContinuousQueryFromTokens(tokens) {
+		return QueryContinuousQL(w, req, ip, tokens, db)
+	}
+	if CheckUserFromTokens(tokens) {
+		return QueryUserQL(w, req, ip, tokens)
+	}
+	if CheckSelectIntoFromTokens(tokens) {
+		return QueryIntoQL(w, req, ip, tokens, db)
+	}
 	selectOrShow := CheckSelectOrShowFromTokens(tokens)
 	if selectOrShow && from {
 		return QueryFromQL(w, req, ip, tokens, db)
 	} else if selectOrShow && !from {
 		return QueryShowQL(w, req, ip, tokens)
+	} else if CheckDeleteOrDropSeriesWhereFromTokens(tokens) {
+		return QueryDeleteOrDropSeriesQL(w, req, ip, db)
 	} else if CheckDeleteOrDropMeasurementFromTokens(tokens) {
 		return QueryDeleteOrDropQL(w, req, ip, tokens, db)
 	} else if alterDb || CheckRetentionPolicyFromTokens(tokens) {
-		return QueryAlterQL(w, req, ip)
+		if alterDb && GetHeadStmtFromTokens(tokens, 1) == "drop" {
+			if err := ip.cqs.DropDatabase(db); err != nil {
+				log.Printf("drop continuous queries of database %s error: %s", db, err)
+			}
+		}
+		return QueryAlterQL(w, req, ip, db)
 	}
 	return nil, ErrIllegalQL
 }
@@ -195,6 +345,9 @@ func (ip *Proxy) WriteRow(line []byte, db, rp, precision string) {
 		log.Printf("write data error: can't get backends, db: %s, meas: %s", db, meas)
 		return
 	}
+	if ip.cache != nil {
+		ip.cache.Invalidate(db, meas)
+	}
 
 	point := &LinePoint{db, rp, nanoLine}
 	for _, be := range backends {
@@ -216,6 +369,9 @@ func (ip *Proxy) WritePoints(points []models.Point, db, rp string) error {
 			err = ErrEmptyBackends
 			continue
 		}
+		if ip.cache != nil {
+			ip.cache.Invalidate(db, meas)
+		}
 
 		point := &LinePoint{db, rp, []byte(pt.String())}
 		for _, be := range backends {
@@ -229,10 +385,23 @@ func (ip *Proxy) WritePoints(points []models.Point, db, rp string) error {
 }
 
 func (ip *Proxy) ReadProm(w http.ResponseWriter, req *http.Request, db, metric string) (err error) {
-	return ReadProm(w, req, ip, db, metric)
+	err = ip.rateLimiter.AllowQuery(req, db)
+	if err != nil {
+		return
+	}
+	req, release, err := ip.limiter.Acquire(req)
+	if err != nil {
+		return
+	}
+	defer release()
+	err = ReadProm(w, req, ip, db, metric)
+	return ip.limiter.CheckTimeout(req, err)
 }
 
 func (ip *Proxy) Close() {
+	if ip.cqs != nil {
+		ip.cqs.Close()
+	}
 	for _, c := range ip.Circles {
 		c.Close()
 	}
@@ -0,0 +1,253 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited          = errors.New("rate limit exceeded")
+	ErrInvalidRateLimitKey  = errors.New("invalid rate limit key, require user, ip or db")
+	ErrDuplicatedRateLimit  = errors.New("rate limit duplicated")
+	ErrInvalidRateLimitRate = errors.New("invalid rate limit, require non-negative number")
+)
+
+// rateLimitSweepInterval is the interval to remove the buckets which are full
+const rateLimitSweepInterval = time.Minute
+
+type RateLimitConfig struct {
+	Key                    string  `mapstructure:"key"`
+	Value                  string  `mapstructure:"value"`
+	WritePointsPerSecond   float64 `mapstructure:"write_points_per_second"`
+	WriteBytesPerSecond    float64 `mapstructure:"write_bytes_per_second"`
+	QueryRequestsPerSecond float64 `mapstructure:"query_requests_per_second"`
+}
+
+// RateLimitError is the error of the request over the limit, which could be retried after RetryAfter
+type RateLimitError struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: %s, retry after %ds", ErrRateLimited, e.Limit, e.RetryAfterSeconds())
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// RetryAfterSeconds returns the seconds of the Retry-After header, which is at least 1
+func (e *RateLimitError) RetryAfterSeconds() int {
+	sec := int(math.Ceil(e.RetryAfter.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	return sec
+}
+
+// tokenBucket allows the request if the tokens are enough for its cost, and the request whose cost exceeds
+// the capacity is allowed once the bucket is full and leaves the bucket in debt, so that a large batch is not
+// rejected forever
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens = math.Min(tb.rate, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// wait returns the duration until the tokens are enough for the cost, or zero if they are enough now
+func (tb *tokenBucket) wait(cost float64) time.Duration {
+	need := math.Min(cost, tb.rate)
+	if tb.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+type RateLimitStats struct {
+	RejectedWrites  int64            `json:"rejected_writes"`
+	RejectedQueries int64            `json:"rejected_queries"`
+	Rejected        map[string]int64 `json:"rejected"`
+}
+
+// RateLimiter limits the points and bytes per second of writes and the requests per second of queries,
+// which are keyed by user, client ip or database. The limit with the same key and value overrides
+// the default limit of the key with empty value, and zero rate means unlimited.
+type RateLimiter struct {
+	lock      sync.Mutex
+	limits    map[string]map[string]*RateLimitConfig
+	buckets   map[string]*tokenBucket
+	stats     RateLimitStats
+	lastSweep time.Time
+}
+
+func NewRateLimiter(cfgs []*RateLimitConfig) (rl *RateLimiter, err error) {
+	rl = &RateLimiter{
+		limits:    make(map[string]map[string]*RateLimitConfig),
+		buckets:   make(map[string]*tokenBucket),
+		stats:     RateLimitStats{Rejected: make(map[string]int64)},
+		lastSweep: time.Now(),
+	}
+	for _, cfg := range cfgs {
+		if cfg.Key != "user" && cfg.Key != "ip" && cfg.Key != "db" {
+			return nil, ErrInvalidRateLimitKey
+		}
+		if cfg.WritePointsPerSecond < 0 || cfg.WriteBytesPerSecond < 0 || cfg.QueryRequestsPerSecond < 0 {
+			return nil, ErrInvalidRateLimitRate
+		}
+		if rl.limits[cfg.Key] == nil {
+			rl.limits[cfg.Key] = make(map[string]*RateLimitConfig)
+		}
+		if _, ok := rl.limits[cfg.Key][cfg.Value]; ok {
+			return nil, fmt.Errorf("%w: key %s, value %s", ErrDuplicatedRateLimit, cfg.Key, cfg.Value)
+		}
+		rl.limits[cfg.Key][cfg.Value] = cfg
+	}
+	return
+}
+
+// AllowWrite takes the points and bytes of the write, the nil rate limiter allows all
+func (rl *RateLimiter) AllowWrite(req *http.Request, db string, points, bytes int) error {
+	if rl == nil {
+		return nil
+	}
+	return rl.allow(req, db, true, func(cfg *RateLimitConfig) []rateCost {
+		return []rateCost{
+			{"write_points", cfg.WritePointsPerSecond, float64(points)},
+			{"write_bytes", cfg.WriteBytesPerSecond, float64(bytes)},
+		}
+	})
+}
+
+// AllowQuery takes a request of the query, the nil rate limiter allows all
+func (rl *RateLimiter) AllowQuery(req *http.Request, db string) error {
+	if rl == nil {
+		return nil
+	}
+	return rl.allow(req, db, false, func(cfg *RateLimitConfig) []rateCost {
+		return []rateCost{{"query_requests", cfg.QueryRequestsPerSecond, 1}}
+	})
+}
+
+type rateCost struct {
+	name string
+	rate float64
+	cost float64
+}
+
+func (rl *RateLimiter) allow(req *http.Request, db string, write bool, costs func(*RateLimitConfig) []rateCost) error {
+	values := map[string]string{"user": GetRequestUser(req), "ip": clientIP(req), "db": db}
+	now := time.Now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.sweep(now)
+
+	type take struct {
+		bucket *tokenBucket
+		cost   float64
+	}
+	var takes []take
+	for _, key := range []string{"user", "ip", "db"} {
+		if key == "user" && values[key] == "" {
+			// the unauthenticated requests are limited by the ip only
+			continue
+		}
+		cfg, ok := rl.limits[key][values[key]]
+		if !ok {
+			if cfg, ok = rl.limits[key][""]; !ok {
+				continue
+			}
+		}
+		for _, rc := range costs(cfg) {
+			if rc.rate <= 0 {
+				continue
+			}
+			limit := fmt.Sprintf("%s %s=%s", rc.name, key, values[key])
+			tb, ok := rl.buckets[limit]
+			if !ok || tb.rate != rc.rate {
+				tb = &tokenBucket{rate: rc.rate, tokens: rc.rate, last: now}
+				rl.buckets[limit] = tb
+			}
+			tb.refill(now)
+			if wait := tb.wait(rc.cost); wait > 0 {
+				if write {
+					rl.stats.RejectedWrites++
+				} else {
+					rl.stats.RejectedQueries++
+				}
+				rl.stats.Rejected[limit]++
+				return &RateLimitError{Limit: fmt.Sprintf("%s is limited to %g/s", limit, rc.rate), RetryAfter: wait}
+			}
+			takes = append(takes, take{tb, rc.cost})
+		}
+	}
+	// the costs are taken only if all the buckets allow the request
+	for _, t := range takes {
+		t.bucket.tokens -= t.cost
+	}
+	return nil
+}
+
+// sweep removes the buckets which are full, so that the buckets of the inactive clients are not kept
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for limit, tb := range rl.buckets {
+		tb.refill(now)
+		if tb.tokens >= tb.rate {
+			delete(rl.buckets, limit)
+		}
+	}
+}
+
+func (rl *RateLimiter) GetStats() *RateLimitStats {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	stats := &RateLimitStats{
+		RejectedWrites:  rl.stats.RejectedWrites,
+		RejectedQueries: rl.stats.RejectedQueries,
+		Rejected:        make(map[string]int64, len(rl.stats.Rejected)),
+	}
+	for limit, n := range rl.stats.Rejected {
+		stats.Rejected[limit] = n
+	}
+	return stats
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// CountLines returns the number of the lines of the line protocol, which is taken as the number of points
+func CountLines(p []byte) int {
+	n := 0
+	for pos := 0; pos < len(p); pos++ {
+		var block []byte
+		pos, block = ScanLine(p, pos)
+		start := SkipWhitespace(block, 0)
+		if start < len(block) && block[start] != '#' && block[start] != '\n' {
+			n++
+		}
+	}
+	return n
+}
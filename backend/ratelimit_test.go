@@ -0,0 +1,155 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newRateLimitRequest(user, addr string) *http.Request {
+	req := &http.Request{URL: &url.URL{}, Header: http.Header{}, RemoteAddr: addr}
+	if user != "" {
+		req = req.WithContext(WithUserName(context.Background(), user))
+	}
+	return req
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	tests := []struct {
+		name string
+		cfgs []*RateLimitConfig
+		err  error
+	}{
+		{name: "valid", cfgs: []*RateLimitConfig{{Key: "user", WritePointsPerSecond: 10}, {Key: "user", Value: "admin"}, {Key: "ip", QueryRequestsPerSecond: 1}}},
+		{name: "invalid key", cfgs: []*RateLimitConfig{{Key: "host"}}, err: ErrInvalidRateLimitKey},
+		{name: "negative rate", cfgs: []*RateLimitConfig{{Key: "db", WriteBytesPerSecond: -1}}, err: ErrInvalidRateLimitRate},
+		{name: "duplicated", cfgs: []*RateLimitConfig{{Key: "db", Value: "db1"}, {Key: "db", Value: "db1"}}, err: ErrDuplicatedRateLimit},
+	}
+	for _, tt := range tests {
+		if _, err := NewRateLimiter(tt.cfgs); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRateLimiterWrite(t *testing.T) {
+	rl, err := NewRateLimiter([]*RateLimitConfig{
+		{Key: "user", WritePointsPerSecond: 100},
+		{Key: "user", Value: "admin"},
+		{Key: "db", Value: "db2", WriteBytesPerSecond: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := newRateLimitRequest("alice", "10.0.0.1:5000")
+	admin := newRateLimitRequest("admin", "10.0.0.2:5000")
+
+	// the batch larger than the rate is allowed, and the next one waits until the debt is paid
+	if err = rl.AllowWrite(alice, "db1", 150, 100); err != nil {
+		t.Fatalf("first write: %s", err)
+	}
+	err = rl.AllowWrite(alice, "db1", 1, 10)
+	var rle *RateLimitError
+	if !errors.As(err, &rle) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("second write: error = %v, want rate limit error", err)
+	}
+	if rle.RetryAfter <= 0 || rle.RetryAfter > time.Second || rle.RetryAfterSeconds() != 1 {
+		t.Errorf("retry after = %s, seconds %d", rle.RetryAfter, rle.RetryAfterSeconds())
+	}
+	for i := 0; i < 3; i++ {
+		if err = rl.AllowWrite(admin, "db1", 1000, 100); err != nil {
+			t.Errorf("write of the unlimited user: %s", err)
+		}
+	}
+
+	// the costs are not taken if any limit rejects the request
+	if err = rl.AllowWrite(admin, "db2", 10, 2000); err != nil {
+		t.Fatal(err)
+	}
+	bob := newRateLimitRequest("bob", "10.0.0.3:5000")
+	if err = rl.AllowWrite(bob, "db2", 10, 10); err == nil {
+		t.Error("write of db2 should be rejected")
+	}
+	if tokens := rl.buckets["write_points user=bob"].tokens; tokens != 100 {
+		t.Errorf("tokens of bob = %g, want 100", tokens)
+	}
+
+	// the user claimed by the unauthenticated request is not trusted
+	claimed := &http.Request{URL: &url.URL{RawQuery: "u=admin"}, Header: http.Header{}, RemoteAddr: "10.0.0.4:5000"}
+	if err = rl.AllowWrite(claimed, "db1", 1000, 100); err != nil {
+		t.Errorf("write of the unauthenticated request: %s", err)
+	}
+	if _, ok := rl.buckets["write_points user=admin"]; ok {
+		t.Error("unauthenticated request should not be limited as the claimed user")
+	}
+
+	for _, tb := range rl.buckets {
+		tb.last = tb.last.Add(-2 * time.Second)
+	}
+	if err = rl.AllowWrite(alice, "db1", 1, 10); err != nil {
+		t.Errorf("write after refill: %s", err)
+	}
+
+	stats := rl.GetStats()
+	if stats.RejectedWrites != 2 || stats.RejectedQueries != 0 || stats.Rejected["write_points user=alice"] != 1 || stats.Rejected["write_bytes db=db2"] != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestRateLimiterQuery(t *testing.T) {
+	rl, err := NewRateLimiter([]*RateLimitConfig{{Key: "ip", QueryRequestsPerSecond: 2}, {Key: "ip", Value: "10.0.0.9", QueryRequestsPerSecond: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		allowed int
+	}{
+		{addr: "10.0.0.1:5000", allowed: 2},
+		{addr: "10.0.0.9:5000", allowed: 1},
+	}
+	for _, tt := range tests {
+		req := newRateLimitRequest("", tt.addr)
+		allowed := 0
+		for i := 0; i < 5; i++ {
+			if rl.AllowQuery(req, "db1") == nil {
+				allowed++
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: allowed = %d, want %d", tt.addr, allowed, tt.allowed)
+		}
+	}
+	if stats := rl.GetStats(); stats.RejectedQueries != 7 || stats.Rejected["query_requests ip=10.0.0.9"] != 4 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	var nilLimiter *RateLimiter
+	if err = nilLimiter.AllowQuery(newRateLimitRequest("", "10.0.0.1:5000"), "db1"); err != nil {
+		t.Errorf("nil rate limiter: %s", err)
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	tests := []struct {
+		p    string
+		want int
+	}{
+		{p: "", want: 0},
+		{p: "cpu value=1", want: 1},
+		{p: "cpu value=1\nmem value=2\n", want: 2},
+		{p: "# comment\n\ncpu value=1\n  \nmem,host=a value=\"x\ny\" 1\n", want: 2},
+	}
+	for _, tt := range tests {
+		if got := CountLines([]byte(tt.p)); got != tt.want {
+			t.Errorf("CountLines(%q) = %d, want %d", tt.p, got, tt.want)
+		}
+	}
+}
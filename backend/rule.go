@@ -0,0 +1,111 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+	RuleAdmin = "admin"
+)
+
+var (
+	ErrStatementDenied   = errors.New("statement denied")
+	ErrInvalidRuleAction = errors.New("invalid statement rule action, require allow, deny or admin")
+)
+
+type StatementRuleConfig struct {
+	Statement string `mapstructure:"statement"`
+	Db        string `mapstructure:"db"`
+	User      string `mapstructure:"user"`
+	Action    string `mapstructure:"action"`
+}
+
+type StatementRule struct {
+	*StatementRuleConfig
+	index     int
+	statement string
+}
+
+// Match checks whether the statement type starts with the statement of the rule by words, the db and the user,
+// the empty or "*" statement, the empty db and the empty user of the rule match all
+func (sr *StatementRule) Match(stmt, db, user string) bool {
+	if sr.statement != "" && stmt != sr.statement && !strings.HasPrefix(stmt, sr.statement+" ") {
+		return false
+	}
+	return (sr.Db == "" || sr.Db == db) && (sr.User == "" || sr.User == user)
+}
+
+// Check returns the error if the statement is denied, or requires admin but the user isn't,
+// the nil user is the proxy user or the auth is disabled
+func (sr *StatementRule) Check(stmt, db string, u *User) error {
+	switch sr.Action {
+	case RuleDeny:
+		if db != "" {
+			return fmt.Errorf("%w: %s on database %s is denied by statement rule %d", ErrStatementDenied, stmt, db, sr.index)
+		}
+		return fmt.Errorf("%w: %s is denied by statement rule %d", ErrStatementDenied, stmt, sr.index)
+	case RuleAdmin:
+		if u != nil && !u.Admin {
+			return fmt.Errorf("%w: user %s requires admin privilege for %s by statement rule %d", ErrNotAuthorized, u.Name, stmt, sr.index)
+		}
+	}
+	return nil
+}
+
+// StatementRules is a list of rules to allow, deny or require admin for the statements, the first rule
+// matching the statement type, db and user is applied, and the statements matching no rule are checked as usual
+type StatementRules []*StatementRule
+
+func NewStatementRules(cfgs []*StatementRuleConfig) (srs StatementRules, err error) {
+	for i, cfg := range cfgs {
+		if cfg.Action != RuleAllow && cfg.Action != RuleDeny && cfg.Action != RuleAdmin {
+			return nil, fmt.Errorf("statement rule %d: %w", i, ErrInvalidRuleAction)
+		}
+		sr := &StatementRule{StatementRuleConfig: cfg, index: i, statement: strings.Join(strings.Fields(strings.ToLower(cfg.Statement)), " ")}
+		if sr.statement == "*" {
+			sr.statement = ""
+		}
+		srs = append(srs, sr)
+	}
+	return
+}
+
+func (srs StatementRules) Match(stmt, db, user string) *StatementRule {
+	for _, sr := range srs {
+		if sr.Match(stmt, db, user) {
+			return sr
+		}
+	}
+	return nil
+}
+
+// StatementType returns the type of the statement, such as "select", "select into", "drop database" and "delete from",
+// which is the longest supported statement matched, or the first two words if the statement isn't supported
+func StatementType(tokens []string) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	if strings.ToLower(tokens[0]) == "select" {
+		if CheckSelectIntoFromTokens(tokens) {
+			return "select into"
+		}
+		return "select"
+	}
+	for n := 5; n >= 2; n-- {
+		if n > len(tokens) {
+			continue
+		}
+		if stmt := GetHeadStmtFromTokens(tokens, n); SupportCmds[stmt] {
+			return stmt
+		}
+	}
+	return GetHeadStmtFromTokens(tokens, 2)
+}
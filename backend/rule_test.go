@@ -0,0 +1,147 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStatementType(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{q: "select * from cpu", want: "select"},
+		{q: "SELECT * INTO cpu_1h FROM cpu GROUP BY time(1h)", want: "select into"},
+		{q: "show tag keys from cpu", want: "show tag keys"},
+		{q: "show series exact cardinality on db1", want: "show series exact cardinality"},
+		{q: "DROP DATABASE db1", want: "drop database"},
+		{q: "delete from cpu where time < now()", want: "delete from"},
+		{q: "show shards", want: "show shards"},
+		{q: "show subscriptions", want: "show subscriptions"},
+	}
+	for _, tt := range tests {
+		if got := StatementType(ScanTokens(tt.q, 0)); got != tt.want {
+			t.Errorf("StatementType(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestStatementRules(t *testing.T) {
+	if _, err := NewStatementRules([]*StatementRuleConfig{{Statement: "drop", Action: "reject"}}); !errors.Is(err, ErrInvalidRuleAction) {
+		t.Errorf("error = %v, want %v", err, ErrInvalidRuleAction)
+	}
+	srs, err := NewStatementRules([]*StatementRuleConfig{
+		{Statement: "drop  database", Db: "prod", Action: RuleDeny},
+		{Statement: "delete", User: "etl", Action: RuleAllow},
+		{Statement: "delete", Action: RuleDeny},
+		{Statement: "show shards", Action: RuleAllow},
+		{Statement: "drop", Action: RuleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := &User{Name: "reader"}
+	admin := &User{Name: "root", Admin: true}
+	tests := []struct {
+		stmt  string
+		db    string
+		user  *User
+		index int
+		err   error
+	}{
+		{stmt: "drop database", db: "prod", user: admin, index: 0, err: ErrStatementDenied},
+		{stmt: "drop database", db: "dev", user: admin, index: 4},
+		{stmt: "drop measurement", db: "dev", user: reader, index: 4, err: ErrNotAuthorized},
+		{stmt: "drop measurement", db: "dev", index: 4},
+		{stmt: "delete from", db: "dev", user: &User{Name: "etl"}, index: 1},
+		{stmt: "delete where", db: "dev", user: admin, index: 2, err: ErrStatementDenied},
+		{stmt: "show shards", user: reader, index: 3},
+		{stmt: "show shard groups", user: reader, index: -1},
+		{stmt: "select", db: "dev", user: reader, index: -1},
+	}
+	for _, tt := range tests {
+		name := ""
+		if tt.user != nil {
+			name = tt.user.Name
+		}
+		sr := srs.Match(tt.stmt, tt.db, name)
+		if sr == nil {
+			if tt.index != -1 {
+				t.Errorf("%s: no rule matched, want %d", tt.stmt, tt.index)
+			}
+			continue
+		}
+		if sr.index != tt.index {
+			t.Errorf("%s: rule %d matched, want %d", tt.stmt, sr.index, tt.index)
+			continue
+		}
+		if err := sr.Check(tt.stmt, tt.db, tt.user); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.stmt, err, tt.err)
+		}
+	}
+}
+
+func TestQueryStatementRules(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queries = append(queries, req.FormValue("q"))
+		io.WriteString(w, `{"results":[{"statement_id":0,"series":[{"name":"db1","columns":["id","database"],"values":[[1,"db1"]]}]}]}`)
+	}))
+	defer server.Close()
+	rules, _ := NewStatementRules([]*StatementRuleConfig{
+		{Statement: "drop database", Action: RuleDeny},
+		{Statement: "show shards", Action: RuleAllow},
+		{Statement: "create subscription", Action: RuleAdmin},
+	})
+	ip := &Proxy{
+		Circles: []*Circle{{Backends: []*Backend{{HttpBackend: newTestHttpBackend("b1", server.URL)}}}},
+		limiter: NewQueryLimiter(&ProxyConfig{}),
+		rules:   rules,
+	}
+	queryAs := func(u *User, q string) ([]byte, error) {
+		req := httptest.NewRequest("GET", "/query?"+url.Values{"q": []string{q}}.Encode(), nil)
+		if u != nil {
+			req = req.WithContext(WithUser(req.Context(), u))
+		}
+		req.ParseForm()
+		return ip.Query(httptest.NewRecorder(), req)
+	}
+	query := func(q string) ([]byte, error) {
+		return queryAs(nil, q)
+	}
+
+	if _, err := query("drop database db1"); !errors.Is(err, ErrStatementDenied) || !strings.Contains(err.Error(), "drop database on database db1") {
+		t.Errorf("drop database: error = %v", err)
+	}
+	if _, err := query("show subscriptions"); !errors.Is(err, ErrIllegalQL) || !strings.Contains(err.Error(), "show subscriptions is not supported") {
+		t.Errorf("show subscriptions: error = %v", err)
+	}
+	body, err := query("show shards")
+	if err != nil {
+		t.Fatalf("show shards: %s", err)
+	}
+	if !strings.Contains(string(body), `"backend":"b1"`) || len(queries) != 1 || queries[0] != "show shards" {
+		t.Errorf("show shards: body %s, queries %v", body, queries)
+	}
+
+	// the statement not supported is passed through to admins by the admin rule
+	subscription := `create subscription "sub0" on "db1"."autogen" destinations all 'udp://h1:9090'`
+	if _, err = queryAs(&User{Name: "reader"}, subscription); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("create subscription by reader: error = %v", err)
+	}
+	if _, err = queryAs(&User{Name: "admin", Admin: true}, subscription); err != nil {
+		t.Errorf("create subscription by admin: error = %v", err)
+	}
+	if len(queries) != 2 || queries[1] != subscription {
+		t.Errorf("create subscription: queries %v", queries)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+var (
+	ErrBackendNotFound = errors.New("backend not found")
+	ErrBackendInactive = errors.New("backend inactive")
+)
+
+type RetentionPolicy struct {
+	Name               string `json:"name"`
+	Duration           string `json:"duration"`
+	ShardGroupDuration string `json:"shard_group_duration"`
+	ReplicaN           int    `json:"replica_n"`
+	Default            bool   `json:"default"`
+}
+
+type DatabaseSchema struct {
+	RetentionPolicies map[string]*RetentionPolicy `json:"retention_policies"`
+	ContinuousQueries map[string]string           `json:"continuous_queries"`
+}
+
+// Schema is the databases, retention policies, continuous queries and users (with admin flag) of a backend
+type Schema struct {
+	Databases map[string]*DatabaseSchema `json:"databases"`
+	Users     map[string]bool            `json:"users"`
+}
+
+// SchemaDiff is the difference of a backend from the reference backend
+type SchemaDiff struct {
+	Backend      string   `json:"backend"`
+	Url          string   `json:"url"` // nolint:golint
+	Missing      []string `json:"missing,omitempty"`
+	Extra        []string `json:"extra,omitempty"`
+	Different    []string `json:"different,omitempty"`
+	Repaired     []string `json:"repaired,omitempty"`
+	Unrepairable []string `json:"unrepairable,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+type SchemaReport struct {
+	Reference  string        `json:"reference"`
+	Consistent bool          `json:"consistent"`
+	Backends   []*SchemaDiff `json:"backends"`
+}
+
+func (hb *HttpBackend) querySeries(db, q string) (models.Rows, error) {
+	qr := hb.Query(NewQueryRequest("GET", db, q, ""), nil, true)
+	if qr.Err != nil {
+		return nil, qr.Err
+	}
+	return SeriesFromResponseBytes(qr.Body)
+}
+
+// GetRetentionPolicyDetails returns the retention policies of the database with duration, shard duration,
+// replication and default flag
+func (hb *HttpBackend) GetRetentionPolicyDetails(db string) ([]*RetentionPolicy, error) {
+	series, err := hb.querySeries(db, fmt.Sprintf("show retention policies on \"%s\"", util.EscapeIdentifier(db)))
+	if err != nil {
+		return nil, err
+	}
+	var rps []*RetentionPolicy
+	for _, s := range series {
+		for _, v := range s.Values {
+			rp := &RetentionPolicy{}
+			for i, c := range s.Columns {
+				if i >= len(v) {
+					break
+				}
+				switch c {
+				case "name":
+					rp.Name = util.CastString(v[i])
+				case "duration":
+					rp.Duration = util.CastString(v[i])
+				case "shardGroupDuration":
+					rp.ShardGroupDuration = util.CastString(v[i])
+				case "replicaN":
+					rp.ReplicaN, _ = strconv.Atoi(util.CastString(v[i]))
+				case "default":
+					rp.Default, _ = v[i].(bool)
+				}
+			}
+			rps = append(rps, rp)
+		}
+	}
+	return rps, nil
+}
+
+func (hb *HttpBackend) GetSchema() (*Schema, error) {
+	schema := &Schema{Databases: make(map[string]*DatabaseSchema), Users: make(map[string]bool)}
+	series, err := hb.querySeries("", "show databases")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		for _, v := range s.Values {
+			db := util.CastString(v[0])
+			if db == "_internal" {
+				continue
+			}
+			rps, err := hb.GetRetentionPolicyDetails(db)
+			if err != nil {
+				return nil, err
+			}
+			ds := &DatabaseSchema{RetentionPolicies: make(map[string]*RetentionPolicy), ContinuousQueries: make(map[string]string)}
+			for _, rp := range rps {
+				ds.RetentionPolicies[rp.Name] = rp
+			}
+			schema.Databases[db] = ds
+		}
+	}
+	series, err = hb.querySeries("", "show continuous queries")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		if ds, ok := schema.Databases[s.Name]; ok {
+			for _, v := range s.Values {
+				if len(v) >= 2 {
+					ds.ContinuousQueries[util.CastString(v[0])] = util.CastString(v[1])
+				}
+			}
+		}
+	}
+	series, err = hb.querySeries("", "show users")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		for _, v := range s.Values {
+			if len(v) >= 2 {
+				admin, _ := v[1].(bool)
+				schema.Users[util.CastString(v[0])] = admin
+			}
+		}
+	}
+	return schema, nil
+}
+
+// RetentionPolicyStatement returns the statement to create or alter the retention policy
+func RetentionPolicyStatement(action, db string, rp *RetentionPolicy) string {
+	replicaN := rp.ReplicaN
+	if replicaN <= 0 {
+		replicaN = 1
+	}
+	q := fmt.Sprintf("%s retention policy \"%s\" on \"%s\" duration %s replication %d", action, util.EscapeIdentifier(rp.Name), util.EscapeIdentifier(db), rp.Duration, replicaN)
+	if rp.ShardGroupDuration != "" {
+		q += " shard duration " + rp.ShardGroupDuration
+	}
+	if rp.Default {
+		q += " default"
+	}
+	return q
+}
+
+type schemaStatement struct {
+	db string
+	q  string
+}
+
+// diffSchema compares the schema with the reference schema, and returns the diff and the statements to repair
+func diffSchema(ref, schema *Schema, diff *SchemaDiff) (stmts []*schemaStatement) {
+	for _, db := range sortedDatabaseNames(ref.Databases) {
+		rds := ref.Databases[db]
+		ds, ok := schema.Databases[db]
+		if !ok {
+			diff.Missing = append(diff.Missing, fmt.Sprintf("database %q", db))
+			stmts = append(stmts, &schemaStatement{"", fmt.Sprintf("create database \"%s\"", util.EscapeIdentifier(db))})
+			ds = &DatabaseSchema{}
+		}
+		for _, name := range sortedPolicyNames(rds.RetentionPolicies) {
+			rrp := rds.RetentionPolicies[name]
+			rp, ok := ds.RetentionPolicies[name]
+			if !ok {
+				diff.Missing = append(diff.Missing, fmt.Sprintf("retention policy %q.%q", db, name))
+				// the database created by repair has the default retention policy autogen
+				action := "create"
+				if ds.RetentionPolicies == nil && name == "autogen" {
+					action = "alter"
+				}
+				stmts = append(stmts, &schemaStatement{db, RetentionPolicyStatement(action, db, rrp)})
+			} else if *rp != *rrp {
+				diff.Different = append(diff.Different, fmt.Sprintf("retention policy %q.%q: %+v != %+v", db, name, *rp, *rrp))
+				stmts = append(stmts, &schemaStatement{db, RetentionPolicyStatement("alter", db, rrp)})
+			}
+		}
+		for _, name := range sortedPolicyNames(ds.RetentionPolicies) {
+			if _, ok := rds.RetentionPolicies[name]; !ok {
+				diff.Extra = append(diff.Extra, fmt.Sprintf("retention policy %q.%q", db, name))
+			}
+		}
+		// the native continuous queries only see the partial data of each backend, so they're reported but not
+		// repaired, and the continuous queries over all backends should be managed by the proxy instead
+		for _, name := range sortedQueryNames(rds.ContinuousQueries) {
+			rcq := rds.ContinuousQueries[name]
+			cq, ok := ds.ContinuousQueries[name]
+			if !ok {
+				diff.Missing = append(diff.Missing, fmt.Sprintf("continuous query %q.%q", db, name))
+				diff.Unrepairable = append(diff.Unrepairable, fmt.Sprintf("continuous query %q.%q: native continuous query isn't copied, manage it by the proxy", db, name))
+			} else if cq != rcq {
+				diff.Different = append(diff.Different, fmt.Sprintf("continuous query %q.%q: %s != %s", db, name, cq, rcq))
+				diff.Unrepairable = append(diff.Unrepairable, fmt.Sprintf("continuous query %q.%q: native continuous query isn't copied, manage it by the proxy", db, name))
+			}
+		}
+		for _, name := range sortedQueryNames(ds.ContinuousQueries) {
+			if _, ok := rds.ContinuousQueries[name]; !ok {
+				diff.Extra = append(diff.Extra, fmt.Sprintf("continuous query %q.%q", db, name))
+			}
+		}
+	}
+	for _, db := range sortedDatabaseNames(schema.Databases) {
+		if _, ok := ref.Databases[db]; !ok {
+			diff.Extra = append(diff.Extra, fmt.Sprintf("database %q", db))
+		}
+	}
+	for _, user := range sortedUserNames(ref.Users) {
+		admin, ok := schema.Users[user]
+		if !ok {
+			diff.Missing = append(diff.Missing, fmt.Sprintf("user %q", user))
+			diff.Unrepairable = append(diff.Unrepairable, fmt.Sprintf("user %q: password can't be copied from the reference backend", user))
+		} else if admin != ref.Users[user] {
+			diff.Different = append(diff.Different, fmt.Sprintf("user %q: admin %t != %t", user, admin, ref.Users[user]))
+			if ref.Users[user] {
+				stmts = append(stmts, &schemaStatement{"", fmt.Sprintf("grant all privileges to \"%s\"", util.EscapeIdentifier(user))})
+			} else {
+				stmts = append(stmts, &schemaStatement{"", fmt.Sprintf("revoke all privileges from \"%s\"", util.EscapeIdentifier(user))})
+			}
+		}
+	}
+	for _, user := range sortedUserNames(schema.Users) {
+		if _, ok := ref.Users[user]; !ok {
+			diff.Extra = append(diff.Extra, fmt.Sprintf("user %q", user))
+		}
+	}
+	return
+}
+
+// CheckSchema compares the schema of all backends with the reference backend, the first active backend by default.
+// If repair is true, the missing and different items are created or altered as the reference backend,
+// while the extra items are kept, and the native continuous queries and the passwords of users are only reported.
+func (ip *Proxy) CheckSchema(reference string, repair bool) (*SchemaReport, error) {
+	backends := ip.GetAllBackends()
+	var ref *Backend
+	for _, be := range backends {
+		if (reference == "" && be.IsActive()) || be.Name == reference {
+			ref = be
+			break
+		}
+	}
+	if ref == nil {
+		return nil, ErrBackendNotFound
+	}
+	if !ref.IsActive() {
+		return nil, ErrBackendInactive
+	}
+
+	var wg sync.WaitGroup
+	schemas := make([]*Schema, len(backends))
+	errs := make([]error, len(backends))
+	for i, be := range backends {
+		if !be.IsActive() {
+			errs[i] = ErrBackendInactive
+			continue
+		}
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			schemas[i], errs[i] = be.GetSchema()
+		}(i, be)
+	}
+	wg.Wait()
+
+	var refSchema *Schema
+	for i, be := range backends {
+		if be == ref {
+			if errs[i] != nil {
+				return nil, fmt.Errorf("get schema of reference backend %s error: %s", ref.Name, errs[i])
+			}
+			refSchema = schemas[i]
+		}
+	}
+	report := &SchemaReport{Reference: ref.Name, Consistent: true}
+	for i, be := range backends {
+		if be == ref {
+			continue
+		}
+		diff := &SchemaDiff{Backend: be.Name, Url: be.Url}
+		report.Backends = append(report.Backends, diff)
+		if errs[i] != nil {
+			diff.Errors = append(diff.Errors, errs[i].Error())
+			report.Consistent = false
+			continue
+		}
+		stmts := diffSchema(refSchema, schemas[i], diff)
+		if len(diff.Missing) > 0 || len(diff.Extra) > 0 || len(diff.Different) > 0 {
+			report.Consistent = false
+		}
+		if !repair {
+			continue
+		}
+		for _, stmt := range stmts {
+			_, err := be.QueryIQL("POST", stmt.db, stmt.q, "")
+			if err != nil {
+				diff.Errors = append(diff.Errors, fmt.Sprintf("%s: %s", stmt.q, err))
+				continue
+			}
+			diff.Repaired = append(diff.Repaired, stmt.q)
+		}
+	}
+	return report, nil
+}
+
+func sortedDatabaseNames(m map[string]*DatabaseSchema) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPolicyNames(m map[string]*RetentionPolicy) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedQueryNames(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedUserNames(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRetentionPolicyStatement(t *testing.T) {
+	rp := &RetentionPolicy{Name: "one_week", Duration: "168h0m0s", ShardGroupDuration: "24h0m0s", ReplicaN: 1, Default: true}
+	want := `create retention policy "one_week" on "db1" duration 168h0m0s replication 1 shard duration 24h0m0s default`
+	if got := RetentionPolicyStatement("create", "db1", rp); got != want {
+		t.Errorf("statement = %s, want %s", got, want)
+	}
+}
+
+func TestDiffSchema(t *testing.T) {
+	autogen := &RetentionPolicy{Name: "autogen", Duration: "0s", ShardGroupDuration: "168h0m0s", ReplicaN: 1, Default: true}
+	week := &RetentionPolicy{Name: "week", Duration: "168h0m0s", ShardGroupDuration: "24h0m0s", ReplicaN: 1}
+	cq := `CREATE CONTINUOUS QUERY cq1 ON db1 BEGIN SELECT mean(v) INTO week.cpu FROM cpu GROUP BY time(1h) END`
+	ref := &Schema{
+		Databases: map[string]*DatabaseSchema{
+			"db1": {RetentionPolicies: map[string]*RetentionPolicy{"autogen": autogen, "week": week}, ContinuousQueries: map[string]string{"cq1": cq}},
+			"db2": {RetentionPolicies: map[string]*RetentionPolicy{"autogen": autogen}, ContinuousQueries: map[string]string{}},
+		},
+		Users: map[string]bool{"admin": true, "reader": false},
+	}
+	shortWeek := *week
+	shortWeek.Duration = "0s"
+	schema := &Schema{
+		Databases: map[string]*DatabaseSchema{
+			"db1": {RetentionPolicies: map[string]*RetentionPolicy{"autogen": autogen, "week": &shortWeek}, ContinuousQueries: map[string]string{}},
+			"db3": {RetentionPolicies: map[string]*RetentionPolicy{}, ContinuousQueries: map[string]string{}},
+		},
+		Users: map[string]bool{"admin": false},
+	}
+	diff := &SchemaDiff{}
+	stmts := diffSchema(ref, schema, diff)
+	var got []string
+	for _, stmt := range stmts {
+		got = append(got, stmt.db+": "+stmt.q)
+	}
+	want := []string{
+		`db1: alter retention policy "week" on "db1" duration 168h0m0s replication 1 shard duration 24h0m0s`,
+		`: create database "db2"`,
+		`db2: alter retention policy "autogen" on "db2" duration 0s replication 1 shard duration 168h0m0s default`,
+		`: grant all privileges to "admin"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statements = %q, want %q", got, want)
+	}
+	if len(diff.Missing) != 4 || len(diff.Extra) != 1 || len(diff.Different) != 2 || len(diff.Unrepairable) != 2 {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+	if stmts = diffSchema(ref, ref, &SchemaDiff{}); len(stmts) != 0 {
+		t.Errorf("same schema should have no statement: %v", stmts)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	DefaultChunkSize  = 10000
+	streamChannelSize = 64
+)
+
+// showMerger dedupes the rows of merged show queries and collects them into chunks
+type showMerger struct {
+	seen  map[string]bool
+	rows  models.Rows
+	index map[string]*models.Row
+	count int
+}
+
+func newShowMerger() *showMerger {
+	return &showMerger{seen: make(map[string]bool), index: make(map[string]*models.Row)}
+}
+
+// Add adds the values of the row which are not seen before, and returns the number of values in the current chunk
+func (sm *showMerger) Add(row *models.Row) int {
+	skey := serieKey(row)
+	for _, value := range row.Values {
+		vals := make([]string, len(value))
+		for i, v := range value {
+			vals[i] = util.CastString(v)
+		}
+		vkey := skey + "\x00" + strings.Join(vals, "\x00")
+		if sm.seen[vkey] {
+			continue
+		}
+		sm.seen[vkey] = true
+		r, ok := sm.index[skey]
+		if !ok {
+			r = &models.Row{Name: row.Name, Tags: row.Tags, Columns: row.Columns}
+			sm.index[skey] = r
+			sm.rows = append(sm.rows, r)
+		}
+		r.Values = append(r.Values, value)
+		sm.count++
+	}
+	return sm.count
+}
+
+// Flush returns the rows of the current chunk and starts a new chunk
+func (sm *showMerger) Flush() models.Rows {
+	rows := sm.rows
+	sm.rows, sm.index, sm.count = nil, make(map[string]*models.Row), 0
+	return rows
+}
+
+// streamShowQL streams the merged show query chunk by chunk. the rows of all backends are passed through
+// a bounded channel, so a slow client blocks the reading of backends, and only the seen values are kept in memory.
+func streamShowQL(w http.ResponseWriter, req *http.Request, backends []*Backend, enc ResponseEncoder) error {
+	chunkSize := DefaultChunkSize
+	if n, err := strconv.Atoi(req.FormValue("chunk_size")); err == nil && n > 0 {
+		chunkSize = n
+	}
+	gzipped := strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
+	req.Header.Del("Accept-Encoding")
+	req.Header.Set(HeaderQueryOrigin, QueryParallel)
+
+	// open all backends before writing anything, so that an error can still be replied
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	var wg sync.WaitGroup
+	resps := make([]*http.Response, len(backends))
+	errs := make([]error, len(backends))
+	for i, be := range backends {
+		if !be.IsActive() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			resps[i], errs[i] = be.QueryStream(CloneQueryRequest(req).WithContext(ctx))
+		}(i, be)
+	}
+	wg.Wait()
+	var bodies []io.ReadCloser
+	var err error
+	for i := range backends {
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+		if resps[i] != nil {
+			bodies = append(bodies, resps[i].Body)
+		}
+	}
+	defer func() {
+		for _, body := range bodies {
+			body.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if len(bodies) == 0 {
+		return ErrBackendsUnavailable
+	}
+	if len(bodies) < len(backends) {
+		log.Printf("query: %s, inactive: %d/%d backends unavailable", req.FormValue("q"), len(backends)-len(bodies), len(backends))
+	}
+
+	var lock sync.Mutex
+	var streamErr string
+	ch := make(chan *models.Row, streamChannelSize)
+	for _, body := range bodies {
+		wg.Add(1)
+		go func(body io.Reader) {
+			defer wg.Done()
+			if err := decodeChunks(ctx, body, ch); err != nil {
+				lock.Lock()
+				if streamErr == "" {
+					streamErr = err.Error()
+				}
+				lock.Unlock()
+			}
+		}(body)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var out io.Writer = w
+	var zw *gzip.Writer
+	w.Header().Set("Content-Type", enc.ContentType())
+	w.Header().Del("Content-Length")
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw = gzip.NewWriter(w)
+		defer zw.Close()
+		out = zw
+	} else {
+		w.Header().Del("Content-Encoding")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	write := func(rows models.Rows, partial bool, err string) error {
+		rsp := ResponseFromResults([]*Result{{Series: rows, Partial: partial, Err: err}})
+		if _, err := out.Write(enc.Encode(rsp)); err != nil {
+			return err
+		}
+		if zw != nil {
+			if err := zw.Flush(); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	sm := newShowMerger()
+	for row := range ch {
+		if sm.Add(row) >= chunkSize {
+			if err := write(sm.Flush(), true, ""); err != nil {
+				log.Printf("stream response error: %s", err)
+				cancel()
+				for range ch {
+				}
+				return nil
+			}
+		}
+	}
+	if err := write(sm.Flush(), false, streamErr); err != nil {
+		log.Printf("stream response error: %s", err)
+	}
+	return nil
+}
+
+// decodeChunks decodes the chunked responses of a backend and sends the rows to the channel
+func decodeChunks(ctx context.Context, r io.Reader, ch chan<- *models.Row) error {
+	dec := jsoniter.ConfigCompatibleWithStandardLibrary.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		rsp := &Response{}
+		err := dec.Decode(rsp)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rsp.Err != "" {
+			return errors.New(rsp.Err)
+		}
+		for _, result := range rsp.Results {
+			if result.Err != "" {
+				return errors.New(result.Err)
+			}
+			for _, row := range result.Series {
+				select {
+				case ch <- row:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestShowMerger(t *testing.T) {
+	sm := newShowMerger()
+	row := func(name string, values ...string) *models.Row {
+		r := &models.Row{Name: name, Columns: []string{"tagKey"}}
+		for _, v := range values {
+			r.Values = append(r.Values, []interface{}{v})
+		}
+		return r
+	}
+	if n := sm.Add(row("cpu", "host", "region")); n != 2 {
+		t.Errorf("count = %d, want 2", n)
+	}
+	if n := sm.Add(row("cpu", "host", "zone")); n != 3 {
+		t.Errorf("count = %d, want 3", n)
+	}
+	if n := sm.Add(row("mem", "host")); n != 4 {
+		t.Errorf("count = %d, want 4", n)
+	}
+	rows := sm.Flush()
+	if len(rows) != 2 || len(rows[0].Values) != 3 || len(rows[1].Values) != 1 {
+		t.Errorf("unexpected rows: %+v", rows)
+	}
+	if n := sm.Add(row("cpu", "host", "os")); n != 1 {
+		t.Errorf("seen values should be skipped after flush, count = %d", n)
+	}
+}
+
+func TestStreamShowQL(t *testing.T) {
+	newServer := func(chunks ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.FormValue("chunked") != "true" {
+				t.Error("chunked should be passed to backends")
+			}
+			for _, chunk := range chunks {
+				io.WriteString(w, chunk+"\n")
+			}
+		}))
+	}
+	s1 := newServer(
+		`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"]]}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["mem"]]}]}]}`,
+	)
+	defer s1.Close()
+	s2 := newServer(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["net"]]}]}]}`)
+	defer s2.Close()
+	backends := []*Backend{
+		{HttpBackend: newTestHttpBackend("b1", s1.URL)},
+		{HttpBackend: newTestHttpBackend("b2", s2.URL)},
+	}
+
+	req := httptest.NewRequest("GET", "/query?q=show+measurements&db=db1&chunked=true&chunk_size=2", nil)
+	req.ParseForm()
+	w := httptest.NewRecorder()
+	if err := streamShowQL(w, req, backends, NewResponseEncoder(req)); err != nil {
+		t.Fatalf("stream show error: %s", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+	values, chunks, partial := 0, 0, true
+	for dec.More() {
+		rsp := &Response{}
+		if err := dec.Decode(rsp); err != nil {
+			t.Fatalf("decode chunk error: %s", err)
+		}
+		chunks++
+		partial = rsp.Results[0].Partial
+		for _, row := range rsp.Results[0].Series {
+			values += len(row.Values)
+		}
+	}
+	if values != 4 || chunks < 2 || partial {
+		t.Errorf("values = %d, chunks = %d, last partial = %t, want 4 distinct values in multiple chunks", values, chunks, partial)
+	}
+}
+
+func TestQueryStreamError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{name: "influxdb error", status: http.StatusBadRequest, body: `{"error":"database not found: db1"}`, want: "database not found: db1"},
+		{name: "html error", status: http.StatusBadGateway, body: "<html>502 Bad Gateway</html>\n", want: "502: <html>502 Bad Gateway</html>"},
+		{name: "json without error", status: http.StatusServiceUnavailable, body: `{"results":[]}`, want: `503: {"results":[]}`},
+		{name: "empty body", status: http.StatusInternalServerError, want: "500: "},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(tt.status)
+			io.WriteString(w, tt.body)
+		}))
+		req := httptest.NewRequest("GET", "/query?q=select+*+from+cpu&db=db1&chunked=true", nil)
+		req.ParseForm()
+		resp, err := newTestHttpBackend("b1", ts.URL).QueryStream(req)
+		if resp != nil || err == nil || err.Error() != tt.want {
+			t.Errorf("%s: error = %v, want %s", tt.name, err, tt.want)
+		}
+		ts.Close()
+	}
+}
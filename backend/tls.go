@@ -0,0 +1,228 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTLSCertKeyPair    = errors.New("tls certificate and key must be set together")
+	ErrNoPeerCertificate = errors.New("no peer certificate")
+)
+
+// certReloadInterval is the minimum interval to check whether the files are changed
+const certReloadInterval = time.Second
+
+// CertFiles is the ca bundle and the certificate key pair loaded from files,
+// which are reloaded when the files are changed on disk
+type CertFiles struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	pool    *x509.CertPool
+	cert    *tls.Certificate
+	modTime map[string]time.Time
+	checked time.Time
+}
+
+func NewCertFiles(caFile, certFile, keyFile string) (cf *CertFiles, err error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, ErrTLSCertKeyPair
+	}
+	cf = &CertFiles{caFile: caFile, certFile: certFile, keyFile: keyFile, checked: time.Now()}
+	if err = cf.load(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (cf *CertFiles) load() error {
+	modTime := cf.stat()
+	var pool *x509.CertPool
+	if cf.caFile != "" {
+		b, err := ioutil.ReadFile(cf.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificate found in ca file %s", cf.caFile)
+		}
+	}
+	var cert *tls.Certificate
+	if cf.certFile != "" {
+		c, err := tls.LoadX509KeyPair(cf.certFile, cf.keyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate %s and key %s error: %s", cf.certFile, cf.keyFile, err)
+		}
+		cert = &c
+	}
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	cf.pool, cf.cert, cf.modTime = pool, cert, modTime
+	return nil
+}
+
+func (cf *CertFiles) stat() map[string]time.Time {
+	modTime := make(map[string]time.Time)
+	for _, file := range []string{cf.caFile, cf.certFile, cf.keyFile} {
+		if file == "" {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil {
+			modTime[file] = fi.ModTime()
+		}
+	}
+	return modTime
+}
+
+// reload checks the modification time of the files at most once per certReloadInterval,
+// the previous ones are kept if the changed files are invalid
+func (cf *CertFiles) reload() {
+	now := time.Now()
+	cf.lock.Lock()
+	if now.Sub(cf.checked) < certReloadInterval {
+		cf.lock.Unlock()
+		return
+	}
+	cf.checked = now
+	modTime := cf.stat()
+	changed := len(modTime) != len(cf.modTime)
+	for file, t := range modTime {
+		if !t.Equal(cf.modTime[file]) {
+			changed = true
+		}
+	}
+	if changed {
+		// the invalid files are not retried until they are changed again
+		cf.modTime = modTime
+	}
+	cf.lock.Unlock()
+	if !changed {
+		return
+	}
+	if err := cf.load(); err != nil {
+		log.Printf("reload tls files error: %s", err)
+		return
+	}
+	log.Printf("tls files reloaded, ca: %s, cert: %s, key: %s", cf.caFile, cf.certFile, cf.keyFile)
+}
+
+func (cf *CertFiles) Certificate() *tls.Certificate {
+	cf.reload()
+	cf.lock.RLock()
+	defer cf.lock.RUnlock()
+	return cf.cert
+}
+
+func (cf *CertFiles) CertPool() *x509.CertPool {
+	cf.reload()
+	cf.lock.RLock()
+	defer cf.lock.RUnlock()
+	return cf.pool
+}
+
+// NewBackendTLSConfig returns the tls config to connect the https backend, the server certificate is verified
+// by the ca bundle or the system roots unless tls_insecure_skip_verify is enabled
+func NewBackendTLSConfig(cfg *BackendConfig) (*tls.Config, error) {
+	tc := &tls.Config{ServerName: cfg.TLSServerName, InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+	if cfg.TLSCA == "" && cfg.TLSCert == "" && cfg.TLSKey == "" {
+		return tc, nil
+	}
+	cf, err := NewCertFiles(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	if cf.certFile != "" {
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cf.Certificate(), nil
+		}
+	}
+	if cf.caFile != "" && !cfg.TLSInsecureSkipVerify {
+		// the default verification is replaced since the ca bundle may be reloaded
+		tc.InsecureSkipVerify = true
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPeer(cs.PeerCertificates, cf.CertPool(), cs.ServerName)
+		}
+	}
+	return tc, nil
+}
+
+// NewPeerTLSConfig returns the tls config to connect the https ha peers, the server certificate is verified
+// by https_peer_ca or the system roots, and https_peer_cert is presented to the peers verifying client certificates
+func NewPeerTLSConfig(cfg *ProxyConfig) (*tls.Config, error) {
+	return NewBackendTLSConfig(&BackendConfig{TLSCA: cfg.HTTPSPeerCA, TLSCert: cfg.HTTPSPeerCert, TLSKey: cfg.HTTPSPeerKey})
+}
+
+// NewServerTLSConfig returns the tls config of the https listener, the client certificate is verified
+// by the client ca bundle if https_client_ca is set, and required if https_client_auth_required is enabled
+func NewServerTLSConfig(cfg *ProxyConfig) (*tls.Config, error) {
+	keyFile := cfg.HTTPSKey
+	if keyFile == "" {
+		keyFile = cfg.HTTPSCert
+	}
+	cf, err := NewCertFiles("", cfg.HTTPSCert, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cf.Certificate(), nil
+		},
+	}
+	if cfg.HTTPSClientCA == "" {
+		return tc, nil
+	}
+	ccf, err := NewCertFiles(cfg.HTTPSClientCA, "", "")
+	if err != nil {
+		return nil, err
+	}
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	if cfg.HTTPSClientAuthRequired {
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	tc.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := tc.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = ccf.CertPool()
+		return c, nil
+	}
+	return tc, nil
+}
+
+func verifyPeer(certs []*x509.Certificate, roots *x509.CertPool, dnsName string) error {
+	if len(certs) == 0 {
+		return ErrNoPeerCertificate
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       dnsName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// ClientCertIdentity returns the common name of the verified client certificate, or empty if not verified
+func ClientCertIdentity(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return cs.VerifiedChains[0][0].Subject.CommonName
+}
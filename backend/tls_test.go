@@ -0,0 +1,255 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.DNSNames = []string{cn}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, file string, data []byte, mtime time.Time) string {
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca := newTestCert(t, "ca", nil, 0)
+	server := newTestCert(t, "influxdb", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "proxy", ca, x509.ExtKeyUsageClientAuth)
+	caFile := writeTestFile(t, filepath.Join(dir, "ca.pem"), ca.certPEM, now)
+	certFile := writeTestFile(t, filepath.Join(dir, "client.pem"), client.certPEM, now)
+	keyFile := writeTestFile(t, filepath.Join(dir, "client.key"), client.keyPEM, now)
+
+	pair, _ := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(ClientCertIdentity(req.TLS)))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{pair}, ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		cfg      *BackendConfig
+		want     string
+		hasError bool
+	}{
+		{name: "system roots", cfg: &BackendConfig{}, hasError: true},
+		{name: "insecure", cfg: &BackendConfig{TLSInsecureSkipVerify: true}, want: ""},
+		{name: "ca", cfg: &BackendConfig{TLSCA: caFile}, want: ""},
+		{name: "client cert", cfg: &BackendConfig{TLSCA: caFile, TLSCert: certFile, TLSKey: keyFile}, want: "proxy"},
+		{name: "server name", cfg: &BackendConfig{TLSCA: caFile, TLSServerName: "influxdb"}, want: ""},
+		{name: "wrong server name", cfg: &BackendConfig{TLSCA: caFile, TLSServerName: "other"}, hasError: true},
+	}
+	for _, tt := range tests {
+		tc, err := NewBackendTLSConfig(tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		resp, err := NewClient(tc, 5).Get(ts.URL)
+		if (err != nil) != tt.hasError {
+			t.Errorf("%s: error = %v, hasError %v", tt.name, err, tt.hasError)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.want {
+			t.Errorf("%s: identity = %q, want %q", tt.name, body, tt.want)
+		}
+	}
+
+	if _, err := NewBackendTLSConfig(&BackendConfig{TLSCert: certFile}); err != ErrTLSCertKeyPair {
+		t.Errorf("error = %v, want %v", err, ErrTLSCertKeyPair)
+	}
+	if _, err := NewSimpleHttpBackend(&BackendConfig{Name: "b1", Url: ts.URL, TLSCA: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("simple backend with missing ca: error = nil")
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca := newTestCert(t, "ca", nil, 0)
+	server := newTestCert(t, "proxy", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "alice", ca, x509.ExtKeyUsageClientAuth)
+	other := newTestCert(t, "bob", newTestCert(t, "other ca", nil, 0), x509.ExtKeyUsageClientAuth)
+	cfg := &ProxyConfig{
+		HTTPSCert:               writeTestFile(t, filepath.Join(dir, "server.pem"), append(server.certPEM, server.keyPEM...), now),
+		HTTPSClientCA:           writeTestFile(t, filepath.Join(dir, "ca.pem"), ca.certPEM, now),
+		HTTPSClientAuthRequired: true,
+	}
+	stc, err := NewServerTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(ClientCertIdentity(req.TLS)))
+	}))
+	ts.TLS = stc
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tests := []struct {
+		name     string
+		cert     *testCert
+		want     string
+		hasError bool
+	}{
+		{name: "no client cert", hasError: true},
+		{name: "untrusted client cert", cert: other, hasError: true},
+		{name: "trusted client cert", cert: client, want: "alice"},
+	}
+	for _, tt := range tests {
+		tc := &tls.Config{RootCAs: pool, ServerName: "proxy"}
+		if tt.cert != nil {
+			pair, _ := tls.X509KeyPair(tt.cert.certPEM, tt.cert.keyPEM)
+			tc.Certificates = []tls.Certificate{pair}
+		}
+		resp, err := NewClient(tc, 5).Get(ts.URL)
+		if (err != nil) != tt.hasError {
+			t.Errorf("%s: error = %v, hasError %v", tt.name, err, tt.hasError)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.want {
+			t.Errorf("%s: identity = %q, want %q", tt.name, body, tt.want)
+		}
+	}
+
+	// the ha peers connect each other with the peer ca and the peer client certificate
+	cfg.HTTPSPeerCA = cfg.HTTPSClientCA
+	cfg.HTTPSPeerCert = writeTestFile(t, filepath.Join(dir, "peer.pem"), client.certPEM, now)
+	cfg.HTTPSPeerKey = writeTestFile(t, filepath.Join(dir, "peer.key"), client.keyPEM, now)
+	ptc, err := NewPeerTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewClient(ptc, 5).Get(ts.URL)
+	if err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "alice" {
+		t.Errorf("peer: identity = %q, want %q", body, "alice")
+	}
+}
+
+func TestCertFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca := newTestCert(t, "ca", nil, 0)
+	cert1 := newTestCert(t, "cert-1", ca, x509.ExtKeyUsageServerAuth)
+	cert2 := newTestCert(t, "cert-2", ca, x509.ExtKeyUsageServerAuth)
+	certFile := writeTestFile(t, filepath.Join(dir, "cert.pem"), cert1.certPEM, now)
+	keyFile := writeTestFile(t, filepath.Join(dir, "cert.key"), cert1.keyPEM, now)
+	cf, err := NewCertFiles("", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, want *testCert) {
+		cf.checked = time.Time{}
+		if got := cf.Certificate(); !bytes.Equal(got.Certificate[0], want.cert.Raw) {
+			t.Errorf("%s: certificate not matched", name)
+		}
+	}
+	check("unchanged", cert1)
+
+	// the mismatched pair is not loaded until the key is changed too
+	writeTestFile(t, certFile, cert2.certPEM, now.Add(time.Second))
+	check("cert changed", cert1)
+	writeTestFile(t, keyFile, cert2.keyPEM, now.Add(time.Second))
+	check("key changed", cert2)
+
+	writeTestFile(t, certFile, []byte("invalid"), now.Add(2*time.Second))
+	check("invalid cert", cert2)
+
+	// the files are not checked again within the reload interval
+	writeTestFile(t, certFile, cert1.certPEM, now.Add(3*time.Second))
+	writeTestFile(t, keyFile, cert1.keyPEM, now.Add(3*time.Second))
+	cf.checked = time.Now()
+	if got := cf.Certificate(); !bytes.Equal(got.Certificate[0], cert2.cert.Raw) {
+		t.Error("certificate reloaded within the reload interval")
+	}
+	check("both changed", cert1)
+}
@@ -6,10 +6,12 @@ require (
 	github.com/gogo/protobuf v1.3.2
 	github.com/golang/snappy v0.0.4
 	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c
+	github.com/influxdata/influxql v1.1.0
 	github.com/json-iterator/go v1.1.12
 	github.com/mitchellh/gox v1.0.1 // indirect
 	github.com/panjf2000/ants/v2 v2.4.8
 	github.com/spf13/viper v1.10.1
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	stathat.com/c/consistent v1.0.0
 )
@@ -53,7 +53,12 @@ func main() {
 	cfg.PrintSummary()
 
 	mux := service.NewServeMux()
-	service.NewHttpService(cfg).Register(mux)
+	hs, err := service.NewHttpService(cfg)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	hs.Register(mux)
 
 	server := &http.Server{
 		Addr:        cfg.ListenAddr,
@@ -61,8 +66,13 @@ func main() {
 		IdleTimeout: time.Duration(cfg.IdleTimeout) * time.Second,
 	}
 	if cfg.HTTPSEnabled {
+		server.TLSConfig, err = backend.NewServerTLSConfig(cfg)
+		if err != nil {
+			log.Print(err)
+			return
+		}
 		log.Printf("https service start, listen on %s", server.Addr)
-		err = server.ListenAndServeTLS(cfg.HTTPSCert, cfg.HTTPSKey)
+		err = server.ListenAndServeTLS("", "")
 	} else {
 		log.Printf("http service start, listen on %s", server.Addr)
 		err = server.ListenAndServe()
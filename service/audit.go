@@ -0,0 +1,164 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// auditMaxErrorSize is the maximum size of the error text saved from the response body
+const auditMaxErrorSize = 1024
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status/100 >= 4 && w.body.Len() < auditMaxErrorSize {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// audited records the requests of the handler except GET to the audit log, including the rejected ones
+func (hs *HttpService) audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if hs.auditLog == nil || req.Method == "GET" {
+			handler(w, req)
+			return
+		}
+		aw := &auditResponseWriter{ResponseWriter: w}
+		handler(aw, req)
+		entry := hs.auditEntry(req, action)
+		entry.Status = aw.status
+		switch {
+		case aw.status/100 >= 4:
+			entry.Result = backend.AuditFailed
+			entry.Error = aw.Header().Get("X-Influxdb-Error")
+			if entry.Error == "" {
+				entry.Error = strings.TrimSpace(aw.body.String())
+			}
+		case aw.status == http.StatusAccepted:
+			entry.Result = backend.AuditAccepted
+		default:
+			entry.Result = backend.AuditSuccess
+		}
+		hs.auditLog.Record(entry)
+	}
+}
+
+// auditFinished returns the function to record the finish of the accepted operation running in background,
+// the entry is built before the request is finished
+func (hs *HttpService) auditFinished(req *http.Request, action string) func() {
+	if hs.auditLog == nil {
+		return func() {}
+	}
+	entry := hs.auditEntry(req, action)
+	entry.Result = backend.AuditFinished
+	return func() {
+		entry.Time = time.Now()
+		hs.auditLog.Record(entry)
+	}
+}
+
+// auditQuery records the query which modifies the data, schema, users or queries
+func (hs *HttpService) auditQuery(req *http.Request, q, db string, err error) {
+	if hs.auditLog == nil {
+		return
+	}
+	stmt := backend.AuditStatement(q)
+	if stmt == "" {
+		return
+	}
+	entry := &backend.AuditEntry{
+		User:   hs.auditUser(req),
+		Addr:   req.RemoteAddr,
+		Action: "query",
+		Params: map[string]string{"db": db, "q": backend.MaskPassword(q), "statement": stmt},
+		Result: backend.AuditSuccess,
+	}
+	if err != nil {
+		entry.Result, entry.Status, entry.Error = backend.AuditFailed, hs.queryErrorStatus(err), err.Error()
+	}
+	hs.auditLog.Record(entry)
+}
+
+func (hs *HttpService) auditEntry(req *http.Request, action string) *backend.AuditEntry {
+	if req.Form == nil {
+		req.ParseForm()
+	}
+	params := make(map[string]string)
+	for key, values := range req.Form {
+		if key != "u" && key != "p" && key != "pretty" {
+			params[key] = strings.Join(values, ",")
+		}
+	}
+	return &backend.AuditEntry{User: hs.auditUser(req), Addr: req.RemoteAddr, Action: action, Params: params}
+}
+
+// auditUser returns the name of the authenticated user, or the claimed name if the authentication failed
+func (hs *HttpService) auditUser(req *http.Request) string {
+	if u := backend.UserFromContext(req.Context()); u != nil {
+		return u.Name
+	}
+	if u, err := hs.authenticate(req); err == nil {
+		if u != nil {
+			return u.Name
+		}
+		if hs.username != "" {
+			return hs.username
+		}
+	}
+	return backend.GetRequestUser(req)
+}
+
+func (hs *HttpService) HandlerAudit(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+	if hs.auditLog == nil {
+		hs.WriteError(w, req, http.StatusBadRequest, "audit log disabled")
+		return
+	}
+
+	filter := &backend.AuditFilter{User: req.FormValue("user"), Action: req.FormValue("action"), Limit: 1000}
+	var err error
+	if filter.Start, err = hs.formTime(req, "start"); err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.End, err = hs.formTime(req, "end"); err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	if str := req.FormValue("limit"); str != "" {
+		if filter.Limit, err = strconv.Atoi(str); err != nil || filter.Limit <= 0 {
+			hs.WriteError(w, req, http.StatusBadRequest, ErrInvalidLimit.Error())
+			return
+		}
+	}
+	entries, err := hs.auditLog.Query(filter)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hs.Write(w, req, http.StatusOK, entries)
+}
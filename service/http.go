@@ -7,6 +7,7 @@ package service
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,6 +19,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
 	"github.com/chengshiwen/influx-proxy/service/prometheus"
@@ -34,6 +36,10 @@ var (
 	ErrInvalidBatch   = errors.New("invalid batch, require positive integer")
 	ErrInvalidLimit   = errors.New("invalid limit, require positive integer")
 	ErrInvalidHaAddrs = errors.New("invalid ha_addrs, require at least two addresses as <host:port>, comma-separated")
+
+	ErrInvalidRate         = errors.New("invalid rate, require non-negative number")
+	ErrInvalidMaxLatency   = errors.New("invalid max_latency_ms, require non-negative integer")
+	ErrInvalidMaxErrorRate = errors.New("invalid max_error_rate, require number between 0 and 1")
 )
 
 type ServeMux struct {
@@ -55,24 +61,58 @@ type HttpService struct { // nolint:golint
 	tx           *transfer.Transfer
 	username     string
 	password     string
-	authEncrypt  bool
+	users        *backend.UserStore
+	jwt          *backend.JWTValidator
+	auditLog     *backend.AuditLog
 	writeTracing bool
 	queryTracing bool
 	pprofEnabled bool
 }
 
-func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService) { // nolint:golint
-	ip := backend.NewProxy(cfg)
+func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService, err error) { // nolint:golint
+	ip, err := backend.NewProxy(cfg)
+	if err != nil {
+		return
+	}
+	tx, err := transfer.NewTransfer(cfg, ip.Circles)
+	if err != nil {
+		return nil, fmt.Errorf("tls config of ha peers error: %w", err)
+	}
 	hs = &HttpService{
 		ip:           ip,
-		tx:           transfer.NewTransfer(cfg, ip.Circles),
+		tx:           tx,
 		username:     cfg.Username,
 		password:     cfg.Password,
-		authEncrypt:  cfg.AuthEncrypt,
 		writeTracing: cfg.WriteTracing,
 		queryTracing: cfg.QueryTracing,
 		pprofEnabled: cfg.PprofEnabled,
 	}
+	if cfg.AuthEncrypt {
+		// the encrypted values are decrypted once, as the ciphertexts have random nonces and can't be compared
+		hs.username, hs.password = util.AesDecrypt(cfg.Username), util.AesDecrypt(cfg.Password)
+	}
+	if len(cfg.Users) > 0 || cfg.UsersFile != "" {
+		users, err := backend.NewUserStore(cfg.Users, cfg.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("load users error: %w", err)
+		}
+		hs.users = users
+	}
+	if cfg.JWTEnabled() {
+		jwt, err := backend.NewJWTValidator(cfg.JWTSharedSecret, cfg.JWTJwksFile, cfg.JWTUsernameClaim)
+		if err != nil {
+			return nil, fmt.Errorf("load jwt error: %w", err)
+		}
+		hs.jwt = jwt
+	}
+	if cfg.AuditLogFile != "" {
+		auditLog, err := backend.NewAuditLog(cfg.AuditLogFile)
+		if err != nil {
+			return nil, fmt.Errorf("open audit log error: %w", err)
+		}
+		hs.auditLog = auditLog
+	}
+	hs.tx.Resume()
 	return
 }
 
@@ -84,14 +124,20 @@ func (hs *HttpService) Register(mux *ServeMux) {
 	mux.HandleFunc("/api/v2/write", hs.HandlerWriteV2)
 	mux.HandleFunc("/health", hs.HandlerHealth)
 	mux.HandleFunc("/replica", hs.HandlerReplica)
+	mux.HandleFunc("/cache/stats", hs.HandlerCacheStats)
+	mux.HandleFunc("/ratelimit/stats", hs.HandlerRateLimitStats)
+	mux.HandleFunc("/schema/check", hs.HandlerSchemaCheck)
+	mux.HandleFunc("/schema/repair", hs.audited("schema_repair", hs.HandlerSchemaRepair))
 	mux.HandleFunc("/encrypt", hs.HandlerEncrypt)
 	mux.HandleFunc("/decrypt", hs.HandlerDecrypt)
-	mux.HandleFunc("/rebalance", hs.HandlerRebalance)
-	mux.HandleFunc("/recovery", hs.HandlerRecovery)
-	mux.HandleFunc("/resync", hs.HandlerResync)
-	mux.HandleFunc("/cleanup", hs.HandlerCleanup)
-	mux.HandleFunc("/transfer/state", hs.HandlerTransferState)
+	mux.HandleFunc("/rebalance", hs.audited("rebalance", hs.HandlerRebalance))
+	mux.HandleFunc("/recovery", hs.audited("recovery", hs.HandlerRecovery))
+	mux.HandleFunc("/resync", hs.audited("resync", hs.HandlerResync))
+	mux.HandleFunc("/cleanup", hs.audited("cleanup", hs.HandlerCleanup))
+	mux.HandleFunc("/transfer/state", hs.audited("transfer_state", hs.HandlerTransferState))
 	mux.HandleFunc("/transfer/stats", hs.HandlerTransferStats)
+	mux.HandleFunc("/jobs", hs.audited("jobs", hs.HandlerJobs))
+	mux.HandleFunc("/audit", hs.HandlerAudit)
 	mux.HandleFunc("/api/v1/prom/read", hs.HandlerPromRead)
 	mux.HandleFunc("/api/v1/prom/write", hs.HandlerPromWrite)
 	if hs.pprofEnabled {
@@ -105,26 +151,32 @@ func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 }
 
 func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+	req, ok := hs.checkMethodAndUser(w, req, "GET", "POST")
+	if !ok {
 		return
 	}
 
 	db := req.FormValue("db")
-	q := req.FormValue("q")
+	q := backend.MaskPassword(req.FormValue("q"))
 	body, err := hs.ip.Query(w, req)
+	hs.auditQuery(req, req.FormValue("q"), db, err)
 	if err != nil {
 		log.Printf("influxql query error: %s, query: %s, db: %s, client: %s", err, q, db, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		hs.writeQueryError(w, req, err)
 		return
 	}
-	hs.WriteBody(w, body)
+	// nil body means the response has been streamed
+	if body != nil {
+		hs.WriteBody(w, body)
+	}
 	if hs.queryTracing {
 		log.Printf("influxql query: %s, db: %s, client: %s", q, db, req.RemoteAddr)
 	}
 }
 
 func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndUser(w, req, "POST")
+	if !ok {
 		return
 	}
 
@@ -168,7 +220,7 @@ func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request)
 	err = hs.ip.QueryFlux(w, req, qr)
 	if err != nil {
 		log.Printf("flux query error: %s, query: %s, spec: %s, client: %s", err, qr.Query, qr.Spec, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		hs.writeQueryError(w, req, err)
 		return
 	}
 	if hs.queryTracing {
@@ -177,7 +229,8 @@ func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request)
 }
 
 func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndUser(w, req, "POST")
+	if !ok {
 		return
 	}
 
@@ -198,13 +251,17 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !hs.authorize(w, req, db, backend.WritePrivilege) {
+		return
+	}
 	rp := req.URL.Query().Get("rp")
 
 	hs.handlerWrite(db, rp, precision, w, req)
 }
 
 func (hs *HttpService) HandlerWriteV2(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndUser(w, req, "POST")
+	if !ok {
 		return
 	}
 
@@ -230,6 +287,9 @@ func (hs *HttpService) HandlerWriteV2(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("database forbidden: %s", db))
 		return
 	}
+	if !hs.authorize(w, req, db, backend.WritePrivilege) {
+		return
+	}
 
 	hs.handlerWrite(db, rp, precision, w, req)
 }
@@ -250,6 +310,10 @@ func (hs *HttpService) handlerWrite(db, rp, precision string, w http.ResponseWri
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err = hs.ip.AllowWrite(req, db, backend.CountLines(p), len(p)); err != nil {
+		hs.writeQueryError(w, req, err)
+		return
+	}
 
 	err = hs.ip.Write(p, db, rp, precision)
 	if err == nil {
@@ -300,26 +364,82 @@ func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+func (hs *HttpService) HandlerCacheStats(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	stats := hs.ip.GetCacheStats()
+	if stats == nil {
+		hs.WriteError(w, req, http.StatusBadRequest, "query cache disabled")
+		return
+	}
+	hs.Write(w, req, http.StatusOK, stats)
+}
+
+func (hs *HttpService) HandlerRateLimitStats(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	stats := hs.ip.GetRateLimitStats()
+	if stats == nil {
+		hs.WriteError(w, req, http.StatusBadRequest, "rate limit disabled")
+		return
+	}
+	hs.Write(w, req, http.StatusOK, stats)
+}
+
+func (hs *HttpService) HandlerSchemaCheck(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	report, err := hs.ip.CheckSchema(req.FormValue("backend"), false)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.Write(w, req, http.StatusOK, report)
+}
+
+func (hs *HttpService) HandlerSchemaRepair(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	report, err := hs.ip.CheckSchema(req.FormValue("backend"), true)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("schema repaired with reference backend %s, client: %s", report.Reference, req.RemoteAddr)
+	hs.Write(w, req, http.StatusOK, report)
+}
+
 func (hs *HttpService) HandlerEncrypt(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethod(w, req, "GET") {
+	if !hs.checkMethodAndAdmin(w, req, "GET") {
 		return
 	}
 	text := req.URL.Query().Get("text")
-	encrypt := util.AesEncrypt(text)
+	encrypt, err := util.Encrypt(text)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
 	hs.WriteText(w, http.StatusOK, encrypt)
 }
 
 func (hs *HttpService) HandlerDecrypt(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethod(w, req, "GET") {
+	if !hs.checkMethodAndAdmin(w, req, "GET") {
 		return
 	}
-	key := req.URL.Query().Get("key")
 	text := req.URL.Query().Get("text")
-	if !util.CheckCipherKey(key) {
-		hs.WriteError(w, req, http.StatusBadRequest, "invalid key")
+	decrypt, err := util.Decrypt(text)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-	decrypt := util.AesDecrypt(text)
 	hs.WriteText(w, http.StatusOK, decrypt)
 }
 
@@ -339,7 +459,7 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	var backends []*backend.Backend
+	var removed []*backend.BackendConfig
 	if operation == "rm" {
 		var body struct {
 			Backends []*backend.BackendConfig `json:"backends"`
@@ -350,12 +470,16 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 			hs.WriteError(w, req, http.StatusBadRequest, "invalid backends from body")
 			return
 		}
+		removed = body.Backends
 		for _, bkcfg := range body.Backends {
-			backends = append(backends, backend.NewSimpleBackend(bkcfg))
-			hs.tx.CircleStates[circleId].Stats[bkcfg.Url] = &transfer.Stats{}
+			if _, err = backend.NewBackendTLSConfig(bkcfg); err != nil {
+				hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("invalid tls config of backend %s: %s", bkcfg.Url, err))
+				return
+			}
+			// the removed backends are recorded as a parameter of the audit log
+			req.Form.Add("backends", bkcfg.Url)
 		}
 	}
-	backends = append(backends, hs.ip.Circles[circleId].Backends...)
 
 	if hs.tx.CircleStates[circleId].Transferring {
 		hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", circleId))
@@ -366,15 +490,16 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	err = hs.setParam(req)
+	job := transfer.NewJob(transfer.JobRebalance)
+	job.CircleId = circleId
+	job.Backends = removed
+	job.Dbs = hs.formValues(req, "dbs")
+	err = hs.setParam(req, job)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	dbs := hs.formValues(req, "dbs")
-	go hs.tx.Rebalance(circleId, backends, dbs)
-	hs.WriteText(w, http.StatusAccepted, "accepted")
+	hs.startJob(w, req, job)
 }
 
 func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request) {
@@ -406,16 +531,17 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	err = hs.setParam(req)
+	job := transfer.NewJob(transfer.JobRecovery)
+	job.FromCircleId = fromCircleId
+	job.ToCircleId = toCircleId
+	job.BackendUrls = hs.formValues(req, "backend_urls")
+	job.Dbs = hs.formValues(req, "dbs")
+	err = hs.setParam(req, job)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	backendUrls := hs.formValues(req, "backend_urls")
-	dbs := hs.formValues(req, "dbs")
-	go hs.tx.Recovery(fromCircleId, toCircleId, backendUrls, dbs)
-	hs.WriteText(w, http.StatusAccepted, "accepted")
+	hs.startJob(w, req, job)
 }
 
 func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
@@ -423,12 +549,6 @@ func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	tick, err := hs.formTick(req)
-	if err != nil {
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
-		return
-	}
-
 	for _, cs := range hs.tx.CircleStates {
 		if cs.Transferring {
 			hs.WriteText(w, http.StatusBadRequest, fmt.Sprintf("circle %d is transferring", cs.CircleId))
@@ -440,15 +560,14 @@ func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = hs.setParam(req)
+	job := transfer.NewJob(transfer.JobResync)
+	job.Dbs = hs.formValues(req, "dbs")
+	err := hs.setParam(req, job)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	dbs := hs.formValues(req, "dbs")
-	go hs.tx.Resync(dbs, tick)
-	hs.WriteText(w, http.StatusAccepted, "accepted")
+	hs.startJob(w, req, job)
 }
 
 func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request) {
@@ -471,14 +590,93 @@ func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	err = hs.setParam(req)
+	job := transfer.NewJob(transfer.JobCleanup)
+	job.CircleId = circleId
+	job.Dbs = hs.formValues(req, "dbs")
+	err = hs.setParam(req, job)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	hs.startJob(w, req, job)
+}
+
+// startJob starts the transfer job in background and replies the job, whose id is recorded to the audit log,
+// or replies the measurements matched by the job without starting it if dry_run is true
+func (hs *HttpService) startJob(w http.ResponseWriter, req *http.Request, job *transfer.Job) {
+	if req.FormValue("dry_run") != "" {
+		dryRun, err := hs.formBool(req, "dry_run")
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, "illegal dry_run")
+			return
+		}
+		if dryRun {
+			plan, err := hs.tx.Plan(job)
+			if err != nil {
+				hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+				return
+			}
+			hs.Write(w, req, http.StatusOK, plan)
+			return
+		}
+	}
+	err := hs.tx.Start(job)
 	if err != nil {
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	req.Form.Set("job_id", job.Id)
+	finished := hs.auditFinished(req, job.Type)
+	go func() {
+		<-job.Stopped()
+		finished()
+	}()
+	hs.Write(w, req, http.StatusAccepted, job.Info(false))
+}
 
-	go hs.tx.Cleanup(circleId)
-	hs.WriteText(w, http.StatusAccepted, "accepted")
+func (hs *HttpService) HandlerJobs(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+		return
+	}
+
+	id := req.FormValue("id")
+	if req.Method == "GET" && id == "" {
+		jobs := hs.tx.Jobs()
+		infos := make([]*transfer.JobInfo, len(jobs))
+		for i, job := range jobs {
+			infos[i] = job.Info(false)
+		}
+		hs.Write(w, req, http.StatusOK, infos)
+		return
+	}
+	job, err := hs.tx.Job(id)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	if req.Method == "POST" {
+		switch req.FormValue("action") {
+		case "pause":
+			err = job.Pause()
+		case "resume":
+			err = hs.tx.ResumeJob(job)
+		case "cancel":
+			err = job.Cancel()
+		case "update":
+			limits := job.Info(false).Limits
+			if err = hs.setLimits(req, &limits); err == nil {
+				err = job.SetLimits(limits)
+			}
+		default:
+			hs.WriteError(w, req, http.StatusBadRequest, "invalid action, require pause, resume, cancel or update")
+			return
+		}
+		if err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	hs.Write(w, req, http.StatusOK, job.Info(true))
 }
 
 func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Request) {
@@ -558,7 +756,8 @@ func (hs *HttpService) HandlerTransferStats(w http.ResponseWriter, req *http.Req
 }
 
 func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndUser(w, req, "POST")
+	if !ok {
 		return
 	}
 
@@ -567,6 +766,9 @@ func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !hs.authorize(w, req, db, backend.ReadPrivilege) {
+		return
+	}
 
 	compressed, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -608,7 +810,7 @@ func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request)
 	err = hs.ip.ReadProm(w, req, db, metric)
 	if err != nil {
 		log.Printf("prometheus read error: %s, query: %s %s %v, client: %s", err, req.Method, db, q, req.RemoteAddr)
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		hs.writeQueryError(w, req, err)
 		return
 	}
 	if hs.queryTracing {
@@ -617,7 +819,8 @@ func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request)
 }
 
 func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request) {
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	req, ok := hs.checkMethodAndUser(w, req, "POST")
+	if !ok {
 		return
 	}
 
@@ -626,6 +829,9 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !hs.authorize(w, req, db, backend.WritePrivilege) {
+		return
+	}
 	rp := req.URL.Query().Get("rp")
 
 	body := req.Body
@@ -677,6 +883,11 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 		}
 	}
 
+	if err = hs.ip.AllowWrite(req, db, len(points), buf.Len()); err != nil {
+		hs.writeQueryError(w, req, err)
+		return
+	}
+
 	// Write points.
 	err = hs.ip.WritePoints(points, db, rp)
 	if err == nil {
@@ -696,12 +907,12 @@ func (hs *HttpService) Write(w http.ResponseWriter, req *http.Request, status in
 }
 
 func (hs *HttpService) WriteError(w http.ResponseWriter, req *http.Request, status int, err string) {
-	w.Header().Set("Content-Type", "application/json")
+	enc := backend.NewResponseEncoder(req)
+	w.Header().Set("Content-Type", enc.ContentType())
 	w.Header().Set("X-Influxdb-Error", err)
+	w.Header().Del("Content-Encoding")
 	w.WriteHeader(status)
-	rsp := backend.ResponseFromError(err)
-	pretty := req.URL.Query().Get("pretty") == "true"
-	w.Write(util.MarshalJSON(rsp, pretty))
+	w.Write(enc.Encode(backend.ResponseFromError(err)))
 }
 
 func (hs *HttpService) WriteBody(w http.ResponseWriter, body []byte) {
@@ -714,10 +925,41 @@ func (hs *HttpService) WriteText(w http.ResponseWriter, status int, text string)
 	w.Write([]byte(text + "\n"))
 }
 
+// writeQueryError writes the error with the status by queryErrorStatus, and the Retry-After header if rate limited
+func (hs *HttpService) writeQueryError(w http.ResponseWriter, req *http.Request, err error) {
+	var rle *backend.RateLimitError
+	if errors.As(err, &rle) {
+		w.Header().Set("Retry-After", strconv.Itoa(rle.RetryAfterSeconds()))
+	}
+	hs.WriteError(w, req, hs.queryErrorStatus(err), err.Error())
+}
+
+func (hs *HttpService) queryErrorStatus(err error) int {
+	if err == backend.ErrTooManyQueries || err == backend.ErrTooManyUserQueries || errors.Is(err, backend.ErrRateLimited) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, backend.ErrNotAuthorized) || errors.Is(err, backend.ErrStatementDenied) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
 func (hs *HttpService) checkMethodAndAuth(w http.ResponseWriter, req *http.Request, methods ...string) bool {
 	return hs.checkMethod(w, req, methods...) && hs.checkAuth(w, req)
 }
 
+// checkMethodAndAdmin is the same as checkMethodAndAuth, but rejects the request if the auth is disabled
+func (hs *HttpService) checkMethodAndAdmin(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	if !hs.checkMethod(w, req, methods...) {
+		return false
+	}
+	if hs.username == "" && hs.password == "" && hs.users == nil {
+		hs.WriteError(w, req, http.StatusForbidden, "admin authentication required, but the auth is disabled")
+		return false
+	}
+	return hs.checkAuth(w, req)
+}
+
 func (hs *HttpService) checkMethod(w http.ResponseWriter, req *http.Request, methods ...string) bool {
 	for _, method := range methods {
 		if req.Method == method {
@@ -728,22 +970,98 @@ func (hs *HttpService) checkMethod(w http.ResponseWriter, req *http.Request, met
 	return false
 }
 
+// checkMethodAndUser checks the method and authenticates the user, and returns the request with the user in context,
+// which is authorized later by the databases it touches
+func (hs *HttpService) checkMethodAndUser(w http.ResponseWriter, req *http.Request, methods ...string) (*http.Request, bool) {
+	if !hs.checkMethod(w, req, methods...) {
+		return req, false
+	}
+	user, err := hs.authenticate(req)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusUnauthorized, err.Error())
+		return req, false
+	}
+	if user != nil {
+		req = req.WithContext(backend.WithUser(req.Context(), user))
+	} else if hs.username != "" {
+		req = req.WithContext(backend.WithUserName(req.Context(), hs.username))
+	}
+	return req, true
+}
+
+// checkAuth authenticates the user of the admin endpoints, which requires admin if the users are configured
 func (hs *HttpService) checkAuth(w http.ResponseWriter, req *http.Request) bool {
-	if hs.username == "" && hs.password == "" {
-		return true
+	user, err := hs.authenticate(req)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	if user != nil && !user.Admin {
+		hs.WriteError(w, req, http.StatusForbidden, fmt.Sprintf("%s: user %s requires admin privilege", backend.ErrNotAuthorized, user.Name))
+		return false
+	}
+	return true
+}
+
+func (hs *HttpService) authorize(w http.ResponseWriter, req *http.Request, db string, p backend.Privilege) bool {
+	if err := backend.AuthorizeDatabase(backend.UserFromContext(req.Context()), db, p); err != nil {
+		hs.WriteError(w, req, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// authenticate returns the user of the users store, or nil user if it's the proxy user or the auth is disabled
+func (hs *HttpService) authenticate(req *http.Request) (*backend.User, error) {
+	proxyAuth := hs.username != "" || hs.password != ""
+	if !proxyAuth && hs.users == nil && hs.jwt == nil {
+		return nil, nil
+	}
+	if auth := req.Header.Get("Authorization"); hs.jwt != nil && strings.HasPrefix(auth, "Bearer ") {
+		name, err := hs.jwt.Validate(auth[len("Bearer "):], time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if hs.users != nil {
+			if user, ok := hs.users.Lookup(name); ok {
+				return user, nil
+			}
+		}
+		if proxyAuth && hs.compareUsername(name) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: user %s not found", backend.ErrAuthenticationFailed, name)
+	}
+	if name := backend.ClientCertIdentity(req.TLS); name != "" {
+		// the common name of the verified client certificate is mapped to the user with the same name
+		if hs.users != nil {
+			if user, ok := hs.users.Lookup(name); ok {
+				return user, nil
+			}
+		}
+		if proxyAuth && hs.compareUsername(name) {
+			return nil, nil
+		}
 	}
 	q := req.URL.Query()
-	if u, p := q.Get("u"), q.Get("p"); hs.compareAuth(u, p) {
-		return true
+	creds := [][2]string{{q.Get("u"), q.Get("p")}}
+	if u, p, ok := req.BasicAuth(); ok {
+		creds = append(creds, [2]string{u, p})
 	}
-	if u, p, ok := req.BasicAuth(); ok && hs.compareAuth(u, p) {
-		return true
+	if u, p, ok := hs.parseAuth(req); ok {
+		creds = append(creds, [2]string{u, p})
 	}
-	if u, p, ok := hs.parseAuth(req); ok && hs.compareAuth(u, p) {
-		return true
+	for _, cred := range creds {
+		if proxyAuth && hs.compareAuth(cred[0], cred[1]) {
+			return nil, nil
+		}
+		if hs.users != nil && cred[0] != "" {
+			if user, err := hs.users.Authenticate(cred[0], cred[1]); err == nil {
+				return user, nil
+			}
+		}
 	}
-	hs.WriteError(w, req, http.StatusUnauthorized, "authentication failed")
-	return false
+	return nil, backend.ErrAuthenticationFailed
 }
 
 func (hs *HttpService) parseAuth(req *http.Request) (string, string, bool) {
@@ -761,14 +1079,11 @@ func (hs *HttpService) parseAuth(req *http.Request) (string, string, bool) {
 }
 
 func (hs *HttpService) compareAuth(u, p string) bool {
-	return hs.transAuth(u) == hs.username && hs.transAuth(p) == hs.password
+	return hs.compareUsername(u) && subtle.ConstantTimeCompare([]byte(p), []byte(hs.password)) == 1
 }
 
-func (hs *HttpService) transAuth(text string) string {
-	if hs.authEncrypt {
-		return util.AesEncrypt(text)
-	}
-	return text
+func (hs *HttpService) compareUsername(u string) bool {
+	return subtle.ConstantTimeCompare([]byte(u), []byte(hs.username)) == 1
 }
 
 func (hs *HttpService) bucket2dbrp(bucket string) (string, string, error) {
@@ -824,18 +1139,45 @@ func (hs *HttpService) formBool(req *http.Request, key string) (bool, error) {
 	return strconv.ParseBool(req.FormValue(key))
 }
 
-func (hs *HttpService) formTick(req *http.Request) (int64, error) {
-	str := strings.TrimSpace(req.FormValue("tick"))
+func (hs *HttpService) formTick(req *http.Request, key string) (int64, error) {
+	str := strings.TrimSpace(req.FormValue(key))
 	if str == "" {
 		return 0, nil
 	}
 	tick, err := strconv.ParseInt(str, 10, 64)
 	if err != nil || tick < 0 {
-		return 0, ErrInvalidTick
+		return 0, fmt.Errorf("%w: %s", ErrInvalidTick, key)
 	}
 	return tick, nil
 }
 
+// formPatterns returns the non-empty values of the key, each is a pattern which may contain commas
+func (hs *HttpService) formPatterns(req *http.Request, key string) []string {
+	var patterns []string
+	for _, v := range req.Form[key] {
+		if v = strings.TrimSpace(v); v != "" {
+			patterns = append(patterns, v)
+		}
+	}
+	return patterns
+}
+
+// formTime parses the time in RFC3339 format or unix seconds, and returns zero time if it's empty
+func (hs *HttpService) formTime(req *http.Request, key string) (time.Time, error) {
+	str := strings.TrimSpace(req.FormValue(key))
+	if str == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s, require RFC3339 or unix seconds", key)
+	}
+	return t, nil
+}
+
 func (hs *HttpService) formCircleId(req *http.Request, key string) (int, error) { // nolint:golint
 	circleId, err := strconv.Atoi(req.FormValue(key)) // nolint:golint
 	if err != nil || circleId < 0 || circleId >= len(hs.ip.Circles) {
@@ -844,70 +1186,127 @@ func (hs *HttpService) formCircleId(req *http.Request, key string) (int, error)
 	return circleId, nil
 }
 
-func (hs *HttpService) setParam(req *http.Request) error {
+func (hs *HttpService) setParam(req *http.Request, job *transfer.Job) error {
 	var err error
-	err = hs.setWorker(req)
+	err = hs.setWorker(req, job)
+	if err != nil {
+		return err
+	}
+	err = hs.setBatch(req, job)
 	if err != nil {
 		return err
 	}
-	err = hs.setBatch(req)
+	err = hs.setLimit(req, job)
 	if err != nil {
 		return err
 	}
-	err = hs.setLimit(req)
+	err = hs.setHaAddrs(req, job)
 	if err != nil {
 		return err
 	}
-	err = hs.setHaAddrs(req)
+	err = hs.setLimits(req, &job.Limits)
 	if err != nil {
 		return err
 	}
+	err = hs.setFilters(req, job)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// setFilters sets the retention policies, measurement patterns and time range to transfer
+func (hs *HttpService) setFilters(req *http.Request, job *transfer.Job) error {
+	var err error
+	job.Tick, err = hs.formTick(req, "tick")
+	if err != nil {
+		return err
+	}
+	job.EndTick, err = hs.formTick(req, "end_tick")
+	if err != nil {
+		return err
+	}
+	job.RetentionPolicies = hs.formValues(req, "rps")
+	job.Measurements = hs.formPatterns(req, "measurements")
+	job.ExcludeMeasurements = hs.formPatterns(req, "exclude_measurements")
 	return nil
 }
 
-func (hs *HttpService) setWorker(req *http.Request) error {
+// setLimits sets the limits given by the request, the others are unchanged
+func (hs *HttpService) setLimits(req *http.Request, limits *transfer.JobLimits) error {
+	rates := []struct {
+		key  string
+		rate *float64
+	}{
+		{"read_points_per_second", &limits.ReadPointsPerSecond},
+		{"read_bytes_per_second", &limits.ReadBytesPerSecond},
+		{"write_points_per_second", &limits.WritePointsPerSecond},
+		{"write_bytes_per_second", &limits.WriteBytesPerSecond},
+	}
+	for _, r := range rates {
+		str := strings.TrimSpace(req.FormValue(r.key))
+		if str != "" {
+			rate, err := strconv.ParseFloat(str, 64)
+			if err != nil || rate < 0 {
+				return fmt.Errorf("%w: %s", ErrInvalidRate, r.key)
+			}
+			*r.rate = rate
+		}
+	}
+	if str := strings.TrimSpace(req.FormValue("max_latency_ms")); str != "" {
+		latency, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || latency < 0 {
+			return ErrInvalidMaxLatency
+		}
+		limits.MaxLatencyMs = latency
+	}
+	if str := strings.TrimSpace(req.FormValue("max_error_rate")); str != "" {
+		rate, err := strconv.ParseFloat(str, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return ErrInvalidMaxErrorRate
+		}
+		limits.MaxErrorRate = rate
+	}
+	return nil
+}
+
+func (hs *HttpService) setWorker(req *http.Request, job *transfer.Job) error {
 	str := strings.TrimSpace(req.FormValue("worker"))
 	if str != "" {
 		worker, err := strconv.Atoi(str)
 		if err != nil || worker <= 0 {
 			return ErrInvalidWorker
 		}
-		hs.tx.Worker = worker
-	} else {
-		hs.tx.Worker = transfer.DefaultWorker
+		job.Worker = worker
 	}
 	return nil
 }
 
-func (hs *HttpService) setBatch(req *http.Request) error {
+func (hs *HttpService) setBatch(req *http.Request, job *transfer.Job) error {
 	str := strings.TrimSpace(req.FormValue("batch"))
 	if str != "" {
 		batch, err := strconv.Atoi(str)
 		if err != nil || batch <= 0 {
 			return ErrInvalidBatch
 		}
-		hs.tx.Batch = batch
-	} else {
-		hs.tx.Batch = transfer.DefaultBatch
+		job.Batch = batch
 	}
 	return nil
 }
 
-func (hs *HttpService) setLimit(req *http.Request) error {
+func (hs *HttpService) setLimit(req *http.Request, job *transfer.Job) error {
 	str := strings.TrimSpace(req.FormValue("limit"))
 	if str != "" {
 		limit, err := strconv.Atoi(str)
 		if err != nil || limit <= 0 {
 			return ErrInvalidLimit
 		}
-		hs.tx.Limit = limit
-	} else {
-		hs.tx.Limit = transfer.DefaultLimit
+		job.Limit = limit
 	}
 	return nil
 }
 
-func (hs *HttpService) setHaAddrs(req *http.Request) error {
+func (hs *HttpService) setHaAddrs(req *http.Request, job *transfer.Job) error {
 	haAddrs := hs.formValues(req, "ha_addrs")
 	if len(haAddrs) > 1 {
 		r, _ := regexp.Compile(`^[\w-.]+:\d{1,5}$`)
@@ -916,7 +1315,7 @@ func (hs *HttpService) setHaAddrs(req *http.Request) error {
 				return ErrInvalidHaAddrs
 			}
 		}
-		hs.tx.HaAddrs = haAddrs
+		job.HaAddrs = haAddrs
 	} else if len(haAddrs) == 1 {
 		return ErrInvalidHaAddrs
 	}
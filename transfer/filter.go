@@ -0,0 +1,216 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+var (
+	ErrJobTimeRange         = errors.New("invalid time range, require end_tick greater than tick")
+	ErrJobCleanupRetentions = errors.New("cleanup can't filter retention policies since it deletes the measurements of all retention policies")
+)
+
+// initFilters validates the filters of the job and compiles the measurement patterns,
+// the filters select the measurements and retention policies before any data is queried
+func (job *Job) initFilters() error {
+	if job.EndTick > 0 && job.EndTick <= job.Tick {
+		return ErrJobTimeRange
+	}
+	if job.Type == JobCleanup && len(job.RetentionPolicies) > 0 {
+		return ErrJobCleanupRetentions
+	}
+	var err error
+	job.include, err = compilePatterns(job.Measurements)
+	if err != nil {
+		return err
+	}
+	job.exclude, err = compilePatterns(job.ExcludeMeasurements)
+	return err
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid measurement pattern %s: %w", pattern, err)
+		}
+		regexps[i] = r
+	}
+	return regexps, nil
+}
+
+func matchPatterns(regexps []*regexp.Regexp, s string) bool {
+	for _, r := range regexps {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMeasurements returns the measurements matching any include pattern and no exclude pattern,
+// all the measurements are included if there is no include pattern
+func (job *Job) filterMeasurements(measures []string) []string {
+	if len(job.include) == 0 && len(job.exclude) == 0 {
+		return measures
+	}
+	filtered := make([]string, 0, len(measures))
+	for _, meas := range measures {
+		if (len(job.include) == 0 || matchPatterns(job.include, meas)) && !matchPatterns(job.exclude, meas) {
+			filtered = append(filtered, meas)
+		}
+	}
+	return filtered
+}
+
+// filterRetentionPolicies returns the retention policies of the job, or all if the job has none
+func (job *Job) filterRetentionPolicies(rps []string) []string {
+	if len(job.RetentionPolicies) == 0 {
+		return rps
+	}
+	set := util.NewSetFromSlice(job.RetentionPolicies)
+	filtered := make([]string, 0, len(rps))
+	for _, rp := range rps {
+		if set[rp] {
+			filtered = append(filtered, rp)
+		}
+	}
+	return filtered
+}
+
+// filterDatabases returns the databases of the job, or all if the job has none
+func (job *Job) filterDatabases(dbs []string) []string {
+	if len(job.Dbs) == 0 {
+		return dbs
+	}
+	set := util.NewSetFromSlice(job.Dbs)
+	filtered := make([]string, 0, len(dbs))
+	for _, db := range dbs {
+		if set[db] {
+			filtered = append(filtered, db)
+		}
+	}
+	return filtered
+}
+
+// timeRange returns the time range [start, end) in nanoseconds to transfer, zero end means unlimited
+func (job *Job) timeRange() (start, end int64) {
+	return job.Tick * int64(time.Second), job.EndTick * int64(time.Second)
+}
+
+// Match is a measurement matched by the job on the backend, which is transferred to the destinations
+// in the retention policies, or deleted from the backend by the cleanup job
+type Match struct {
+	Backend     string   `json:"backend"`
+	Db          string   `json:"db"`
+	Measurement string   `json:"measurement"`
+	Rps         []string `json:"rps,omitempty"`
+	Dsts        []string `json:"dsts,omitempty"`
+}
+
+// Plan is the result of the dry run of the job
+type Plan struct {
+	Type             string                 `json:"type"`
+	Params           map[string]interface{} `json:"params"`
+	Matches          []*Match               `json:"matches"`
+	InactiveBackends []string               `json:"inactive_backends,omitempty"`
+}
+
+// Plan returns the measurements which the job would transfer or clean up without running it,
+// only the databases, retention policies and measurements are queried
+func (tx *Transfer) Plan(job *Job) (*Plan, error) {
+	if err := job.initFilters(); err != nil {
+		return nil, err
+	}
+	plan := &Plan{Type: job.Type, Params: job.params(), Matches: make([]*Match, 0)}
+	switch job.Type {
+	case JobRebalance:
+		cs := tx.CircleStates[job.CircleId]
+		dbs := job.Dbs
+		if len(dbs) == 0 {
+			dbs = tx.getDatabases()
+		}
+		backends, err := tx.rebalanceBackends(job)
+		if err != nil {
+			return nil, err
+		}
+		for _, be := range backends {
+			be := be
+			tx.planBackend(job, plan, be, dbs, func(db, meas string) []*backend.Backend {
+				return rebalanceDsts(cs, be, db, meas)
+			})
+		}
+	case JobRecovery:
+		dbs := job.Dbs
+		if len(dbs) == 0 {
+			dbs = tx.getDatabases()
+		}
+		tcs := tx.CircleStates[job.ToCircleId]
+		backendUrlSet := recoveryUrls(job, tcs) // nolint:golint
+		for _, be := range tx.CircleStates[job.FromCircleId].Backends {
+			tx.planBackend(job, plan, be, dbs, func(db, meas string) []*backend.Backend {
+				return recoveryDsts(tcs, backendUrlSet, db, meas)
+			})
+		}
+	case JobResync:
+		dbs := job.Dbs
+		if len(dbs) == 0 {
+			dbs = tx.getDatabases()
+		}
+		for _, cs := range tx.CircleStates {
+			cs := cs
+			for _, be := range cs.Backends {
+				tx.planBackend(job, plan, be, dbs, func(db, meas string) []*backend.Backend {
+					return tx.resyncDsts(cs, db, meas)
+				})
+			}
+		}
+	case JobCleanup:
+		cs := tx.CircleStates[job.CircleId]
+		for _, be := range cs.Backends {
+			be := be
+			tx.planBackend(job, plan, be, job.filterDatabases(be.GetDatabases()), func(db, meas string) []*backend.Backend {
+				return rebalanceDsts(cs, be, db, meas)
+			})
+		}
+	}
+	return plan, nil
+}
+
+// planBackend adds the measurements of the backend matched by the filters and routed to the destinations
+func (tx *Transfer) planBackend(job *Job, plan *Plan, be *backend.Backend, dbs []string, route func(db, meas string) []*backend.Backend) {
+	if !be.IsActive() {
+		plan.InactiveBackends = append(plan.InactiveBackends, be.Url)
+		return
+	}
+	for _, db := range dbs {
+		var rps []string
+		if job.Type != JobCleanup {
+			rps = job.filterRetentionPolicies(be.GetRetentionPolicies(db))
+			if len(rps) == 0 {
+				continue
+			}
+		}
+		for _, meas := range job.filterMeasurements(be.GetMeasurements(db)) {
+			dsts := route(db, meas)
+			if len(dsts) == 0 {
+				continue
+			}
+			match := &Match{Backend: be.Url, Db: db, Measurement: meas, Rps: rps}
+			if job.Type != JobCleanup {
+				match.Dsts = getBackendUrls(dsts)
+			}
+			plan.Matches = append(plan.Matches, match)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestInitFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		job      *Job
+		err      error
+		hasError bool
+	}{
+		{name: "no filter", job: &Job{Type: JobResync}},
+		{name: "patterns", job: &Job{Type: JobResync, Measurements: []string{"^cpu", "mem$"}, ExcludeMeasurements: []string{"_tmp$"}}},
+		{name: "bad include pattern", job: &Job{Type: JobResync, Measurements: []string{"cpu("}}, hasError: true},
+		{name: "bad exclude pattern", job: &Job{Type: JobResync, ExcludeMeasurements: []string{"[a-"}}, hasError: true},
+		{name: "time range", job: &Job{Type: JobResync, Tick: 100, EndTick: 200}},
+		{name: "tick only", job: &Job{Type: JobResync, Tick: 100}},
+		{name: "end tick equals tick", job: &Job{Type: JobResync, Tick: 100, EndTick: 100}, err: ErrJobTimeRange},
+		{name: "end tick before tick", job: &Job{Type: JobResync, Tick: 200, EndTick: 100}, err: ErrJobTimeRange},
+		{name: "cleanup with rps", job: &Job{Type: JobCleanup, RetentionPolicies: []string{"autogen"}}, err: ErrJobCleanupRetentions},
+		{name: "rebalance with rps", job: &Job{Type: JobRebalance, RetentionPolicies: []string{"autogen"}}},
+	}
+	for _, tt := range tests {
+		err := tt.job.initFilters()
+		if tt.err != nil {
+			if err != tt.err {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			}
+		} else if (err != nil) != tt.hasError {
+			t.Errorf("%s: error = %v, hasError %v", tt.name, err, tt.hasError)
+		}
+	}
+}
+
+func TestFilterMeasurements(t *testing.T) {
+	measures := []string{"cpu", "cpu_tmp", "disk", "mem", "mem_tmp"}
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{name: "all", want: measures},
+		{name: "include", include: []string{"^cpu", "^disk$"}, want: []string{"cpu", "cpu_tmp", "disk"}},
+		{name: "exclude", exclude: []string{"_tmp$"}, want: []string{"cpu", "disk", "mem"}},
+		{name: "include and exclude", include: []string{"^mem"}, exclude: []string{"_tmp$"}, want: []string{"mem"}},
+		{name: "none", include: []string{"^load"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		job := &Job{Type: JobResync, Measurements: tt.include, ExcludeMeasurements: tt.exclude}
+		if err := job.initFilters(); err != nil {
+			t.Fatal(err)
+		}
+		if got := job.filterMeasurements(measures); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: measurements = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterRetentionPoliciesAndDatabases(t *testing.T) {
+	all := []string{"autogen", "rp1", "rp2"}
+	tests := []struct {
+		name   string
+		filter []string
+		want   []string
+	}{
+		{name: "all", want: all},
+		{name: "selected", filter: []string{"rp2", "autogen"}, want: []string{"autogen", "rp2"}},
+		{name: "missing", filter: []string{"rp3"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		job := &Job{Type: JobResync, RetentionPolicies: tt.filter, Dbs: tt.filter}
+		if got := job.filterRetentionPolicies(all); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: retention policies = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := job.filterDatabases(all); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: databases = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// testSchema is the retention policies and the measurements of the databases on a fake backend
+type testSchema struct {
+	dbs          []string
+	rps          map[string][]string
+	measurements map[string][]string
+}
+
+func respondSchema(schema *testSchema) func(db, q string) *models.Row {
+	values := func(names []string) [][]interface{} {
+		vs := make([][]interface{}, len(names))
+		for i, name := range names {
+			vs[i] = []interface{}{name}
+		}
+		return vs
+	}
+	return func(db, q string) *models.Row {
+		switch q {
+		case "show databases":
+			return &models.Row{Name: "databases", Columns: []string{"name"}, Values: values(schema.dbs)}
+		case "show retention policies":
+			if len(schema.rps[db]) > 0 {
+				return &models.Row{Columns: []string{"name"}, Values: values(schema.rps[db])}
+			}
+		case "show measurements":
+			if len(schema.measurements[db]) > 0 {
+				return &models.Row{Name: "measurements", Columns: []string{"name"}, Values: values(schema.measurements[db])}
+			}
+		}
+		return nil
+	}
+}
+
+func newTestBackendConfig(t *testing.T, name string, schema *testSchema) *backend.BackendConfig {
+	return &backend.BackendConfig{Name: name, Url: newFakeInflux(t, respondSchema(schema)).URL}
+}
+
+// newTestTransfer returns the transfer of the circles with the backends
+func newTestTransfer(t *testing.T, circles ...[]*backend.BackendConfig) *Transfer {
+	pxcfg := &backend.ProxyConfig{DataDir: t.TempDir(), HashKey: "idx", CheckInterval: 1, ConnPoolSize: 1, FlushSize: 1, FlushTime: 1, RewriteInterval: 1, WriteTimeout: 10}
+	tx := &Transfer{jobDir: filepath.Join(pxcfg.DataDir, "transfer"), jobs: make(map[string]*Job)}
+	for idx, bkcfgs := range circles {
+		pxcfg.Circles = append(pxcfg.Circles, &backend.CircleConfig{Name: fmt.Sprintf("circle-%d", idx), Backends: bkcfgs})
+		circle, err := backend.NewCircle(pxcfg.Circles[idx], pxcfg, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, be := range circle.Backends {
+			t.Cleanup(be.Close)
+		}
+		tx.CircleStates = append(tx.CircleStates, NewCircleState(pxcfg.Circles[idx], circle))
+	}
+	return tx
+}
+
+func TestPlan(t *testing.T) {
+	a := newTestBackendConfig(t, "a", &testSchema{
+		dbs:          []string{"db1", "db2"},
+		rps:          map[string][]string{"db1": {"autogen", "rp1"}, "db2": {"autogen"}},
+		measurements: map[string][]string{"db1": {"cpu", "cpu_tmp", "mem"}, "db2": {"disk"}},
+	})
+	b := newTestBackendConfig(t, "b", &testSchema{
+		dbs:          []string{"db1"},
+		rps:          map[string][]string{"db1": {"autogen"}},
+		measurements: map[string][]string{"db1": {"cpu"}},
+	})
+	// c is the backend removed from the circle 0
+	c := newTestBackendConfig(t, "c", &testSchema{
+		dbs:          []string{"db1"},
+		rps:          map[string][]string{"db1": {"autogen"}},
+		measurements: map[string][]string{"db1": {"cpu", "cpu_tmp", "load"}},
+	})
+	tx := newTestTransfer(t, []*backend.BackendConfig{a}, []*backend.BackendConfig{b})
+
+	tests := []struct {
+		name    string
+		job     *Job
+		params  map[string]interface{}
+		matches []*Match
+		err     error
+	}{
+		{
+			name:    "rebalance",
+			job:     &Job{Type: JobRebalance, CircleId: 0, Backends: []*backend.BackendConfig{c}, Measurements: []string{"^cpu"}, ExcludeMeasurements: []string{"_tmp$"}},
+			params:  map[string]interface{}{"circle_id": 0, "backends": []string{c.Url}, "measurements": []string{"^cpu"}, "exclude_measurements": []string{"_tmp$"}},
+			matches: []*Match{{Backend: c.Url, Db: "db1", Measurement: "cpu", Rps: []string{"autogen"}, Dsts: []string{a.Url}}},
+		},
+		{
+			name:   "recovery",
+			job:    &Job{Type: JobRecovery, FromCircleId: 0, ToCircleId: 1, RetentionPolicies: []string{"rp1"}},
+			params: map[string]interface{}{"from_circle_id": 0, "to_circle_id": 1, "rps": []string{"rp1"}},
+			matches: []*Match{
+				{Backend: a.Url, Db: "db1", Measurement: "cpu", Rps: []string{"rp1"}, Dsts: []string{b.Url}},
+				{Backend: a.Url, Db: "db1", Measurement: "cpu_tmp", Rps: []string{"rp1"}, Dsts: []string{b.Url}},
+				{Backend: a.Url, Db: "db1", Measurement: "mem", Rps: []string{"rp1"}, Dsts: []string{b.Url}},
+			},
+		},
+		{
+			name:    "resync",
+			job:     &Job{Type: JobResync, Dbs: []string{"db2"}, Tick: 100, EndTick: 200},
+			params:  map[string]interface{}{"dbs": []string{"db2"}, "tick": 100, "end_tick": 200},
+			matches: []*Match{{Backend: a.Url, Db: "db2", Measurement: "disk", Rps: []string{"autogen"}, Dsts: []string{b.Url}}},
+		},
+		{
+			// the measurements of the single backend of the circle are all in place
+			name:    "cleanup in place",
+			job:     &Job{Type: JobCleanup, CircleId: 1},
+			params:  map[string]interface{}{"circle_id": 1},
+			matches: []*Match{},
+		},
+		{
+			name: "invalid filter",
+			job:  &Job{Type: JobResync, Tick: 200, EndTick: 100},
+			err:  ErrJobTimeRange,
+		},
+	}
+	for _, tt := range tests {
+		tt.job.Worker, tt.job.Batch, tt.job.Limit = DefaultWorker, DefaultBatch, DefaultLimit
+		plan, err := tx.Plan(tt.job)
+		if err != tt.err {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		tt.params["worker"], tt.params["batch"], tt.params["limit"] = DefaultWorker, DefaultBatch, DefaultLimit
+		if plan.Type != tt.job.Type || toJSON(plan.Params) != toJSON(tt.params) {
+			t.Errorf("%s: type = %s, params = %s, want %s, %s", tt.name, plan.Type, toJSON(plan.Params), tt.job.Type, toJSON(tt.params))
+		}
+		if toJSON(plan.Matches) != toJSON(tt.matches) || len(plan.InactiveBackends) > 0 {
+			t.Errorf("%s: matches = %s, inactive = %v, want %s", tt.name, toJSON(plan.Matches), plan.InactiveBackends, toJSON(tt.matches))
+		}
+	}
+
+	// the removed backend with invalid tls config is rejected
+	job := &Job{Type: JobRebalance, Backends: []*backend.BackendConfig{{Name: "d", Url: "https://127.0.0.1:8086", TLSCA: filepath.Join(t.TempDir(), "missing.pem")}}}
+	if _, err := tx.Plan(job); err == nil {
+		t.Error("rebalance with invalid tls config: error = nil")
+	}
+}
+
+func TestPlanCleanup(t *testing.T) {
+	schema := &testSchema{
+		dbs:          []string{"db1", "db2"},
+		rps:          map[string][]string{"db1": {"autogen", "rp1"}, "db2": {"autogen"}},
+		measurements: map[string][]string{"db1": {"cpu", "disk", "mem"}, "db2": {"cpu"}},
+	}
+	tx := newTestTransfer(t, []*backend.BackendConfig{newTestBackendConfig(t, "a", schema), newTestBackendConfig(t, "b", schema)})
+	cs := tx.CircleStates[0]
+
+	job := &Job{Type: JobCleanup, Dbs: []string{"db1"}, Measurements: []string{"^(cpu|mem)$"}}
+	plan, err := tx.Plan(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each measurement on both backends is cleaned up from the backend which it doesn't belong to
+	want := make([]*Match, 0)
+	for _, be := range cs.Backends {
+		for _, meas := range []string{"cpu", "mem"} {
+			if cs.GetBackend(backend.GetKey("db1", meas)).Url != be.Url {
+				want = append(want, &Match{Backend: be.Url, Db: "db1", Measurement: meas})
+			}
+		}
+	}
+	if len(want) != 2 || toJSON(plan.Matches) != toJSON(want) {
+		t.Errorf("matches = %s, want %s", toJSON(plan.Matches), toJSON(want))
+	}
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
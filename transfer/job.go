@@ -0,0 +1,674 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/panjf2000/ants/v2"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	JobRebalance = "rebalance"
+	JobRecovery  = "recovery"
+	JobResync    = "resync"
+	JobCleanup   = "cleanup"
+)
+
+const (
+	JobRunning   = "running"
+	JobPaused    = "paused"
+	JobCancelled = "cancelled"
+	JobFinished  = "finished"
+	JobFailed    = "failed"
+	JobPartial   = "partial"
+)
+
+var (
+	ErrJobCancelled = errors.New("job cancelled")
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobConflict  = errors.New("job conflicts with the running job")
+	ErrJobNotPaused = errors.New("job is not paused")
+	ErrJobStopped   = errors.New("job is stopped")
+	ErrJobNoFile    = errors.New("job has no id or file to save")
+	ErrJobNotRetry  = errors.New("job has no failed measurements to retry")
+
+	ErrBackendInactive = errors.New("backend is inactive")
+)
+
+// jobSaveInterval is the minimum interval to save the checkpoints of the running job,
+// the checkpoints not saved are transferred again after restart, which is idempotent
+var jobSaveInterval = time.Second
+
+// Job is a transfer operation with its own parameters, which is persisted as a json file under the data dir
+// until it's stopped, so that the job interrupted by a restart is resumed from its checkpoints. The checkpoints
+// are the completed measurements and, for the measurements in transfer, the end of the last time window copied,
+// since the points are copied in time windows in ascending order. The job completed with failed measurements
+// is partial, which keeps its file until it's resumed to retry them or cancelled.
+type Job struct {
+	Id                  string                   `json:"id"` // nolint:golint
+	Type                string                   `json:"type"`
+	Status              string                   `json:"status"`
+	CircleId            int                      `json:"circle_id"`      // nolint:golint
+	FromCircleId        int                      `json:"from_circle_id"` // nolint:golint
+	ToCircleId          int                      `json:"to_circle_id"`   // nolint:golint
+	Backends            []*backend.BackendConfig `json:"backends,omitempty"`
+	BackendUrls         []string                 `json:"backend_urls,omitempty"`
+	Dbs                 []string                 `json:"dbs,omitempty"`
+	Tick                int64                    `json:"tick,omitempty"`
+	EndTick             int64                    `json:"end_tick,omitempty"`
+	Measurements        []string                 `json:"measurements,omitempty"`
+	ExcludeMeasurements []string                 `json:"exclude_measurements,omitempty"`
+	RetentionPolicies   []string                 `json:"retention_policies,omitempty"`
+	Worker              int                      `json:"worker"`
+	Batch               int                      `json:"batch"`
+	Limit               int                      `json:"limit"`
+	HaAddrs             []string                 `json:"ha_addrs,omitempty"`
+	Limits              JobLimits                `json:"limits"`
+	PauseReason         string                   `json:"pause_reason,omitempty"`
+	AutoPaused          bool                     `json:"auto_paused,omitempty"`
+	StartTime           time.Time                `json:"start_time"`
+	EndTime             time.Time                `json:"end_time"`
+	LogFile             string                   `json:"log_file"`
+	Error               string                   `json:"error,omitempty"`
+	Done                map[string]bool          `json:"done"`
+	Windows             map[string]int64         `json:"windows"`
+	Errors              map[string]string        `json:"errors"`
+
+	measurementTotal int32
+	measurementDone  int32
+	runTime          time.Time
+	pauseTime        time.Time
+	paused           time.Duration
+	resumeTimer      *time.Timer
+	health           health
+	readPoints       throttle
+	readBytes        throttle
+	writePoints      throttle
+	writeBytes       throttle
+	include          []*regexp.Regexp
+	exclude          []*regexp.Regexp
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	filename string
+	saved    time.Time
+	stopped  chan struct{}
+	tlog     *log.Logger
+	logger   io.Closer
+	pool     *ants.Pool
+}
+
+// NewJob returns the job of the type with the default parameters, the other parameters are set by the caller
+func NewJob(typ string) *Job {
+	return &Job{Type: typ, Worker: DefaultWorker, Batch: DefaultBatch, Limit: DefaultLimit}
+}
+
+func newJobId(typ string) string { // nolint:golint
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s-%s", typ, time.Now().Format("20060102150405"), hex.EncodeToString(b))
+}
+
+func loadJob(filename string) (*Job, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err = json.Unmarshal(b, job); err != nil {
+		return nil, err
+	}
+	job.init(filename)
+	return job, nil
+}
+
+func (job *Job) init(filename string) {
+	if job.Done == nil {
+		job.Done = make(map[string]bool)
+	}
+	if job.Windows == nil {
+		job.Windows = make(map[string]int64)
+	}
+	if job.Errors == nil {
+		job.Errors = make(map[string]string)
+	}
+	job.cond = sync.NewCond(&job.lock)
+	job.filename = filename
+	job.stopped = make(chan struct{})
+	job.setThrottles()
+}
+
+func (job *Job) setThrottles() {
+	job.readPoints.setRate(job.Limits.ReadPointsPerSecond)
+	job.readBytes.setRate(job.Limits.ReadBytesPerSecond)
+	job.writePoints.setRate(job.Limits.WritePointsPerSecond)
+	job.writeBytes.setRate(job.Limits.WriteBytesPerSecond)
+}
+
+// SetLimits changes the limits of the job, which take effect on the next read and write
+func (job *Job) SetLimits(limits JobLimits) error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.Status != JobRunning && job.Status != JobPaused && job.Status != JobPartial {
+		return ErrJobStopped
+	}
+	job.Limits = limits
+	job.setThrottles()
+	job.health.reset()
+	job.saveOrLog()
+	return nil
+}
+
+// circles returns the ids of the circles which the job transfers from or to, nil means all the circles
+func (job *Job) circles() []int {
+	switch job.Type {
+	case JobRebalance, JobCleanup:
+		return []int{job.CircleId}
+	case JobRecovery:
+		return []int{job.FromCircleId, job.ToCircleId}
+	}
+	return nil
+}
+
+// conflicts checks whether the two jobs transfer the same circle
+func (job *Job) conflicts(other *Job) bool {
+	cs1, cs2 := job.circles(), other.circles()
+	if cs1 == nil || cs2 == nil {
+		return true
+	}
+	for _, c1 := range cs1 {
+		for _, c2 := range cs2 {
+			if c1 == c2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (job *Job) openLog(tlogDir string) {
+	if tlogDir == "" {
+		job.tlog = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+		return
+	}
+	util.MakeDir(tlogDir)
+	logger := &lumberjack.Logger{
+		Filename:   job.LogFile,
+		MaxSize:    100,
+		MaxBackups: 5,
+		MaxAge:     7,
+	}
+	job.tlog = log.New(logger, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	job.logger = logger
+}
+
+// Stopped returns the channel which is closed once the job is stopped
+func (job *Job) Stopped() <-chan struct{} {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.stopped
+}
+
+// Pause pauses the running job, the transfers in progress are paused after their current batch
+func (job *Job) Pause() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	switch job.Status {
+	case JobPaused:
+		// the job paused automatically keeps paused until it's resumed by the user
+		job.AutoPaused = false
+		job.PauseReason = ""
+		job.stopResume()
+		job.saveOrLog()
+		return nil
+	case JobRunning:
+		job.Status = JobPaused
+		job.pauseTime = time.Now()
+		job.saveOrLog()
+		return nil
+	}
+	return ErrJobStopped
+}
+
+func (job *Job) Resume() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	switch job.Status {
+	case JobRunning:
+		return ErrJobNotPaused
+	case JobPaused:
+		job.resume()
+		return nil
+	}
+	return ErrJobStopped
+}
+
+func (job *Job) resume() {
+	job.stopResume()
+	job.Status = JobRunning
+	job.AutoPaused = false
+	job.PauseReason = ""
+	job.paused += time.Since(job.pauseTime)
+	job.health.reset()
+	job.cond.Broadcast()
+	job.saveOrLog()
+}
+
+// observe records the latency and the error of a backend request, and pauses the running job if the average
+// latency or the error rate of the latest requests exceeds the limits, which is resumed after AutoResumeInterval
+func (job *Job) observe(latency time.Duration, err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.health.add(latency, err != nil)
+	if job.Status != JobRunning || !job.health.full() {
+		return
+	}
+	reason := ""
+	if maxLatency := time.Duration(job.Limits.MaxLatencyMs) * time.Millisecond; maxLatency > 0 && job.health.latency() > maxLatency {
+		reason = fmt.Sprintf("backend latency %s exceeds %s", job.health.latency().Round(time.Millisecond), maxLatency)
+	} else if job.Limits.MaxErrorRate > 0 && job.health.errorRate() > job.Limits.MaxErrorRate {
+		reason = fmt.Sprintf("backend error rate %.2f exceeds %.2f", job.health.errorRate(), job.Limits.MaxErrorRate)
+	}
+	if reason == "" {
+		return
+	}
+	job.Status = JobPaused
+	job.AutoPaused = true
+	job.PauseReason = reason
+	job.pauseTime = time.Now()
+	job.tlog.Printf("job paused: %s, resume after %s", reason, AutoResumeInterval)
+	job.saveOrLog()
+	job.scheduleResume()
+}
+
+// scheduleResume resumes the job paused automatically after AutoResumeInterval, the timer scheduled before
+// is stopped so that only the latest pause is resumed
+func (job *Job) scheduleResume() {
+	job.stopResume()
+	var timer *time.Timer
+	timer = time.AfterFunc(AutoResumeInterval, func() {
+		job.lock.Lock()
+		defer job.lock.Unlock()
+		if job.resumeTimer != timer {
+			return
+		}
+		job.resumeTimer = nil
+		if job.Status == JobPaused && job.AutoPaused {
+			job.tlog.Printf("job resumed after paused: %s", job.PauseReason)
+			job.resume()
+		}
+	})
+	job.resumeTimer = timer
+}
+
+func (job *Job) stopResume() {
+	if job.resumeTimer != nil {
+		job.resumeTimer.Stop()
+		job.resumeTimer = nil
+	}
+}
+
+// throttleRead waits until the points and bytes read are allowed by the limits
+func (job *Job) throttleRead(points, bytes int) error {
+	return job.throttle(&job.readPoints, float64(points), &job.readBytes, float64(bytes))
+}
+
+// throttleWrite waits until the points and bytes written are allowed by the limits
+func (job *Job) throttleWrite(points, bytes int) error {
+	return job.throttle(&job.writePoints, float64(points), &job.writeBytes, float64(bytes))
+}
+
+func (job *Job) throttle(pt *throttle, points float64, bt *throttle, bytes float64) error {
+	for _, t := range []struct {
+		throttle *throttle
+		cost     float64
+	}{{pt, points}, {bt, bytes}} {
+		for {
+			d := t.throttle.reserve(t.cost)
+			if d == 0 {
+				break
+			}
+			// the wait is split so that the paused or cancelled job and the changed limits are noticed
+			if d > time.Second {
+				d = time.Second
+			}
+			time.Sleep(d)
+			if err := job.wait(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Cancel cancels the running or paused job, which isn't resumed after restart, or discards the partial job
+func (job *Job) Cancel() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.Status == JobPartial {
+		job.Status = JobCancelled
+		return job.remove()
+	}
+	if job.Status != JobRunning && job.Status != JobPaused {
+		return ErrJobStopped
+	}
+	job.Status = JobCancelled
+	job.stopResume()
+	job.cond.Broadcast()
+	return nil
+}
+
+// wait blocks while the job is paused, and returns ErrJobCancelled once the job is cancelled
+func (job *Job) wait() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	for job.Status == JobPaused {
+		job.cond.Wait()
+	}
+	if job.Status == JobCancelled {
+		return ErrJobCancelled
+	}
+	return nil
+}
+
+func (job *Job) isCancelled() bool {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.Status == JobCancelled
+}
+
+// finish stops the job with the error of the operation, the cancelled job keeps its status,
+// and the job completed with failed measurements is partial and saved to retry them
+func (job *Job) finish(err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.Status != JobCancelled {
+		switch {
+		case err != nil:
+			job.Status = JobFailed
+		case len(job.Errors) > 0:
+			job.Status = JobPartial
+			job.Error = fmt.Sprintf("%d measurements or backends failed, resume the job to retry them", len(job.Errors))
+		default:
+			job.Status = JobFinished
+		}
+	}
+	if err != nil && err != ErrJobCancelled {
+		job.Error = err.Error()
+	}
+	job.EndTime = time.Now()
+	job.stopResume()
+	job.cond.Broadcast()
+	if job.Status == JobPartial {
+		job.saveOrLog()
+	}
+	if job.logger != nil {
+		job.logger.Close()
+	}
+	close(job.stopped)
+}
+
+// retry runs the partial job again, which skips the completed measurements and retries the failed ones
+func (job *Job) retry() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.Status != JobPartial {
+		return ErrJobNotRetry
+	}
+	job.Status = JobRunning
+	job.Error = ""
+	job.EndTime = time.Time{}
+	job.paused = 0
+	job.health.reset()
+	atomic.StoreInt32(&job.measurementTotal, 0)
+	atomic.StoreInt32(&job.measurementDone, 0)
+	job.stopped = make(chan struct{})
+	job.saveOrLog()
+	return nil
+}
+
+func checkpointKey(be *backend.Backend, db, rp, meas string) string {
+	return fmt.Sprintf("%s,%s,%s,%s", be.Url, db, rp, meas)
+}
+
+// IsDone returns whether the measurement of the retention policy on the backend is completed
+func (job *Job) IsDone(key string) bool {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.Done[key]
+}
+
+// Window returns the time in nanoseconds before which the points of the measurement are copied, or zero if none
+func (job *Job) Window(key string) int64 {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.Windows[key]
+}
+
+// SetWindow checkpoints that the points before the time in nanoseconds are copied
+func (job *Job) SetWindow(key string, ts int64) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.Windows[key] = ts
+	job.saveInterval()
+}
+
+// SetDone checkpoints that the measurement is completed
+func (job *Job) SetDone(key string) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.Done[key] = true
+	delete(job.Windows, key)
+	delete(job.Errors, key)
+	job.saveInterval()
+}
+
+// SetError records the error of the measurement or the backend, which makes the job partial once it completes,
+// and is retried when the partial job is resumed
+func (job *Job) SetError(key string, err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.Errors[key] = err.Error()
+	job.saveInterval()
+}
+
+// clearError removes the error recorded before, which is being retried
+func (job *Job) clearError(key string) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	delete(job.Errors, key)
+}
+
+func (job *Job) addMeasurements(total int32) {
+	atomic.AddInt32(&job.measurementTotal, total)
+}
+
+func (job *Job) measurementCompleted() {
+	atomic.AddInt32(&job.measurementDone, 1)
+}
+
+func (job *Job) saveInterval() {
+	if time.Since(job.saved) >= jobSaveInterval {
+		job.saveOrLog()
+	}
+}
+
+func (job *Job) saveOrLog() {
+	if err := job.save(); err != nil {
+		job.tlog.Printf("save job error: %s, job: %s", err, job.Id)
+	}
+}
+
+func (job *Job) Save() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.save()
+}
+
+func (job *Job) save() error {
+	if job.Id == "" || job.filename == "" {
+		return ErrJobNoFile
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err = util.MakeDir(filepath.Dir(job.filename)); err != nil {
+		return err
+	}
+	tmp := job.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	job.saved = time.Now()
+	return os.Rename(tmp, job.filename)
+}
+
+func (job *Job) Remove() error {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.remove()
+}
+
+func (job *Job) remove() error {
+	err := os.Remove(job.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// JobInfo is the state of the job reported by the api, the errors of the measurements are only reported in detail
+type JobInfo struct {
+	Id               string                 `json:"id"` // nolint:golint
+	Type             string                 `json:"type"`
+	Status           string                 `json:"status"`
+	Params           map[string]interface{} `json:"params"`
+	StartTime        time.Time              `json:"start_time"`
+	EndTime          *time.Time             `json:"end_time,omitempty"`
+	MeasurementTotal int32                  `json:"measurement_total"`
+	MeasurementDone  int32                  `json:"measurement_done"`
+	Progress         float64                `json:"progress"`
+	ETASeconds       int64                  `json:"eta_seconds,omitempty"`
+	Limits           JobLimits              `json:"limits"`
+	PauseReason      string                 `json:"pause_reason,omitempty"`
+	LatencyMs        int64                  `json:"latency_ms"`
+	ErrorRate        float64                `json:"error_rate"`
+	ErrorCount       int                    `json:"error_count"`
+	Errors           map[string]string      `json:"errors,omitempty"`
+	Error            string                 `json:"error,omitempty"`
+	LogFile          string                 `json:"log_file"`
+}
+
+// Info returns the state of the job, the progress is the ratio of the measurements done, and the eta is
+// estimated by the rate of the measurements done since the job runs, excluding the paused time
+func (job *Job) Info(detail bool) *JobInfo {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	info := &JobInfo{
+		Id:               job.Id,
+		Type:             job.Type,
+		Status:           job.Status,
+		Params:           job.params(),
+		StartTime:        job.StartTime,
+		MeasurementTotal: atomic.LoadInt32(&job.measurementTotal),
+		MeasurementDone:  atomic.LoadInt32(&job.measurementDone),
+		Limits:           job.Limits,
+		PauseReason:      job.PauseReason,
+		LatencyMs:        job.health.latency().Milliseconds(),
+		ErrorRate:        job.health.errorRate(),
+		ErrorCount:       len(job.Errors),
+		Error:            job.Error,
+		LogFile:          job.LogFile,
+	}
+	if !job.EndTime.IsZero() {
+		endTime := job.EndTime
+		info.EndTime = &endTime
+	}
+	if info.MeasurementTotal > 0 {
+		info.Progress = float64(info.MeasurementDone) / float64(info.MeasurementTotal)
+	}
+	if job.Status == JobFinished {
+		info.Progress = 1
+	}
+	if (job.Status == JobRunning || job.Status == JobPaused) && info.MeasurementDone > 0 {
+		elapsed := time.Since(job.runTime) - job.paused
+		if job.Status == JobPaused {
+			elapsed -= time.Since(job.pauseTime)
+		}
+		remaining := info.MeasurementTotal - info.MeasurementDone
+		info.ETASeconds = int64(elapsed.Seconds() * float64(remaining) / float64(info.MeasurementDone))
+	}
+	if detail {
+		info.Errors = make(map[string]string, len(job.Errors))
+		for key, msg := range job.Errors {
+			info.Errors[key] = msg
+		}
+	}
+	return info
+}
+
+// params returns the parameters of the job, the removed backends are reported by urls without the credentials
+func (job *Job) params() map[string]interface{} {
+	params := map[string]interface{}{"worker": job.Worker, "batch": job.Batch, "limit": job.Limit}
+	switch job.Type {
+	case JobRebalance:
+		params["circle_id"] = job.CircleId
+		if len(job.Backends) > 0 {
+			urls := make([]string, len(job.Backends))
+			for i, bkcfg := range job.Backends {
+				urls[i] = bkcfg.Url
+			}
+			params["backends"] = urls
+		}
+	case JobRecovery:
+		params["from_circle_id"] = job.FromCircleId
+		params["to_circle_id"] = job.ToCircleId
+		if len(job.BackendUrls) > 0 {
+			params["backend_urls"] = job.BackendUrls
+		}
+	case JobCleanup:
+		params["circle_id"] = job.CircleId
+	}
+	if len(job.Dbs) > 0 {
+		params["dbs"] = job.Dbs
+	}
+	if len(job.RetentionPolicies) > 0 {
+		params["rps"] = job.RetentionPolicies
+	}
+	if len(job.Measurements) > 0 {
+		params["measurements"] = job.Measurements
+	}
+	if len(job.ExcludeMeasurements) > 0 {
+		params["exclude_measurements"] = job.ExcludeMeasurements
+	}
+	if job.Tick > 0 {
+		params["tick"] = job.Tick
+	}
+	if job.EndTick > 0 {
+		params["end_tick"] = job.EndTick
+	}
+	if len(job.HaAddrs) > 0 {
+		params["ha_addrs"] = job.HaAddrs
+	}
+	return params
+}
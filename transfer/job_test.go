@@ -0,0 +1,482 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+func TestJobPersistence(t *testing.T) {
+	dir := t.TempDir()
+	tests := []*Job{
+		{Type: JobRebalance, Status: JobRunning, CircleId: 1, Backends: []*backend.BackendConfig{{Name: "b3", Url: "http://127.0.0.1:8088"}}, Dbs: []string{"db1"}},
+		{Type: JobRecovery, Status: JobPaused, FromCircleId: 0, ToCircleId: 1, BackendUrls: []string{"http://127.0.0.1:8086"}, PauseReason: "backend error rate 0.60 exceeds 0.50", AutoPaused: true},
+		{Type: JobResync, Status: JobRunning, Tick: 100, EndTick: 200, Measurements: []string{"^cpu"}, ExcludeMeasurements: []string{"_tmp$"}, RetentionPolicies: []string{"autogen"}},
+		{Type: JobCleanup, Status: JobRunning, CircleId: 0, Limits: JobLimits{WritePointsPerSecond: 100, MaxErrorRate: 0.5}, HaAddrs: []string{"127.0.0.1:7077"}},
+	}
+	for i, job := range tests {
+		job.Id = newJobId(job.Type)
+		job.Worker, job.Batch, job.Limit = i+1, 100*(i+1), 1000*(i+1)
+		job.StartTime = time.Now().Round(0)
+		job.init(filepath.Join(dir, job.Id+".json"))
+		job.openLog("")
+		job.SetDone("http://127.0.0.1:8086,db1,autogen,cpu")
+		job.SetWindow("http://127.0.0.1:8086,db1,autogen,mem", 1e9)
+		job.SetError("http://127.0.0.1:8086,db1,autogen,disk", errors.New("write error"))
+		if err := job.Save(); err != nil {
+			t.Fatalf("%s: save error: %s", job.Type, err)
+		}
+		loaded, err := loadJob(job.filename)
+		if err != nil {
+			t.Fatalf("%s: load error: %s", job.Type, err)
+		}
+		b1, _ := json.Marshal(job)
+		b2, _ := json.Marshal(loaded)
+		if string(b1) != string(b2) {
+			t.Errorf("%s: loaded job = %s, want %s", job.Type, b2, b1)
+		}
+		if loaded.filename != job.filename || loaded.cond == nil || loaded.stopped == nil {
+			t.Errorf("%s: loaded job isn't initialized", job.Type)
+		}
+		if loaded.writePoints.rate != job.Limits.WritePointsPerSecond {
+			t.Errorf("%s: write points rate = %g, want %g", job.Type, loaded.writePoints.rate, job.Limits.WritePointsPerSecond)
+		}
+		if err = loaded.Remove(); err != nil {
+			t.Errorf("%s: remove error: %s", job.Type, err)
+		}
+		if _, err = os.Stat(job.filename); !os.IsNotExist(err) {
+			t.Errorf("%s: file isn't removed", job.Type)
+		}
+		if err = loaded.Remove(); err != nil {
+			t.Errorf("%s: remove again error: %s", job.Type, err)
+		}
+	}
+}
+
+func TestLoadJob(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	tests := []struct {
+		name     string
+		filename string
+		hasError bool
+	}{
+		{name: "missing", filename: filepath.Join(dir, "missing.json"), hasError: true},
+		{name: "invalid json", filename: write("invalid.json", "{"), hasError: true},
+		{name: "no checkpoints", filename: write("empty.json", `{"id":"resync-1","type":"resync","status":"running"}`)},
+	}
+	for _, tt := range tests {
+		job, err := loadJob(tt.filename)
+		if (err != nil) != tt.hasError {
+			t.Errorf("%s: error = %v, hasError %v", tt.name, err, tt.hasError)
+			continue
+		}
+		if err == nil && (job.Done == nil || job.Windows == nil || job.Errors == nil) {
+			t.Errorf("%s: checkpoints aren't initialized", tt.name)
+		}
+	}
+}
+
+func TestJobCheckpoints(t *testing.T) {
+	saveInterval := jobSaveInterval
+	jobSaveInterval = time.Hour
+	defer func() { jobSaveInterval = saveInterval }()
+
+	job := newTestJob(t, JobResync)
+	if err := job.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// the checkpoints within the save interval are saved later
+	job.SetWindow("k1", 10)
+	if loaded, _ := loadJob(job.filename); loaded.Window("k1") != 0 {
+		t.Error("window saved within the save interval")
+	}
+	job.saved = time.Time{}
+	job.SetWindow("k1", 20)
+	job.SetError("k1", errors.New("write error"))
+	job.SetWindow("k2", 30)
+	job.saved = time.Time{}
+	job.SetDone("k2")
+
+	loaded, err := loadJob(job.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    string
+		done   bool
+		window int64
+		err    string
+	}{
+		{key: "k1", window: 20, err: "write error"},
+		// the done measurement has no window and error
+		{key: "k2", done: true},
+		{key: "k3"},
+	}
+	for _, tt := range tests {
+		if done, window := loaded.IsDone(tt.key), loaded.Window(tt.key); done != tt.done || window != tt.window || loaded.Errors[tt.key] != tt.err {
+			t.Errorf("%s: done = %t, window = %d, error = %q, want %t, %d, %q", tt.key, done, window, loaded.Errors[tt.key], tt.done, tt.window, tt.err)
+		}
+	}
+}
+
+func TestValidJob(t *testing.T) {
+	tx := &Transfer{CircleStates: make([]*CircleState, 2)}
+	tests := []struct {
+		name  string
+		job   *Job
+		valid bool
+	}{
+		{name: "rebalance", job: &Job{Id: "1", Type: JobRebalance, Status: JobRunning, CircleId: 1}, valid: true},
+		{name: "rebalance circle out of range", job: &Job{Id: "1", Type: JobRebalance, Status: JobRunning, CircleId: 2}},
+		{name: "cleanup paused", job: &Job{Id: "1", Type: JobCleanup, Status: JobPaused, CircleId: 0}, valid: true},
+		{name: "cleanup negative circle", job: &Job{Id: "1", Type: JobCleanup, Status: JobRunning, CircleId: -1}},
+		{name: "recovery", job: &Job{Id: "1", Type: JobRecovery, Status: JobRunning, FromCircleId: 0, ToCircleId: 1}, valid: true},
+		{name: "recovery same circle", job: &Job{Id: "1", Type: JobRecovery, Status: JobRunning, FromCircleId: 1, ToCircleId: 1}},
+		{name: "resync", job: &Job{Id: "1", Type: JobResync, Status: JobRunning}, valid: true},
+		{name: "no id", job: &Job{Type: JobResync, Status: JobRunning}},
+		{name: "partial", job: &Job{Id: "1", Type: JobResync, Status: JobPartial}, valid: true},
+		{name: "finished", job: &Job{Id: "1", Type: JobResync, Status: JobFinished}},
+		{name: "cancelled", job: &Job{Id: "1", Type: JobResync, Status: JobCancelled}},
+		{name: "unknown type", job: &Job{Id: "1", Type: "compact", Status: JobRunning}},
+	}
+	for _, tt := range tests {
+		if valid := tx.validJob(tt.job); valid != tt.valid {
+			t.Errorf("%s: valid = %t, want %t", tt.name, valid, tt.valid)
+		}
+	}
+}
+
+func TestTransferResume(t *testing.T) {
+	dir := t.TempDir()
+	tx := &Transfer{jobDir: dir, jobs: make(map[string]*Job)}
+	save := func(job *Job) *Job {
+		job.Id = newJobId(job.Type)
+		job.init(filepath.Join(dir, job.Id+".json"))
+		if err := job.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	resumed := save(&Job{Type: JobResync, Status: JobPaused, Done: map[string]bool{"k1": true}, Windows: map[string]int64{"k2": 20}})
+	removed := []*Job{
+		save(&Job{Type: JobResync, Status: JobFinished}),
+		save(&Job{Type: JobRebalance, Status: JobRunning, CircleId: 1}),
+		save(&Job{Type: JobResync, Status: JobRunning, Measurements: []string{"("}}),
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tx.Resume()
+	jobs := tx.Jobs()
+	if len(jobs) != 1 || jobs[0].Id != resumed.Id {
+		t.Fatalf("resumed jobs = %d, want %s", len(jobs), resumed.Id)
+	}
+	job := jobs[0]
+	if !job.IsDone("k1") || job.Window("k2") != 20 {
+		t.Errorf("checkpoints aren't resumed: done = %v, windows = %v", job.Done, job.Windows)
+	}
+	for _, rj := range removed {
+		if _, err := os.Stat(rj.filename); !os.IsNotExist(err) {
+			t.Errorf("invalid job %s isn't removed", rj.Id)
+		}
+	}
+	// the job without databases to transfer is stopped at once
+	select {
+	case <-job.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job isn't stopped")
+	}
+	if _, err := os.Stat(resumed.filename); !os.IsNotExist(err) {
+		t.Error("stopped job isn't removed")
+	}
+}
+
+func TestJobSaveWithoutFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		id       string
+		filename string
+	}{
+		{name: "no id", filename: filepath.Join(dir, "job.json")},
+		{name: "no file", id: "rebalance-1"},
+		{name: "neither"},
+	}
+	for _, tt := range tests {
+		job := NewJob(JobRebalance)
+		job.Id = tt.id
+		job.init(tt.filename)
+		if err := job.Save(); err != ErrJobNoFile {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, ErrJobNoFile)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) > 0 {
+		t.Errorf("files saved: %v", matches)
+	}
+}
+
+func TestJobStateTransitions(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		auto   bool
+		op     func(job *Job) error
+		err    error
+		want   string
+	}{
+		{name: "pause running", status: JobRunning, op: (*Job).Pause, want: JobPaused},
+		{name: "pause paused", status: JobPaused, op: (*Job).Pause, want: JobPaused},
+		{name: "pause auto paused", status: JobPaused, auto: true, op: (*Job).Pause, want: JobPaused},
+		{name: "pause cancelled", status: JobCancelled, op: (*Job).Pause, err: ErrJobStopped, want: JobCancelled},
+		{name: "pause finished", status: JobFinished, op: (*Job).Pause, err: ErrJobStopped, want: JobFinished},
+		{name: "resume paused", status: JobPaused, op: (*Job).Resume, want: JobRunning},
+		{name: "resume auto paused", status: JobPaused, auto: true, op: (*Job).Resume, want: JobRunning},
+		{name: "resume running", status: JobRunning, op: (*Job).Resume, err: ErrJobNotPaused, want: JobRunning},
+		{name: "resume failed", status: JobFailed, op: (*Job).Resume, err: ErrJobStopped, want: JobFailed},
+		{name: "cancel running", status: JobRunning, op: (*Job).Cancel, want: JobCancelled},
+		{name: "cancel paused", status: JobPaused, op: (*Job).Cancel, want: JobCancelled},
+		{name: "cancel cancelled", status: JobCancelled, op: (*Job).Cancel, err: ErrJobStopped, want: JobCancelled},
+		{name: "cancel finished", status: JobFinished, op: (*Job).Cancel, err: ErrJobStopped, want: JobFinished},
+		{name: "set limits paused", status: JobPaused, op: func(job *Job) error { return job.SetLimits(JobLimits{}) }, want: JobPaused},
+		{name: "set limits finished", status: JobFinished, op: func(job *Job) error { return job.SetLimits(JobLimits{}) }, err: ErrJobStopped, want: JobFinished},
+	}
+	for _, tt := range tests {
+		job := newTestJob(t, JobResync)
+		job.Status = tt.status
+		job.AutoPaused = tt.auto
+		if tt.auto {
+			job.PauseReason = "backend latency 2s exceeds 1s"
+		}
+		if err := tt.op(job); err != tt.err {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+		if job.Status != tt.want {
+			t.Errorf("%s: status = %s, want %s", tt.name, job.Status, tt.want)
+		}
+		// the job paused or resumed by the user isn't resumed automatically
+		if tt.auto && tt.err == nil && (job.AutoPaused || job.PauseReason != "") {
+			t.Errorf("%s: auto paused = %t, reason = %q", tt.name, job.AutoPaused, job.PauseReason)
+		}
+	}
+}
+
+func TestJobWait(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(job *Job) error
+		err  error
+	}{
+		{name: "resumed", op: (*Job).Resume},
+		{name: "cancelled", op: (*Job).Cancel, err: ErrJobCancelled},
+	}
+	for _, tt := range tests {
+		job := newTestJob(t, JobResync)
+		if err := job.Pause(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- job.wait() }()
+		select {
+		case err := <-done:
+			t.Fatalf("%s: wait returns while paused: %v", tt.name, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if err := tt.op(job); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			if err != tt.err {
+				t.Errorf("%s: wait error = %v, want %v", tt.name, err, tt.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: wait isn't returned", tt.name)
+		}
+	}
+}
+
+func TestJobFinish(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel bool
+		failed bool
+		err    error
+		status string
+		msg    string
+	}{
+		{name: "finished", status: JobFinished},
+		{name: "failed", err: errors.New("query error"), status: JobFailed, msg: "query error"},
+		{name: "partial", failed: true, status: JobPartial, msg: "1 measurements or backends failed, resume the job to retry them"},
+		{name: "cancelled", cancel: true, err: ErrJobCancelled, status: JobCancelled},
+	}
+	for _, tt := range tests {
+		job := newTestJob(t, JobResync)
+		if tt.cancel {
+			job.Cancel()
+		}
+		if tt.failed {
+			job.SetError("url,db,rp,cpu", errors.New("write error"))
+		}
+		job.finish(tt.err)
+		info := job.Info(false)
+		if info.Status != tt.status || info.Error != tt.msg || info.EndTime == nil {
+			t.Errorf("%s: status = %s, error = %q, end time %v, want %s, %q", tt.name, info.Status, info.Error, info.EndTime, tt.status, tt.msg)
+		}
+		select {
+		case <-job.Stopped():
+		default:
+			t.Errorf("%s: stopped isn't closed", tt.name)
+		}
+		if err := job.wait(); tt.cancel != (err == ErrJobCancelled) {
+			t.Errorf("%s: wait error = %v", tt.name, err)
+		}
+	}
+}
+
+// autoPause pauses the job by the failed backend requests over the error rate limit
+func autoPause(job *Job) {
+	for i := 0; i < HealthSamples; i++ {
+		job.observe(time.Millisecond, errors.New("failed"))
+	}
+}
+
+func (job *Job) status() (string, bool) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.Status, job.resumeTimer != nil
+}
+
+func TestJobAutoResume(t *testing.T) {
+	interval := AutoResumeInterval
+	AutoResumeInterval = 200 * time.Millisecond
+	defer func() { AutoResumeInterval = interval }()
+
+	job := newTestJob(t, JobResync)
+	job.Limits.MaxErrorRate = 0.5
+	autoPause(job)
+	if status, scheduled := job.status(); status != JobPaused || !scheduled {
+		t.Fatalf("status = %s, scheduled %t, want paused and scheduled", status, scheduled)
+	}
+
+	// the timer of the pause resumed by the user doesn't resume the next pause early
+	time.Sleep(100 * time.Millisecond)
+	if err := job.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if _, scheduled := job.status(); scheduled {
+		t.Error("timer should be stopped after resumed")
+	}
+	autoPause(job)
+	time.Sleep(150 * time.Millisecond)
+	if status, _ := job.status(); status != JobPaused {
+		t.Errorf("status = %s, want paused by the latest pause", status)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if status, scheduled := job.status(); status != JobRunning || scheduled {
+		t.Errorf("status = %s, scheduled %t, want resumed", status, scheduled)
+	}
+
+	// the cancelled job isn't resumed
+	autoPause(job)
+	if err := job.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if status, scheduled := job.status(); status != JobCancelled || scheduled {
+		t.Errorf("status = %s, scheduled %t, want cancelled without timer", status, scheduled)
+	}
+}
+
+func TestJobPartial(t *testing.T) {
+	be := newTestBackend(t, "inactive", http.StatusInternalServerError)
+	for begin := time.Now(); be.IsActive(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(begin) > 5*time.Second {
+			t.Fatal("backend isn't inactive")
+		}
+	}
+
+	// the inactive backend is recorded as error, so that the job completed is partial instead of finished
+	job := newTestJob(t, JobResync)
+	cs := &CircleState{Stats: map[string]*Stats{}}
+	cs.wg.Add(1)
+	(&Transfer{}).runTransfer(job, cs, be, []string{"db"}, nil)
+	if msg := job.Info(true).Errors[be.Url]; msg != ErrBackendInactive.Error() {
+		t.Errorf("error of inactive backend = %q, want %q", msg, ErrBackendInactive)
+	}
+	job.finish(nil)
+	if st := job.Info(false).Status; st != JobPartial {
+		t.Fatalf("status = %s, want %s", st, JobPartial)
+	}
+	if _, err := os.Stat(job.filename); err != nil {
+		t.Errorf("partial job isn't saved: %s", err)
+	}
+	if err := job.Resume(); err != ErrJobStopped {
+		t.Errorf("resume error = %v, want %v", err, ErrJobStopped)
+	}
+	if err := job.Cancel(); err != nil || job.Info(false).Status != JobCancelled {
+		t.Errorf("cancel error = %v, status = %s", err, job.Info(false).Status)
+	}
+	if _, err := os.Stat(job.filename); !os.IsNotExist(err) {
+		t.Error("cancelled partial job isn't removed")
+	}
+}
+
+func TestTransferRetry(t *testing.T) {
+	a := newTestBackendConfig(t, "a", &testSchema{
+		dbs:          []string{"db1"},
+		rps:          map[string][]string{"db1": {"autogen"}},
+		measurements: map[string][]string{"db1": {"cpu"}},
+	})
+	tx := newTestTransfer(t, []*backend.BackendConfig{a})
+
+	// the partial job is listed after restart without running
+	job := &Job{Type: JobResync, Status: JobPartial, Worker: 1, Batch: 1, Limit: 1, Errors: map[string]string{a.Url: ErrBackendInactive.Error()}}
+	job.Id = newJobId(job.Type)
+	job.init(filepath.Join(tx.jobDir, job.Id+".json"))
+	if err := job.Save(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Resume()
+	jobs := tx.Jobs()
+	if len(jobs) != 1 || jobs[0].Info(false).Status != JobPartial {
+		t.Fatalf("jobs = %d, want the partial job", len(jobs))
+	}
+	job = jobs[0]
+
+	// the partial job is run again, and the backend active now completes it
+	if err := tx.ResumeJob(job); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-job.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job isn't stopped")
+	}
+	if info := job.Info(true); info.Status != JobFinished || len(info.Errors) > 0 || info.Error != "" {
+		t.Errorf("status = %s, errors = %v, error = %q, want finished", info.Status, info.Errors, info.Error)
+	}
+	if _, err := os.Stat(job.filename); !os.IsNotExist(err) {
+		t.Error("finished job isn't removed")
+	}
+	if err := tx.ResumeJob(job); err != ErrJobStopped {
+		t.Errorf("resume finished job error = %v, want %v", err, ErrJobStopped)
+	}
+}
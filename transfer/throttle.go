@@ -0,0 +1,118 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// HealthSamples is the number of the latest backend requests to check the latency and error rate
+	HealthSamples = 20
+	// AutoResumeInterval is the interval to resume the job paused by the unhealthy backends
+	AutoResumeInterval = time.Minute
+)
+
+// JobLimits throttles the reads and writes of the job, and pauses the job automatically when the average
+// latency or the error rate of the latest backend requests exceeds the threshold, the zero values mean unlimited
+type JobLimits struct {
+	ReadPointsPerSecond  float64 `json:"read_points_per_second"`
+	ReadBytesPerSecond   float64 `json:"read_bytes_per_second"`
+	WritePointsPerSecond float64 `json:"write_points_per_second"`
+	WriteBytesPerSecond  float64 `json:"write_bytes_per_second"`
+	MaxLatencyMs         int64   `json:"max_latency_ms"`
+	MaxErrorRate         float64 `json:"max_error_rate"`
+}
+
+// throttle is a token bucket whose capacity is the rate of one second, the request larger than the capacity
+// is allowed once the bucket is full and leaves the bucket in debt, the zero rate means unlimited
+type throttle struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (t *throttle) setRate(rate float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.rate <= 0 || t.tokens > rate {
+		t.tokens = rate
+	}
+	t.rate = rate
+	t.last = time.Now()
+}
+
+// reserve takes the tokens of the cost and returns zero, or returns the duration to wait for the tokens
+func (t *throttle) reserve(cost float64) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	t.tokens = math.Min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	need := math.Min(cost, t.rate)
+	if t.tokens >= need {
+		t.tokens -= cost
+		return 0
+	}
+	return time.Duration((need - t.tokens) / t.rate * float64(time.Second))
+}
+
+// health keeps the latency and the result of the latest backend requests
+type health struct {
+	latencies []time.Duration
+	failures  []bool
+	next      int
+}
+
+func (h *health) add(latency time.Duration, failed bool) {
+	if len(h.latencies) < HealthSamples {
+		h.latencies = append(h.latencies, latency)
+		h.failures = append(h.failures, failed)
+		return
+	}
+	h.latencies[h.next] = latency
+	h.failures[h.next] = failed
+	h.next = (h.next + 1) % len(h.latencies)
+}
+
+func (h *health) reset() {
+	h.latencies = h.latencies[:0]
+	h.failures = h.failures[:0]
+	h.next = 0
+}
+
+func (h *health) full() bool {
+	return len(h.latencies) >= HealthSamples
+}
+
+func (h *health) latency() time.Duration {
+	if len(h.latencies) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, latency := range h.latencies {
+		sum += latency
+	}
+	return sum / time.Duration(len(h.latencies))
+}
+
+func (h *health) errorRate() float64 {
+	if len(h.failures) == 0 {
+		return 0
+	}
+	n := 0
+	for _, failed := range h.failures {
+		if failed {
+			n++
+		}
+	}
+	return float64(n) / float64(len(h.failures))
+}
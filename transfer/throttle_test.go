@@ -0,0 +1,141 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestThrottleReserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		tokens  float64
+		elapsed time.Duration
+		cost    float64
+		wait    time.Duration
+		left    float64
+	}{
+		{name: "unlimited", rate: 0, cost: 1000},
+		{name: "allowed", rate: 100, tokens: 100, cost: 30, left: 70},
+		{name: "wait for tokens", rate: 100, tokens: 70, cost: 80, wait: 100 * time.Millisecond, left: 70},
+		{name: "refilled", rate: 100, tokens: 0, elapsed: 500 * time.Millisecond, cost: 40, left: 10},
+		{name: "refill is capped", rate: 100, tokens: 50, elapsed: time.Hour, cost: 10, left: 90},
+		// the cost over the rate is allowed once the bucket is full, and the debt is paid by the next ones
+		{name: "debt", rate: 100, tokens: 100, cost: 150, left: -50},
+		{name: "wait for debt", rate: 100, tokens: -50, cost: 10, wait: 600 * time.Millisecond, left: -50},
+		{name: "wait for full bucket", rate: 100, tokens: 50, cost: 150, wait: 500 * time.Millisecond, left: 50},
+	}
+	for _, tt := range tests {
+		th := &throttle{rate: tt.rate, tokens: tt.tokens, last: time.Now().Add(-tt.elapsed)}
+		wait := th.reserve(tt.cost)
+		if d := wait - tt.wait; d < -10*time.Millisecond || d > 10*time.Millisecond {
+			t.Errorf("%s: wait = %s, want %s", tt.name, wait, tt.wait)
+		}
+		if tt.rate > 0 && math.Abs(th.tokens-tt.left) > 1 {
+			t.Errorf("%s: tokens = %g, want %g", tt.name, th.tokens, tt.left)
+		}
+	}
+}
+
+func TestThrottleSetRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   float64
+		tokens float64
+		set    float64
+		want   float64
+	}{
+		{name: "limited", rate: 0, tokens: 0, set: 100, want: 100},
+		{name: "lowered", rate: 100, tokens: 80, set: 50, want: 50},
+		{name: "raised", rate: 100, tokens: 80, set: 200, want: 80},
+		{name: "debt kept", rate: 100, tokens: -50, set: 200, want: -50},
+	}
+	for _, tt := range tests {
+		th := &throttle{rate: tt.rate, tokens: tt.tokens}
+		th.setRate(tt.set)
+		if th.rate != tt.set || th.tokens != tt.want {
+			t.Errorf("%s: rate = %g, tokens = %g, want %g, %g", tt.name, th.rate, th.tokens, tt.set, tt.want)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	samples := HealthSamples
+	HealthSamples = 4
+	defer func() { HealthSamples = samples }()
+
+	type sample struct {
+		latency time.Duration
+		failed  bool
+	}
+	tests := []struct {
+		name      string
+		samples   []sample
+		full      bool
+		latency   time.Duration
+		errorRate float64
+	}{
+		{name: "empty"},
+		{name: "not full", samples: []sample{{10 * time.Millisecond, false}, {30 * time.Millisecond, true}}, latency: 20 * time.Millisecond, errorRate: 0.5},
+		{name: "full", samples: []sample{{10 * time.Millisecond, true}, {10 * time.Millisecond, false}, {10 * time.Millisecond, false}, {30 * time.Millisecond, false}}, full: true, latency: 15 * time.Millisecond, errorRate: 0.25},
+		{
+			// the oldest samples are replaced by the latest ones
+			name: "ring",
+			samples: []sample{
+				{100 * time.Millisecond, true}, {100 * time.Millisecond, true}, {10 * time.Millisecond, false}, {10 * time.Millisecond, false},
+				{10 * time.Millisecond, false}, {10 * time.Millisecond, true},
+			},
+			full:      true,
+			latency:   10 * time.Millisecond,
+			errorRate: 0.25,
+		},
+	}
+	for _, tt := range tests {
+		var h health
+		for _, s := range tt.samples {
+			h.add(s.latency, s.failed)
+		}
+		if h.full() != tt.full || h.latency() != tt.latency || h.errorRate() != tt.errorRate {
+			t.Errorf("%s: full = %t, latency = %s, error rate = %g, want %t, %s, %g", tt.name, h.full(), h.latency(), h.errorRate(), tt.full, tt.latency, tt.errorRate)
+		}
+		h.reset()
+		if h.full() || h.latency() != 0 || h.errorRate() != 0 {
+			t.Errorf("%s: health isn't reset", tt.name)
+		}
+	}
+}
+
+func TestJobThrottle(t *testing.T) {
+	job := newTestJob(t, JobResync)
+	if err := job.SetLimits(JobLimits{WritePointsPerSecond: 100}); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := job.throttleWrite(50, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 150 points are written by 100 points per second, and the bytes are unlimited
+	if elapsed := time.Since(begin); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("elapsed = %s, want about 500ms", elapsed)
+	}
+
+	// the throttled job is cancelled while waiting
+	if err := job.SetLimits(JobLimits{WritePointsPerSecond: 1}); err != nil {
+		t.Fatal(err)
+	}
+	job.throttleWrite(1, 0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		job.Cancel()
+	}()
+	if err := job.throttleWrite(1, 0); err != ErrJobCancelled {
+		t.Errorf("error = %v, want %v", err, ErrJobCancelled)
+	}
+}
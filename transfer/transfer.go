@@ -6,10 +6,10 @@ package transfer
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -20,7 +20,6 @@ import (
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
 	"github.com/panjf2000/ants/v2"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
@@ -30,11 +29,15 @@ var (
 	DefaultWorker = 1
 	DefaultBatch  = 25000
 	DefaultLimit  = 1000000
-	tlog          = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	// MaxJobHistory is the maximum number of the stopped jobs kept to be listed
+	MaxJobHistory = 100
 )
 
+// QueryResult is the points of a window, or of a page of the window, End is the end of the window
+// to checkpoint after the points are written, or zero if more pages of the window follow
 type QueryResult struct {
 	Series models.Rows
+	End    int64
 	Err    error
 }
 
@@ -43,68 +46,260 @@ type Transfer struct {
 	password     string
 	authEncrypt  bool
 	httpsEnabled bool
+	peerTLS      *tls.Config
 
-	pool         *ants.Pool
 	tlogDir      string
+	jobDir       string
+	jobs         map[string]*Job
+	jobIds       []string
+	lock         sync.Mutex
 	CircleStates []*CircleState
-	Worker       int
-	Batch        int
-	Limit        int
 	Resyncing    bool
-	HaAddrs      []string
 }
 
-func NewTransfer(cfg *backend.ProxyConfig, circles []*backend.Circle) (tx *Transfer) {
+func NewTransfer(cfg *backend.ProxyConfig, circles []*backend.Circle) (tx *Transfer, err error) {
 	tx = &Transfer{
+		username:     cfg.Username,
+		password:     cfg.Password,
+		authEncrypt:  cfg.AuthEncrypt,
+		httpsEnabled: cfg.HTTPSEnabled,
 		tlogDir:      cfg.TLogDir,
+		jobDir:       filepath.Join(cfg.DataDir, "transfer"),
+		jobs:         make(map[string]*Job),
 		CircleStates: make([]*CircleState, len(cfg.Circles)),
-		Worker:       DefaultWorker,
-		Batch:        DefaultBatch,
-		Limit:        DefaultLimit,
 	}
 	for idx, circfg := range cfg.Circles {
 		tx.CircleStates[idx] = NewCircleState(circfg, circles[idx])
 	}
+	if tx.httpsEnabled {
+		tx.peerTLS, err = backend.NewPeerTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return
 }
 
-func (tx *Transfer) resetCircleStates() {
-	for _, cs := range tx.CircleStates {
-		cs.ResetStates()
+// Start saves the job and runs it in background, the job conflicts with the running jobs of the same circle,
+// and the resync job conflicts with all the running jobs
+func (tx *Transfer) Start(job *Job) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if err := job.initFilters(); err != nil {
+		return err
 	}
+	if err := tx.checkConflict(job); err != nil {
+		return err
+	}
+	job.Id = newJobId(job.Type)
+	job.Status = JobRunning
+	job.StartTime = time.Now()
+	job.init(filepath.Join(tx.jobDir, job.Id+".json"))
+	tx.addJob(job)
+	if err := job.Save(); err != nil {
+		log.Printf("save transfer job error: %s, job: %s", err, job.Id)
+	}
+	go tx.runJob(job)
+	return nil
 }
 
-func (tx *Transfer) resetBasicParam() {
-	tx.Worker = DefaultWorker
-	tx.Batch = DefaultBatch
-	tx.Limit = DefaultLimit
+func (tx *Transfer) checkConflict(job *Job) error {
+	for _, other := range tx.jobs {
+		if (other.Status == JobRunning || other.Status == JobPaused) && job.conflicts(other) {
+			return fmt.Errorf("%w %s", ErrJobConflict, other.Id)
+		}
+	}
+	return nil
 }
 
-func (tx *Transfer) setLogOutput(name string) {
-	logPath := filepath.Join(tx.tlogDir, name)
-	if logPath == "" {
-		tlog.SetOutput(os.Stdout)
-	} else {
-		util.MakeDir(tx.tlogDir)
-		tlog.SetOutput(&lumberjack.Logger{
-			Filename:   logPath,
-			MaxSize:    100,
-			MaxBackups: 5,
-			MaxAge:     7,
-		})
+// addJob registers the job and removes the oldest stopped jobs over MaxJobHistory
+func (tx *Transfer) addJob(job *Job) {
+	if tx.tlogDir != "" {
+		job.LogFile = filepath.Join(tx.tlogDir, job.Id+".log")
+	}
+	job.openLog(tx.tlogDir)
+	tx.jobs[job.Id] = job
+	tx.jobIds = append(tx.jobIds, job.Id)
+	stopped := 0
+	for _, id := range tx.jobIds {
+		if isStopped(tx.jobs[id].Info(false).Status) {
+			stopped++
+		}
+	}
+	for i := 0; i < len(tx.jobIds) && stopped > MaxJobHistory; {
+		id := tx.jobIds[i]
+		if isStopped(tx.jobs[id].Info(false).Status) {
+			delete(tx.jobs, id)
+			tx.jobIds = append(tx.jobIds[:i], tx.jobIds[i+1:]...)
+			stopped--
+			continue
+		}
+		i++
+	}
+}
+
+// isStopped checks whether the job is stopped and can't be resumed, the partial job is kept to retry
+func isStopped(status string) bool {
+	return status != JobRunning && status != JobPaused && status != JobPartial
+}
+
+// Jobs returns the running, paused and latest stopped jobs in order of start
+func (tx *Transfer) Jobs() []*Job {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	jobs := make([]*Job, len(tx.jobIds))
+	for i, id := range tx.jobIds {
+		jobs[i] = tx.jobs[id]
+	}
+	return jobs
+}
+
+func (tx *Transfer) Job(id string) (*Job, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	job, ok := tx.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// ResumeJob resumes the paused job, or runs the partial job again to retry its failed measurements
+func (tx *Transfer) ResumeJob(job *Job) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if job.Info(false).Status != JobPartial {
+		return job.Resume()
+	}
+	if err := tx.checkConflict(job); err != nil {
+		return err
+	}
+	if err := job.retry(); err != nil {
+		return err
+	}
+	job.openLog(tx.tlogDir)
+	go tx.runJob(job)
+	return nil
+}
+
+// runJob runs the job with its parameters and removes the job file once it's stopped, unless it's partial
+func (tx *Transfer) runJob(job *Job) {
+	job.lock.Lock()
+	job.runTime = time.Now()
+	if job.Status == JobPaused {
+		// the paused time before the restart is not counted
+		job.pauseTime = job.runTime
+		if job.AutoPaused {
+			job.scheduleResume()
+		}
+	}
+	job.lock.Unlock()
+	var err error
+	switch job.Type {
+	case JobRebalance:
+		cs := tx.CircleStates[job.CircleId]
+		for _, bkcfg := range job.Backends {
+			if _, ok := cs.Stats[bkcfg.Url]; !ok {
+				cs.Stats[bkcfg.Url] = &Stats{}
+			}
+		}
+		var backends []*backend.Backend
+		backends, err = tx.rebalanceBackends(job)
+		if err == nil {
+			err = tx.rebalance(job, job.CircleId, backends, job.Dbs)
+		}
+	case JobRecovery:
+		err = tx.recovery(job, job.FromCircleId, job.ToCircleId, job.Dbs)
+	case JobResync:
+		err = tx.resync(job, job.Dbs)
+	case JobCleanup:
+		err = tx.cleanup(job, job.CircleId)
+	}
+	job.finish(err)
+	if job.Info(false).Status == JobPartial {
+		log.Printf("transfer job %s stopped with failed measurements, resume it to retry them", job.Id)
+		return
+	}
+	if err := job.Remove(); err != nil {
+		log.Printf("remove transfer job error: %s, job: %s", err, job.Id)
+	}
+}
+
+// Resume runs the jobs interrupted by the last shutdown in background, which skip the completed measurements
+// and continue the measurements in transfer from their checkpoints, the paused jobs keep paused,
+// and the partial jobs are listed until they're resumed to retry the failed measurements
+func (tx *Transfer) Resume() {
+	files, err := filepath.Glob(filepath.Join(tx.jobDir, "*.json"))
+	if err != nil {
+		log.Printf("list transfer jobs error: %s", err)
+		return
+	}
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	for _, file := range files {
+		job, err := loadJob(file)
+		if err != nil {
+			log.Printf("load transfer job error: %s, file: %s", err, file)
+			continue
+		}
+		if !tx.validJob(job) {
+			log.Printf("transfer job %s doesn't match the circles, removed", job.Id)
+			job.Remove()
+			continue
+		}
+		if err = job.initFilters(); err != nil {
+			log.Printf("transfer job %s error: %s, removed", job.Id, err)
+			job.Remove()
+			continue
+		}
+		if job.Status == JobPartial {
+			log.Printf("partial transfer job: %s, started at %s, %d measurements failed", job.Id, job.StartTime.Format(time.RFC3339), len(job.Errors))
+			tx.addJob(job)
+			continue
+		}
+		if err = tx.checkConflict(job); err != nil {
+			log.Printf("transfer job %s error: %s, removed", job.Id, err)
+			job.Remove()
+			continue
+		}
+		log.Printf("resume transfer job: %s, started at %s, %d measurements done", job.Id, job.StartTime.Format(time.RFC3339), len(job.Done))
+		tx.addJob(job)
+		go tx.runJob(job)
+	}
+}
+
+func (tx *Transfer) validJob(job *Job) bool {
+	valid := func(circleId int) bool { // nolint:golint
+		return circleId >= 0 && circleId < len(tx.CircleStates)
+	}
+	if job.Id == "" || isStopped(job.Status) {
+		return false
 	}
+	switch job.Type {
+	case JobRebalance, JobCleanup:
+		return valid(job.CircleId)
+	case JobRecovery:
+		return valid(job.FromCircleId) && valid(job.ToCircleId) && job.FromCircleId != job.ToCircleId
+	case JobResync:
+		return true
+	}
+	return false
 }
 
-func (tx *Transfer) getRetentionPolicies(db string) []string {
-	rps := make([]string, 0)
+func (tx *Transfer) getRetentionPolicies(db string) []*backend.RetentionPolicy {
+	rps := make([]*backend.RetentionPolicy, 0)
 	rpm := make(map[string]bool)
 	for _, cs := range tx.CircleStates {
 		for _, be := range cs.Backends {
 			if be.IsActive() {
-				for _, rp := range be.GetRetentionPolicies(db) {
-					if _, ok := rpm[rp]; !ok {
+				details, err := be.GetRetentionPolicyDetails(db)
+				if err != nil {
+					continue
+				}
+				for _, rp := range details {
+					if _, ok := rpm[rp.Name]; !ok {
 						rps = append(rps, rp)
-						rpm[rp] = true
+						rpm[rp.Name] = true
 					}
 				}
 			}
@@ -131,7 +326,7 @@ func (tx *Transfer) getDatabases() []string {
 	return dbs
 }
 
-func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
+func (tx *Transfer) createDatabases(job *Job, dbs []string) ([]string, error) {
 	if len(dbs) == 0 {
 		dbs = tx.getDatabases()
 	}
@@ -146,23 +341,30 @@ func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
 			req := backend.NewQueryRequest("POST", "", q, "")
 			_, _, err := backend.QueryInParallel(backends, req, nil, false)
 			if err != nil {
-				tlog.Printf("create databases error: %s, db: %s, dbs: %v", err, db, dbs)
+				job.tlog.Printf("create databases error: %s, db: %s, dbs: %v", err, db, dbs)
 				return dbs, err
 			}
 			// create retention policy
+			// create retention policy with the real duration, shard duration, replication and default flag,
+			// the autogen created with database is altered since it can't be created again
 			rps := tx.getRetentionPolicies(db)
-			tlog.Printf("create retention policy, db: %s, rps: %v", db, rps)
 			for _, rp := range rps {
-				q = fmt.Sprintf("create retention policy \"%s\" on \"%s\" duration 0s replication 1", util.EscapeIdentifier(rp), util.EscapeIdentifier(db))
+				job.tlog.Printf("create retention policy, db: %s, rp: %+v", db, *rp)
+				q = backend.RetentionPolicyStatement("create", db, rp)
 				req = backend.NewQueryRequest("POST", "", q, "")
 				_, _, err = backend.QueryInParallel(backends, req, nil, false)
 				if err != nil {
-					tlog.Printf("create retention policy error: %s, db: %s, rp: %s", err, db, rp)
+					q = backend.RetentionPolicyStatement("alter", db, rp)
+					req = backend.NewQueryRequest("POST", "", q, "")
+					_, _, err = backend.QueryInParallel(backends, req, nil, false)
+				}
+				if err != nil {
+					job.tlog.Printf("create retention policy error: %s, db: %s, rp: %s", err, db, rp.Name)
 				}
 			}
 		}
 	} else {
-		tlog.Printf("databases are empty in all backends")
+		job.tlog.Printf("databases are empty in all backends")
 	}
 	return dbs, nil
 }
@@ -175,34 +377,13 @@ func getBackendUrls(backends []*backend.Backend) []string {
 	return backendUrls
 }
 
-func reformFieldKeys(fieldKeys map[string][]string) map[string]string {
-	// The SELECT statement returns all field values if all values have the same type.
-	// If field value types differ across shards, InfluxDB first performs any applicable cast operations and
-	// then returns all values with the type that occurs first in the following list: float, integer, string, boolean.
-	fieldSet := make(map[string]util.Set, len(fieldKeys))
-	for field, types := range fieldKeys {
-		fieldSet[field] = util.NewSetFromSlice(types)
-	}
-	fieldMap := make(map[string]string, len(fieldKeys))
-	for field, types := range fieldKeys {
-		if len(types) == 1 {
-			fieldMap[field] = types[0]
-		} else {
-			for _, dt := range FieldTypes {
-				if fieldSet[field][dt] {
-					fieldMap[field] = dt
-					break
-				}
-			}
-		}
-	}
-	return fieldMap
-}
-
-func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, rp, meas string, tagMap util.Set, fieldMap map[string]string) error {
+func (tx *Transfer) write(job *Job, key string, ch chan *QueryResult, dsts []*backend.Backend, db, rp, meas string, cols []*backend.Column) error {
 	var buf bytes.Buffer
 	var wg sync.WaitGroup
-	pool, err := ants.NewPool(len(dsts) * 20)
+	var lock sync.Mutex
+	var werr error
+	// one batch is written to each destination at a time
+	pool, err := ants.NewPool(len(dsts))
 	if err != nil {
 		return err
 	}
@@ -211,161 +392,306 @@ func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, rp,
 		if qr.Err != nil {
 			return qr.Err
 		}
-		serie := qr.Series[0]
-		columns := serie.Columns
-		valen := len(serie.Values)
-		for idx, value := range serie.Values {
-			mtagSet := []string{util.EscapeMeasurement(meas)}
-			fieldSet := make([]string, 0)
-			for i := 1; i < len(value); i++ {
-				k := columns[i]
-				v := value[i]
-				if tagMap[k] {
-					if v != nil {
-						mtagSet = append(mtagSet, fmt.Sprintf("%s=%s", util.EscapeTag(k), util.EscapeTag(util.CastString(v))))
-					}
-				} else if vtype, ok := fieldMap[k]; ok {
-					if v != nil {
-						if vtype == "float" || vtype == "boolean" {
-							fieldSet = append(fieldSet, fmt.Sprintf("%s=%v", util.EscapeTag(k), v))
-						} else if vtype == "integer" {
-							fieldSet = append(fieldSet, fmt.Sprintf("%s=%vi", util.EscapeTag(k), v))
-						} else if vtype == "string" {
-							fieldSet = append(fieldSet, fmt.Sprintf("%s=\"%s\"", util.EscapeTag(k), models.EscapeStringField(util.CastString(v))))
-						}
-					}
-				}
+		var values [][]interface{}
+		if len(qr.Series) > 0 {
+			values = qr.Series[0].Values
+		}
+		valen := len(values)
+		for idx, value := range values {
+			line := backend.RowToLine(meas, nil, cols, value)
+			if line != "" {
+				buf.WriteString(line)
+				buf.WriteByte('\n')
 			}
-			mtagStr := strings.Join(mtagSet, ",")
-			fieldStr := strings.Join(fieldSet, ",")
-			line := fmt.Sprintf("%s %s %v\n", mtagStr, fieldStr, value[0])
-			buf.WriteString(line)
-			if (idx+1)%tx.Batch == 0 || idx+1 == valen {
+			if (idx+1)%job.Batch == 0 || idx+1 == valen {
 				p := buf.Bytes()
+				points := idx%job.Batch + 1
 				for _, dst := range dsts {
 					dst := dst
 					wg.Add(1)
 					pool.Submit(func() {
 						defer wg.Done()
+						if job.throttleWrite(points, len(p)) != nil {
+							return
+						}
 						var err error
 						for i := 0; i <= RetryCount; i++ {
 							if i > 0 {
 								time.Sleep(time.Duration(RetryInterval) * time.Second)
-								tlog.Printf("transfer write retry: %d, err:%s dst:%s db:%s rp:%s meas:%s", i, err, dst.Url, db, rp, meas)
+								job.tlog.Printf("transfer write retry: %d, err:%s dst:%s db:%s rp:%s meas:%s", i, err, dst.Url, db, rp, meas)
 							}
+							begin := time.Now()
 							err = dst.Write(db, rp, p)
+							job.observe(time.Since(begin), err)
 							if err == nil {
 								break
 							}
 						}
 						if err != nil {
-							tlog.Printf("transfer write error: %s, dst:%s db:%s rp:%s meas:%s", err, dst.Url, db, rp, meas)
+							job.tlog.Printf("transfer write error: %s, dst:%s db:%s rp:%s meas:%s", err, dst.Url, db, rp, meas)
+							lock.Lock()
+							if werr == nil {
+								werr = fmt.Errorf("write to %s error: %w", dst.Url, err)
+							}
+							lock.Unlock()
 						}
 					})
 				}
 				buf = bytes.Buffer{}
 			}
 		}
+		// the window is checkpointed after all its points are written
+		wg.Wait()
+		if job.isCancelled() {
+			return ErrJobCancelled
+		}
+		if werr != nil {
+			return werr
+		}
+		if qr.End > 0 {
+			job.SetWindow(key, qr.End)
+		}
 	}
-	wg.Wait()
 	return nil
 }
 
-func (tx *Transfer) query(ch chan *QueryResult, src *backend.Backend, db, rp, meas string, tick int64) {
+// query walks the measurement in time windows in ascending order within [start, end) in nanoseconds, zero end means unlimited,
+// each window is sized by the point density of the last one, and the window with the limit points is halved
+// and queried again, or paged by offset if it's already the minimum window
+func (tx *Transfer) query(job *Job, ch chan *QueryResult, done chan struct{}, src *backend.Backend, db, rp, meas string, cols []*backend.Column, start, end int64) {
 	defer close(ch)
-	for offset := 0; ; offset += tx.Limit {
-		whereClause := ""
-		if tick > 0 {
-			whereClause = fmt.Sprintf("where time >= %ds", tick)
+	// the query stops once the write returns
+	send := func(qr *QueryResult) bool {
+		select {
+		case ch <- qr:
+			return qr.Err == nil
+		case <-done:
+			return false
 		}
-		q := fmt.Sprintf("select * from \"%s\".\"%s\" %s order by time desc limit %d offset %d", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas), whereClause, tx.Limit, offset)
-		var rsp []byte
-		var err error
-		for i := 0; i <= RetryCount; i++ {
-			if i > 0 {
-				time.Sleep(time.Duration(RetryInterval) * time.Second)
-				tlog.Printf("transfer query retry: %d, err:%s src:%s db:%s rp:%s meas:%s tick:%d limit:%d offset:%d", i, err, src.Url, db, rp, meas, tick, tx.Limit, offset)
+	}
+	first, last, err := tx.queryTimeRange(job, src, db, rp, meas, start, end)
+	if err != nil {
+		send(&QueryResult{Err: err})
+		return
+	}
+	// the first point is at or after the start
+	start, end = first, last+1
+	window := int64(InitialWindow)
+	for start < end {
+		if err := job.wait(); err != nil {
+			send(&QueryResult{Err: err})
+			return
+		}
+		stop := start + window
+		if stop > end || stop < start {
+			stop = end
+		}
+		series, err := tx.queryWindow(job, src, db, rp, meas, cols, start, stop, 0)
+		if err != nil {
+			send(&QueryResult{Err: err})
+			return
+		}
+		points := countValues(series)
+		if points >= job.Limit && stop-start > int64(MinWindow) {
+			window = (stop - start) / 2
+			continue
+		}
+		for offset := job.Limit; points >= job.Limit; offset += job.Limit {
+			if !send(&QueryResult{Series: series}) {
+				return
 			}
-			rsp, err = src.QueryIQL("GET", db, q, "ns")
-			if err == nil {
-				break
+			if series, err = tx.queryWindow(job, src, db, rp, meas, cols, start, stop, offset); err != nil {
+				send(&QueryResult{Err: err})
+				return
 			}
+			points = countValues(series)
 		}
-		if err != nil {
-			ch <- &QueryResult{Err: err}
+		if !send(&QueryResult{Series: series, End: stop}) {
 			return
 		}
-		series, err := backend.SeriesFromResponseBytes(rsp)
+		window = nextWindow(stop-start, points, job.Limit)
+		start = stop
+	}
+}
+
+// queryTimeRange returns the time of the first and the last points of the measurement within [start, end)
+// in nanoseconds, zero start or end means unlimited, the last is less than the first if there is no point
+func (tx *Transfer) queryTimeRange(job *Job, src *backend.Backend, db, rp, meas string, start, end int64) (first, last int64, err error) {
+	conds := make([]string, 0, 2)
+	if start > 0 {
+		conds = append(conds, fmt.Sprintf("time >= %d", start))
+	}
+	if end > 0 {
+		conds = append(conds, fmt.Sprintf("time < %d", end))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " where " + strings.Join(conds, " and ")
+	}
+	for i, order := range []string{"asc", "desc"} {
+		q := fmt.Sprintf("select * from \"%s\".\"%s\"%s order by time %s limit 1", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas), where, order)
+		series, err := tx.queryRetry(job, src, db, q)
 		if err != nil {
-			ch <- &QueryResult{Err: err}
-			return
+			return 0, 0, err
 		}
-		if len(series) == 0 || len(series[0].Values) == 0 {
-			return
+		if countValues(series) == 0 {
+			return 0, -1, nil
+		}
+		ts, err := parseTime(series[0].Values[0][0])
+		if err != nil {
+			return 0, 0, err
+		}
+		if i == 0 {
+			first = ts
+		} else {
+			last = ts
 		}
-		ch <- &QueryResult{Series: series}
 	}
+	return
 }
 
-func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db, rp, meas string, tick int64) error {
-	ch := make(chan *QueryResult, 4)
-	go tx.query(ch, src, db, rp, meas, tick)
+func (tx *Transfer) queryWindow(job *Job, src *backend.Backend, db, rp, meas string, cols []*backend.Column, start, stop int64, offset int) (models.Rows, error) {
+	q := fmt.Sprintf("select %s from \"%s\".\"%s\" where time >= %d and time < %d limit %d", projection(cols), util.EscapeIdentifier(rp), util.EscapeIdentifier(meas), start, stop, job.Limit)
+	if offset > 0 {
+		q = fmt.Sprintf("%s offset %d", q, offset)
+	}
+	return tx.queryRetry(job, src, db, q)
+}
 
-	var tagMap util.Set
-	var fieldMap map[string]string
+func (tx *Transfer) queryRetry(job *Job, src *backend.Backend, db, q string) (models.Rows, error) {
+	var rsp []byte
+	var err error
+	for i := 0; i <= RetryCount; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(RetryInterval) * time.Second)
+			job.tlog.Printf("transfer query retry: %d, err:%s src:%s db:%s q:%s", i, err, src.Url, db, q)
+		}
+		begin := time.Now()
+		rsp, err = src.QueryIQL("GET", db, q, "ns")
+		job.observe(time.Since(begin), err)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	series, err := backend.SeriesFromResponseBytes(rsp)
+	if err != nil {
+		return nil, err
+	}
+	return series, job.throttleRead(countValues(series), len(rsp))
+}
+
+func countValues(series models.Rows) int {
+	if len(series) == 0 {
+		return 0
+	}
+	return len(series[0].Values)
+}
+
+func (tx *Transfer) transfer(job *Job, src *backend.Backend, dsts []*backend.Backend, db, rp, meas string) error {
+	key := checkpointKey(src, db, rp, meas)
+	start, end := job.timeRange()
+	if window := job.Window(key); window > start {
+		job.tlog.Printf("transfer resume, src:%s db:%s rp:%s meas:%s window:%d", src.Url, db, rp, meas, window)
+		start = window
+	}
+
+	var tagKeys []string
+	var fieldKeys map[string][]string
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		tagKeys := src.GetTagKeys(db, rp, meas)
-		tagMap = util.NewSetFromSlice(tagKeys)
+		tagKeys = src.GetTagKeys(db, rp, meas)
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		fieldKeys := src.GetFieldKeys(db, rp, meas)
-		fieldMap = reformFieldKeys(fieldKeys)
+		fieldKeys = src.GetFieldKeys(db, rp, meas)
 	}()
 	wg.Wait()
-	return tx.write(ch, dsts, db, rp, meas, tagMap, fieldMap)
+	if len(fieldKeys) == 0 {
+		job.SetDone(key)
+		return nil
+	}
+	cols := newColumns(tagKeys, fieldKeys)
+
+	ch := make(chan *QueryResult, 4)
+	done := make(chan struct{})
+	defer close(done)
+	go tx.query(job, ch, done, src, db, rp, meas, cols, start, end)
+	err := tx.write(job, key, ch, dsts, db, rp, meas, cols)
+	if err == nil {
+		job.SetDone(key)
+	}
+	return err
 }
 
-func (tx *Transfer) submitTransfer(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, db, meas string, tick int64) {
-	rps := src.GetRetentionPolicies(db)
+func (tx *Transfer) submitTransfer(job *Job, cs *CircleState, src *backend.Backend, dsts []*backend.Backend, db, meas string) {
+	rps := job.filterRetentionPolicies(src.GetRetentionPolicies(db))
 	for _, rp := range rps {
 		rp := rp
+		if job.IsDone(checkpointKey(src, db, rp, meas)) {
+			job.tlog.Printf("transfer skipped by checkpoint, src:%s db:%s rp:%s meas:%s", src.Url, db, rp, meas)
+			continue
+		}
 		cs.wg.Add(1)
-		tx.pool.Submit(func() {
+		job.pool.Submit(func() {
 			defer cs.wg.Done()
-			err := tx.transfer(src, dsts, db, rp, meas, tick)
+			if job.wait() != nil {
+				return
+			}
+			err := tx.transfer(job, src, dsts, db, rp, meas)
 			if err == nil {
-				tlog.Printf("transfer done, src:%s dst:%v db:%s rp:%s meas:%s tick:%d", src.Url, getBackendUrls(dsts), db, rp, meas, tick)
-			} else {
-				tlog.Printf("transfer error: %s, src:%s dst:%v db:%s rp:%s meas:%s tick:%d", err, src.Url, getBackendUrls(dsts), db, rp, meas, tick)
+				job.tlog.Printf("transfer done, src:%s dst:%v db:%s rp:%s meas:%s tick:%d end_tick:%d", src.Url, getBackendUrls(dsts), db, rp, meas, job.Tick, job.EndTick)
+			} else if err != ErrJobCancelled {
+				job.SetError(checkpointKey(src, db, rp, meas), err)
+				job.tlog.Printf("transfer error: %s, src:%s dst:%v db:%s rp:%s meas:%s tick:%d end_tick:%d", err, src.Url, getBackendUrls(dsts), db, rp, meas, job.Tick, job.EndTick)
 			}
 		})
 	}
 }
 
-func (tx *Transfer) submitCleanup(cs *CircleState, be *backend.Backend, db, meas string) {
+func (tx *Transfer) submitCleanup(job *Job, cs *CircleState, be *backend.Backend, db, meas string) {
+	key := checkpointKey(be, db, "", meas)
+	if job.IsDone(key) {
+		job.tlog.Printf("cleanup skipped by checkpoint, backend:%s db:%s meas:%s", be.Url, db, meas)
+		return
+	}
 	cs.wg.Add(1)
-	tx.pool.Submit(func() {
+	job.pool.Submit(func() {
 		defer cs.wg.Done()
-		_, err := be.DropMeasurement(db, meas)
+		if job.wait() != nil {
+			return
+		}
+		var err error
+		if job.Tick > 0 || job.EndTick > 0 {
+			start, end := job.timeRange()
+			_, err = be.DeleteMeasurement(db, meas, start, end)
+		} else {
+			_, err = be.DropMeasurement(db, meas)
+		}
 		if err == nil {
-			tlog.Printf("cleanup done, backend:%s db:%s meas:%s", be.Url, db, meas)
+			job.SetDone(key)
+			job.tlog.Printf("cleanup done, backend:%s db:%s meas:%s", be.Url, db, meas)
 		} else {
-			tlog.Printf("cleanup error: %s, backend:%s db:%s meas:%s", err, be.Url, db, meas)
+			job.SetError(key, err)
+			job.tlog.Printf("cleanup error: %s, backend:%s db:%s meas:%s", err, be.Url, db, meas)
 		}
 	})
 }
 
-func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []string, fn func(*CircleState, *backend.Backend, string, string, []interface{}) bool, args ...interface{}) {
+func (tx *Transfer) runTransfer(job *Job, cs *CircleState, be *backend.Backend, dbs []string, fn func(*Job, *CircleState, *backend.Backend, string, string, []interface{}) bool, args ...interface{}) {
 	defer cs.wg.Done()
+	// the measurements of the inactive backend are left to the retry of the partial job
 	if !be.IsActive() {
-		tlog.Printf("backend unavailable: %s", be.Url)
+		job.SetError(be.Url, ErrBackendInactive)
+		job.tlog.Printf("backend unavailable: %s", be.Url)
 		return
 	}
+	job.clearError(be.Url)
 
 	stats := cs.Stats[be.Url]
 	stats.DatabaseTotal = int32(len(dbs))
@@ -375,147 +701,208 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 		wg.Add(1)
 		go func(i int, db string) {
 			defer wg.Done()
-			measures[i] = be.GetMeasurements(db)
+			measures[i] = job.filterMeasurements(be.GetMeasurements(db))
 		}(i, db)
 	}
 	wg.Wait()
 	for i := range measures {
 		stats.MeasurementTotal += int32(len(measures[i]))
+		job.addMeasurements(int32(len(measures[i])))
 	}
 
 	for i, db := range dbs {
 		for _, meas := range measures[i] {
-			require := fn(cs, be, db, meas, args)
+			if job.wait() != nil {
+				return
+			}
+			require := fn(job, cs, be, db, meas, args)
 			if require {
 				atomic.AddInt32(&stats.TransferCount, 1)
 			} else {
 				atomic.AddInt32(&stats.InPlaceCount, 1)
 			}
 			atomic.AddInt32(&stats.MeasurementDone, 1)
+			job.measurementCompleted()
 		}
 		atomic.AddInt32(&stats.DatabaseDone, 1)
 	}
 }
 
-func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []string) { // nolint:golint
-	tx.setLogOutput("rebalance.log")
-	dbs, err := tx.createDatabases(dbs)
+func (tx *Transfer) rebalance(job *Job, circleId int, backends []*backend.Backend, dbs []string) error { // nolint:golint
+	dbs, err := tx.createDatabases(job, dbs)
 	if err != nil || len(dbs) == 0 {
-		return
+		return err
 	}
-	tx.pool, err = ants.NewPool(tx.Worker)
+	job.pool, err = ants.NewPool(job.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
-		return
+		job.tlog.Printf("new pool error: %s", err)
+		return err
 	}
-	defer tx.pool.Release()
-	tlog.Printf("rebalance start: circle %d", circleId)
+	defer job.pool.Release()
+	job.tlog.Printf("rebalance start: circle %d", circleId)
 	cs := tx.CircleStates[circleId]
-	tx.resetCircleStates()
-	tx.broadcastTransferring(cs, true)
-	defer tx.broadcastTransferring(cs, false)
+	cs.ResetStates()
+	tx.broadcastTransferring(job, cs, true)
+	defer tx.broadcastTransferring(job, cs, false)
 
 	for _, be := range backends {
 		cs.wg.Add(1)
-		go tx.runTransfer(cs, be, dbs, tx.runRebalance)
+		go tx.runTransfer(job, cs, be, dbs, tx.runRebalance)
 	}
 	cs.wg.Wait()
-	tx.resetBasicParam()
-	tlog.Printf("rebalance done: circle %d", circleId)
+	if job.isCancelled() {
+		job.tlog.Printf("rebalance cancelled: circle %d", circleId)
+		return ErrJobCancelled
+	}
+	job.tlog.Printf("rebalance done: circle %d", circleId)
+	return nil
 }
 
-func (tx *Transfer) runRebalance(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
-	key := backend.GetKey(db, meas)
-	dst := cs.GetBackend(key)
-	require = dst.Url != be.Url
+func (tx *Transfer) runRebalance(job *Job, cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
+	dsts := rebalanceDsts(cs, be, db, meas)
+	require = len(dsts) > 0
 	if require {
-		tx.submitTransfer(cs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(job, cs, be, dsts, db, meas)
 	}
 	return
 }
 
-func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string, dbs []string) { // nolint:golint
-	tx.setLogOutput("recovery.log")
-	dbs, err := tx.createDatabases(dbs)
+// rebalanceBackends returns the removed backends of the job and the backends of the circle
+func (tx *Transfer) rebalanceBackends(job *Job) ([]*backend.Backend, error) {
+	cs := tx.CircleStates[job.CircleId]
+	backends := make([]*backend.Backend, 0, len(job.Backends)+len(cs.Backends))
+	for _, bkcfg := range job.Backends {
+		be, err := backend.NewSimpleBackend(bkcfg)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, be)
+	}
+	return append(backends, cs.Backends...), nil
+}
+
+// rebalanceDsts returns the backend of the circle which the measurement belongs to, or nil if it's the backend itself
+func rebalanceDsts(cs *CircleState, be *backend.Backend, db, meas string) []*backend.Backend {
+	dst := cs.GetBackend(backend.GetKey(db, meas))
+	if dst.Url == be.Url {
+		return nil
+	}
+	return []*backend.Backend{dst}
+}
+
+func (tx *Transfer) recovery(job *Job, fromCircleId, toCircleId int, dbs []string) error { // nolint:golint
+	dbs, err := tx.createDatabases(job, dbs)
 	if err != nil || len(dbs) == 0 {
-		return
+		return err
 	}
-	tx.pool, err = ants.NewPool(tx.Worker)
+	job.pool, err = ants.NewPool(job.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
-		return
+		job.tlog.Printf("new pool error: %s", err)
+		return err
 	}
-	defer tx.pool.Release()
-	tlog.Printf("recovery start: circle from %d to %d", fromCircleId, toCircleId)
+	defer job.pool.Release()
+	job.tlog.Printf("recovery start: circle from %d to %d", fromCircleId, toCircleId)
 	fcs := tx.CircleStates[fromCircleId]
 	tcs := tx.CircleStates[toCircleId]
-	tx.resetCircleStates()
-	tx.broadcastTransferring(tcs, true)
-	defer tx.broadcastTransferring(tcs, false)
+	fcs.ResetStates()
+	tx.broadcastTransferring(job, tcs, true)
+	defer tx.broadcastTransferring(job, tcs, false)
 
-	backendUrlSet := util.NewSet() // nolint:golint
-	if len(backendUrls) != 0 {
-		for _, u := range backendUrls {
-			backendUrlSet.Add(u)
-		}
-	} else {
-		for _, b := range tcs.Backends {
-			backendUrlSet.Add(b.Url)
-		}
-	}
+	backendUrlSet := recoveryUrls(job, tcs) // nolint:golint
 	for _, be := range fcs.Backends {
 		fcs.wg.Add(1)
-		go tx.runTransfer(fcs, be, dbs, tx.runRecovery, tcs, backendUrlSet)
+		go tx.runTransfer(job, fcs, be, dbs, tx.runRecovery, tcs, backendUrlSet)
 	}
 	fcs.wg.Wait()
-	tx.resetBasicParam()
-	tlog.Printf("recovery done: circle from %d to %d", fromCircleId, toCircleId)
+	if job.isCancelled() {
+		job.tlog.Printf("recovery cancelled: circle from %d to %d", fromCircleId, toCircleId)
+		return ErrJobCancelled
+	}
+	job.tlog.Printf("recovery done: circle from %d to %d", fromCircleId, toCircleId)
+	return nil
 }
 
-func (tx *Transfer) runRecovery(fcs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
+func (tx *Transfer) runRecovery(job *Job, fcs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	tcs := args[0].(*CircleState)
 	backendUrlSet := args[1].(util.Set) // nolint:golint
-	key := backend.GetKey(db, meas)
-	dst := tcs.GetBackend(key)
-	require = backendUrlSet[dst.Url]
+	dsts := recoveryDsts(tcs, backendUrlSet, db, meas)
+	require = len(dsts) > 0
 	if require {
-		tx.submitTransfer(fcs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(job, fcs, be, dsts, db, meas)
 	}
 	return
 }
 
-func (tx *Transfer) Resync(dbs []string, tick int64) {
-	tx.setLogOutput("resync.log")
-	dbs, err := tx.createDatabases(dbs)
+// recoveryUrls returns the backend urls of the job to recover, or all the backend urls of the circle
+func recoveryUrls(job *Job, tcs *CircleState) util.Set {
+	backendUrlSet := util.NewSet() // nolint:golint
+	if len(job.BackendUrls) != 0 {
+		for _, u := range job.BackendUrls {
+			backendUrlSet.Add(u)
+		}
+	} else {
+		for _, b := range tcs.Backends {
+			backendUrlSet.Add(b.Url)
+		}
+	}
+	return backendUrlSet
+}
+
+// recoveryDsts returns the backend of the circle which the measurement belongs to if it's to recover
+func recoveryDsts(tcs *CircleState, backendUrlSet util.Set, db, meas string) []*backend.Backend { // nolint:golint
+	dst := tcs.GetBackend(backend.GetKey(db, meas))
+	if !backendUrlSet[dst.Url] {
+		return nil
+	}
+	return []*backend.Backend{dst}
+}
+
+func (tx *Transfer) resync(job *Job, dbs []string) error {
+	dbs, err := tx.createDatabases(job, dbs)
 	if err != nil || len(dbs) == 0 {
-		return
+		return err
 	}
-	tx.pool, err = ants.NewPool(tx.Worker)
+	job.pool, err = ants.NewPool(job.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
-		return
+		job.tlog.Printf("new pool error: %s", err)
+		return err
 	}
-	defer tx.pool.Release()
-	tlog.Printf("resync start")
-	tx.resetCircleStates()
-	tx.broadcastResyncing(true)
-	defer tx.broadcastResyncing(false)
+	defer job.pool.Release()
+	job.tlog.Printf("resync start")
+	for _, cs := range tx.CircleStates {
+		cs.ResetStates()
+	}
+	tx.broadcastResyncing(job, true)
+	defer tx.broadcastResyncing(job, false)
 
 	for _, cs := range tx.CircleStates {
-		tlog.Printf("resync start: circle %d", cs.CircleId)
+		job.tlog.Printf("resync start: circle %d", cs.CircleId)
 		for _, be := range cs.Backends {
 			cs.wg.Add(1)
-			go tx.runTransfer(cs, be, dbs, tx.runResync, tick)
+			go tx.runTransfer(job, cs, be, dbs, tx.runResync)
 		}
 		cs.wg.Wait()
-		tlog.Printf("resync done: circle %d", cs.CircleId)
+		if job.isCancelled() {
+			job.tlog.Printf("resync cancelled: circle %d", cs.CircleId)
+			return ErrJobCancelled
+		}
+		job.tlog.Printf("resync done: circle %d", cs.CircleId)
 	}
-	tx.resetBasicParam()
-	tlog.Printf("resync done")
+	job.tlog.Printf("resync done")
+	return nil
 }
 
-func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
-	tick := args[0].(int64)
+func (tx *Transfer) runResync(job *Job, cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
+	dsts := tx.resyncDsts(cs, db, meas)
+	require = len(dsts) > 0
+	if require {
+		tx.submitTransfer(job, cs, be, dsts, db, meas)
+	}
+	return
+}
+
+// resyncDsts returns the backends of the other circles which the measurement belongs to
+func (tx *Transfer) resyncDsts(cs *CircleState, db, meas string) []*backend.Backend {
 	key := backend.GetKey(db, meas)
 	dsts := make([]*backend.Backend, 0)
 	for _, tcs := range tx.CircleStates {
@@ -524,67 +911,64 @@ func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, m
 			dsts = append(dsts, dst)
 		}
 	}
-	require = len(dsts) > 0
-	if require {
-		tx.submitTransfer(cs, be, dsts, db, meas, tick)
-	}
-	return
+	return dsts
 }
 
-func (tx *Transfer) Cleanup(circleId int) { // nolint:golint
-	tx.setLogOutput("cleanup.log")
+func (tx *Transfer) cleanup(job *Job, circleId int) error { // nolint:golint
 	var err error
-	tx.pool, err = ants.NewPool(tx.Worker)
+	job.pool, err = ants.NewPool(job.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
-		return
+		job.tlog.Printf("new pool error: %s", err)
+		return err
 	}
-	defer tx.pool.Release()
-	tlog.Printf("cleanup start: circle %d", circleId)
+	defer job.pool.Release()
+	job.tlog.Printf("cleanup start: circle %d", circleId)
 	cs := tx.CircleStates[circleId]
-	tx.resetCircleStates()
-	tx.broadcastTransferring(cs, true)
-	defer tx.broadcastTransferring(cs, false)
+	cs.ResetStates()
+	tx.broadcastTransferring(job, cs, true)
+	defer tx.broadcastTransferring(job, cs, false)
 
 	for _, be := range cs.Backends {
-		dbs := be.GetDatabases()
+		dbs := job.filterDatabases(be.GetDatabases())
 		if len(dbs) > 0 {
 			cs.wg.Add(1)
-			go tx.runTransfer(cs, be, dbs, tx.runCleanup)
+			go tx.runTransfer(job, cs, be, dbs, tx.runCleanup)
 		}
 	}
 	cs.wg.Wait()
-	tx.resetBasicParam()
-	tlog.Printf("cleanup done: circle %d", circleId)
+	if job.isCancelled() {
+		job.tlog.Printf("cleanup cancelled: circle %d", circleId)
+		return ErrJobCancelled
+	}
+	job.tlog.Printf("cleanup done: circle %d", circleId)
+	return nil
 }
 
-func (tx *Transfer) runCleanup(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
-	key := backend.GetKey(db, meas)
-	dst := cs.GetBackend(key)
-	require = dst.Url != be.Url
+func (tx *Transfer) runCleanup(job *Job, cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
+	require = len(rebalanceDsts(cs, be, db, meas)) > 0
 	if require {
-		tlog.Printf("backend:%s db:%s meas:%s require to cleanup", be.Url, db, meas)
-		tx.submitCleanup(cs, be, db, meas)
+		job.tlog.Printf("backend:%s db:%s meas:%s require to cleanup", be.Url, db, meas)
+		tx.submitCleanup(job, cs, be, db, meas)
 	} else {
-		tlog.Printf("backend:%s db:%s meas:%s checked", be.Url, db, meas)
+		job.tlog.Printf("backend:%s db:%s meas:%s checked", be.Url, db, meas)
 	}
 	return
 }
 
-func (tx *Transfer) broadcastResyncing(resyncing bool) {
+func (tx *Transfer) broadcastResyncing(job *Job, resyncing bool) {
 	tx.Resyncing = resyncing
-	client := backend.NewClient(tx.httpsEnabled, 10)
-	for _, addr := range tx.HaAddrs {
+	client := backend.NewClient(tx.peerTLS, 10)
+	for _, addr := range job.HaAddrs {
 		url := fmt.Sprintf("http://%s/transfer/state?resyncing=%t", addr, resyncing)
 		tx.postBroadcast(client, url)
 	}
 }
 
-func (tx *Transfer) broadcastTransferring(cs *CircleState, transferring bool) {
+func (tx *Transfer) broadcastTransferring(job *Job, cs *CircleState, transferring bool) {
 	cs.Transferring = transferring
 	cs.SetTransferIn(transferring)
-	client := backend.NewClient(tx.httpsEnabled, 10)
-	for _, addr := range tx.HaAddrs {
+	client := backend.NewClient(tx.peerTLS, 10)
+	for _, addr := range job.HaAddrs {
 		url := fmt.Sprintf("http://%s/transfer/state?circle_id=%d&transferring=%t", addr, cs.CircleId, transferring)
 		tx.postBroadcast(client, url)
 	}
@@ -0,0 +1,230 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func newTestJob(t *testing.T, typ string) *Job {
+	job := NewJob(typ)
+	job.Id = newJobId(typ)
+	job.Status = JobRunning
+	job.init(filepath.Join(t.TempDir(), job.Id+".json"))
+	job.openLog("")
+	return job
+}
+
+func newTestBackend(t *testing.T, name string, status int) *backend.Backend {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	pxcfg := &backend.ProxyConfig{DataDir: t.TempDir(), CheckInterval: 1, ConnPoolSize: 1, FlushSize: 1, FlushTime: 1, RewriteInterval: 1, WriteTimeout: 10}
+	be, err := backend.NewBackend(&backend.BackendConfig{Name: name, Url: ts.URL}, pxcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(be.Close)
+	return be
+}
+
+// fakeInflux is an influxdb answering the queries by respond and recording the queries and the lines written
+type fakeInflux struct {
+	URL     string
+	lock    sync.Mutex
+	queries []string
+	lines   []string
+	respond func(db, q string) *models.Row
+}
+
+func newFakeInflux(t *testing.T, respond func(db, q string) *models.Row) *fakeInflux {
+	fi := &fakeInflux{respond: respond}
+	ts := httptest.NewServer(fi)
+	t.Cleanup(ts.Close)
+	fi.URL = ts.URL
+	return fi
+}
+
+func (fi *fakeInflux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/query":
+		db, q := req.FormValue("db"), req.FormValue("q")
+		fi.lock.Lock()
+		fi.queries = append(fi.queries, q)
+		fi.lock.Unlock()
+		result := map[string]interface{}{"statement_id": 0}
+		if fi.respond != nil {
+			if row := fi.respond(db, q); row != nil {
+				result["series"] = []*models.Row{row}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{result}})
+	case "/write":
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gr
+		}
+		scanner := bufio.NewScanner(body)
+		fi.lock.Lock()
+		for scanner.Scan() {
+			fi.lines = append(fi.lines, scanner.Text())
+		}
+		fi.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (fi *fakeInflux) Queries() []string {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return append([]string(nil), fi.queries...)
+}
+
+func (fi *fakeInflux) Lines() []string {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return append([]string(nil), fi.lines...)
+}
+
+func TestTransferWrite(t *testing.T) {
+	retryCount := RetryCount
+	RetryCount = 0
+	defer func() { RetryCount = retryCount }()
+
+	cols := newColumns([]string{"host"}, map[string][]string{"value": {"float"}})
+	tests := []struct {
+		name     string
+		statuses []int
+		hasError bool
+	}{
+		{name: "written", statuses: []int{http.StatusNoContent, http.StatusNoContent}},
+		{name: "one failed", statuses: []int{http.StatusNoContent, http.StatusInternalServerError}, hasError: true},
+		{name: "all failed", statuses: []int{http.StatusInternalServerError, http.StatusInternalServerError}, hasError: true},
+	}
+	for _, tt := range tests {
+		job := newTestJob(t, JobResync)
+		dsts := make([]*backend.Backend, len(tt.statuses))
+		for i, status := range tt.statuses {
+			dsts[i] = newTestBackend(t, "dst", status)
+		}
+		ch := make(chan *QueryResult, 1)
+		ch <- &QueryResult{Series: models.Rows{{Values: [][]interface{}{{json.Number("1"), "h1", json.Number("0.5")}}}}, End: 2}
+		close(ch)
+		err := (&Transfer{}).write(job, "key", ch, dsts, "db", "rp", "cpu", cols)
+		if (err != nil) != tt.hasError {
+			t.Errorf("%s: error = %v, hasError %v", tt.name, err, tt.hasError)
+		}
+		// the window failed to write isn't checkpointed
+		if window, want := job.Window("key"), int64(2); (window == want) == tt.hasError {
+			t.Errorf("%s: window = %d, hasError %v", tt.name, window, tt.hasError)
+		}
+	}
+}
+
+var (
+	timeLowerRegexp = regexp.MustCompile(`time >= (\d+)`)
+	timeUpperRegexp = regexp.MustCompile(`time < (\d+)`)
+)
+
+// respondPoints answers the schema and the select queries of the measurement cpu with the points
+// at the seconds, which have the tag host and the float field value
+func respondPoints(seconds ...int64) func(db, q string) *models.Row {
+	return func(db, q string) *models.Row {
+		switch {
+		case strings.HasPrefix(q, "show tag keys"):
+			return &models.Row{Name: "cpu", Columns: []string{"tagKey"}, Values: [][]interface{}{{"host"}}}
+		case strings.HasPrefix(q, "show field keys"):
+			return &models.Row{Name: "cpu", Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{{"value", "float"}}}
+		case !strings.HasPrefix(q, "select"):
+			return nil
+		}
+		lower, upper := int64(0), int64(1<<62)
+		if m := timeLowerRegexp.FindStringSubmatch(q); m != nil {
+			lower, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+		if m := timeUpperRegexp.FindStringSubmatch(q); m != nil {
+			upper, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+		row := &models.Row{Name: "cpu", Columns: []string{"time", "host", "value"}}
+		for _, sec := range seconds {
+			if ts := sec * int64(1e9); ts >= lower && ts < upper {
+				row.Values = append(row.Values, []interface{}{ts, "h1", float64(sec)})
+			}
+		}
+		if strings.Contains(q, "order by time desc") && len(row.Values) > 0 {
+			row.Values = row.Values[len(row.Values)-1:]
+		}
+		if strings.HasSuffix(q, " limit 1") && len(row.Values) > 1 {
+			row.Values = row.Values[:1]
+		}
+		return row
+	}
+}
+
+func TestTransferFromWindow(t *testing.T) {
+	fsrc := newFakeInflux(t, respondPoints(1, 2, 3, 4, 5))
+	src, err := backend.NewSimpleBackend(&backend.BackendConfig{Name: "src", Url: fsrc.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fdst := newFakeInflux(t, nil)
+	pxcfg := &backend.ProxyConfig{DataDir: t.TempDir(), CheckInterval: 1, ConnPoolSize: 1, FlushSize: 1, FlushTime: 1, RewriteInterval: 1, WriteTimeout: 10}
+	dst, err := backend.NewBackend(&backend.BackendConfig{Name: "dst", Url: fdst.URL}, pxcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// the job saved with the window checkpoint is loaded and transferred from the window
+	job := newTestJob(t, JobResync)
+	key := checkpointKey(src, "db", "rp", "cpu")
+	job.Windows[key] = 3e9
+	if err = job.Save(); err != nil {
+		t.Fatal(err)
+	}
+	job, err = loadJob(job.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.openLog("")
+	if err = (&Transfer{}).transfer(job, src, []*backend.Backend{dst}, "db", "rp", "cpu"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cpu,host=h1 value=3 3000000000", "cpu,host=h1 value=4 4000000000", "cpu,host=h1 value=5 5000000000"}
+	if lines := fdst.Lines(); strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("lines = %v, want %v", lines, want)
+	}
+	for _, q := range fsrc.Queries() {
+		if strings.HasPrefix(q, "select") && !strings.Contains(q, "time >= 3000000000") {
+			t.Errorf("query before the window: %s", q)
+		}
+	}
+	if !job.IsDone(key) || job.Window(key) != 0 {
+		t.Errorf("done = %t, window = %d, want done without window", job.IsDone(key), job.Window(key))
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+var (
+	// InitialWindow is the size of the first time window of a measurement
+	InitialWindow = time.Hour
+	// MinWindow is the minimum size of the time window, the full window of this size is paged by offset
+	MinWindow = time.Millisecond
+	// MaxWindowGrowth is the maximum factor the window grows or shrinks by from one window to the next
+	MaxWindowGrowth = 4.0
+)
+
+// newColumns returns the columns selected from the measurement, the first is the time, a field with several types
+// across shards is selected once per type so that its values keep their own types
+func newColumns(tagKeys []string, fieldKeys map[string][]string) []*backend.Column {
+	cols := make([]*backend.Column, 0, 1+len(tagKeys)+len(fieldKeys))
+	cols = append(cols, &backend.Column{Key: "time"})
+	for _, key := range tagKeys {
+		cols = append(cols, &backend.Column{Key: key, Type: "tag"})
+	}
+	fields := make([]string, 0, len(fieldKeys))
+	for field := range fieldKeys {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		types := util.NewSetFromSlice(fieldKeys[field])
+		for _, typ := range FieldTypes {
+			if types[typ] {
+				cols = append(cols, &backend.Column{Key: field, Type: typ})
+			}
+		}
+	}
+	return cols
+}
+
+// projection returns the select clause of the columns except the time with the type casts, such as "host"::tag, "value"::float
+func projection(cols []*backend.Column) string {
+	exprs := make([]string, 0, len(cols))
+	for _, col := range cols[1:] {
+		exprs = append(exprs, fmt.Sprintf("\"%s\"::%s", util.EscapeIdentifier(col.Key), col.Type))
+	}
+	return strings.Join(exprs, ", ")
+}
+
+// nextWindow returns the size of the next window from the size and the points of the last window,
+// which is sized to hold about half of the limit points, the empty window grows by MaxWindowGrowth
+func nextWindow(size int64, points, limit int) int64 {
+	factor := MaxWindowGrowth
+	if points > 0 {
+		factor = float64(limit) / 2 / float64(points)
+		if factor > MaxWindowGrowth {
+			factor = MaxWindowGrowth
+		} else if factor < 1/MaxWindowGrowth {
+			factor = 1 / MaxWindowGrowth
+		}
+	}
+	next := int64(float64(size) * factor)
+	if next < int64(MinWindow) {
+		next = int64(MinWindow)
+	}
+	return next
+}
+
+func parseTime(v interface{}) (int64, error) {
+	return strconv.ParseInt(fmt.Sprint(v), 10, 64)
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+func TestNewColumns(t *testing.T) {
+	tests := []struct {
+		name       string
+		tagKeys    []string
+		fieldKeys  map[string][]string
+		projection string
+		value      []interface{}
+		line       string
+	}{
+		{
+			name:       "tags and fields",
+			tagKeys:    []string{"host", "region"},
+			fieldKeys:  map[string][]string{"value": {"float"}, "count": {"integer"}, "msg": {"string"}, "ok": {"boolean"}},
+			projection: `"host"::tag, "region"::tag, "count"::integer, "msg"::string, "ok"::boolean, "value"::float`,
+			value:      []interface{}{json.Number("1"), "h 1", nil, json.Number("5"), `say "hi"`, true, json.Number("0.5")},
+			line:       `cpu,host=h\ 1 count=5i,msg="say \"hi\"",ok=true,value=0.5 1`,
+		},
+		{
+			// the field with several types is selected once per type, and the null type is skipped
+			name:       "field types",
+			fieldKeys:  map[string][]string{"value": {"string", "float", "integer"}},
+			projection: `"value"::float, "value"::integer, "value"::string`,
+			value:      []interface{}{json.Number("2"), nil, json.Number("3"), nil},
+			line:       `cpu value=3i 2`,
+		},
+		{
+			name:       "escaped key",
+			tagKeys:    []string{`a"b`},
+			fieldKeys:  map[string][]string{"v": {"float"}},
+			projection: `"a\"b"::tag, "v"::float`,
+			value:      []interface{}{json.Number("3"), "x", json.Number("1")},
+			line:       `cpu,a"b=x v=1 3`,
+		},
+		{
+			name:       "no field value",
+			tagKeys:    []string{"host"},
+			fieldKeys:  map[string][]string{"value": {"float"}},
+			projection: `"host"::tag, "value"::float`,
+			value:      []interface{}{json.Number("4"), "h1", nil},
+			line:       "",
+		},
+	}
+	for _, tt := range tests {
+		cols := newColumns(tt.tagKeys, tt.fieldKeys)
+		if cols[0].Key != "time" || cols[0].Type != "" {
+			t.Errorf("%s: first column = %+v, want time", tt.name, *cols[0])
+		}
+		if got := projection(cols); got != tt.projection {
+			t.Errorf("%s: projection = %s, want %s", tt.name, got, tt.projection)
+		}
+		if got := backend.RowToLine("cpu", nil, cols, tt.value); got != tt.line {
+			t.Errorf("%s: line = %s, want %s", tt.name, got, tt.line)
+		}
+	}
+}
+
+func TestNextWindow(t *testing.T) {
+	size := int64(time.Hour)
+	tests := []struct {
+		name   string
+		size   int64
+		points int
+		limit  int
+		want   int64
+	}{
+		{name: "empty window grows", size: size, points: 0, limit: 1000, want: 4 * size},
+		{name: "half of the limit", size: size, points: 500, limit: 1000, want: size},
+		{name: "sparse window grows", size: size, points: 250, limit: 1000, want: 2 * size},
+		{name: "growth is bounded", size: size, points: 1, limit: 1000, want: 4 * size},
+		{name: "dense window shrinks", size: size, points: 1000, limit: 1000, want: size / 2},
+		{name: "shrink is bounded", size: size, points: 1000000, limit: 1000, want: size / 4},
+		{name: "minimum window", size: int64(MinWindow), points: 1000, limit: 1000, want: int64(MinWindow)},
+	}
+	for _, tt := range tests {
+		if got := nextWindow(tt.size, tt.points, tt.limit); got != tt.want {
+			t.Errorf("%s: next window = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
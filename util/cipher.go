@@ -8,53 +8,148 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 )
 
-var cipherKey = []byte("consistentcipher")
-var aesCipher, _ = aes.NewCipher(cipherKey)
-var blockSize = aesCipher.BlockSize()
-var iv = cipherKey[:blockSize]
+// CipherKeyEnv is the environment variable of the cipher key, which is used if the cipher key file is not set
+const CipherKeyEnv = "INFLUX_PROXY_CIPHER_KEY"
+
+// cipherVersion is the prefix of the ciphertexts encrypted by AES-GCM,
+// the ciphertexts without prefix are encrypted by the legacy AES-CBC with the fixed key
+const cipherVersion = "v2:"
+
+var (
+	ErrCipherKeyNotSet   = errors.New("cipher key not set, require cipher_key_file or environment variable " + CipherKeyEnv)
+	ErrInvalidCipherKey  = errors.New("invalid cipher key, require base64 encoded 16, 24 or 32 bytes")
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+)
+
+var (
+	cipherLock sync.RWMutex
+	aead       cipher.AEAD
+)
+
+// the legacy cipher is only used to decrypt the values encrypted by the previous versions
+var legacyKey = []byte("consistentcipher")
+var legacyCipher, _ = aes.NewCipher(legacyKey)
+var blockSize = legacyCipher.BlockSize()
 
 var encodeURL = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_!"
 var base64RawURLEncoding = base64.NewEncoding(encodeURL).WithPadding(base64.NoPadding)
 
-func CheckCipherKey(key string) bool {
-	return key == string(cipherKey)
+// LoadCipherKey reads the base64 encoded key from the file, or from the environment variable if the file is empty,
+// and returns nil if neither is set
+func LoadCipherKey(file string) ([]byte, error) {
+	var text string
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	} else {
+		text = os.Getenv(CipherKeyEnv)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+		return nil, ErrInvalidCipherKey
+	}
+	return key, nil
+}
+
+func SetCipherKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return ErrInvalidCipherKey
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	cipherLock.Lock()
+	defer cipherLock.Unlock()
+	aead = gcm
+	return nil
 }
 
-func AesEncrypt(origin string) string {
+// Encrypt encrypts the text by AES-GCM with a random nonce
+func Encrypt(origin string) (string, error) {
 	if len(origin) == 0 {
-		return ""
+		return "", nil
+	}
+	cipherLock.RLock()
+	gcm := aead
+	cipherLock.RUnlock()
+	if gcm == nil {
+		return "", ErrCipherKeyNotSet
 	}
-	originBytes := padding([]byte(origin), blockSize)
-	blockMode := cipher.NewCBCEncrypter(aesCipher, iv)
-	encryptBytes := make([]byte, len(originBytes))
-	blockMode.CryptBlocks(encryptBytes, originBytes)
-	return base64RawURLEncoding.EncodeToString(encryptBytes)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return cipherVersion + base64RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(origin), nil)), nil
 }
 
-func AesDecrypt(encrypt string) string {
+// Decrypt decrypts the text encrypted by AES-GCM, or by the legacy AES-CBC if the text has no version prefix
+func Decrypt(encrypt string) (string, error) {
 	if len(encrypt) == 0 {
-		return ""
+		return "", nil
+	}
+	if !strings.HasPrefix(encrypt, cipherVersion) {
+		return legacyDecrypt(encrypt)
+	}
+	cipherLock.RLock()
+	gcm := aead
+	cipherLock.RUnlock()
+	if gcm == nil {
+		return "", ErrCipherKeyNotSet
 	}
+	encryptBytes, err := base64RawURLEncoding.DecodeString(encrypt[len(cipherVersion):])
+	if err != nil || len(encryptBytes) < gcm.NonceSize() {
+		return "", ErrInvalidCiphertext
+	}
+	nonce, sealed := encryptBytes[:gcm.NonceSize()], encryptBytes[gcm.NonceSize():]
+	originBytes, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(originBytes), nil
+}
+
+// IsLegacyCiphertext returns true if the text is encrypted by the legacy AES-CBC, which should be encrypted again
+func IsLegacyCiphertext(encrypt string) bool {
+	return len(encrypt) > 0 && !strings.HasPrefix(encrypt, cipherVersion)
+}
+
+// AesDecrypt decrypts the text and returns empty string if failed,
+// the encrypted values of config are checked when the config is loaded
+func AesDecrypt(encrypt string) string {
+	origin, _ := Decrypt(encrypt)
+	return origin
+}
+
+func legacyDecrypt(encrypt string) (string, error) {
 	encryptBytes, err := base64RawURLEncoding.DecodeString(encrypt)
 	if err != nil {
-		return err.Error()
+		return "", ErrInvalidCiphertext
 	}
 	if len(encryptBytes)%blockSize != 0 {
-		return "crypto/cipher: input not full blocks"
+		return "", ErrInvalidCiphertext
 	}
-	blockMode := cipher.NewCBCDecrypter(aesCipher, iv)
+	blockMode := cipher.NewCBCDecrypter(legacyCipher, legacyKey[:blockSize])
 	originBytes := make([]byte, len(encryptBytes))
 	blockMode.CryptBlocks(originBytes, encryptBytes)
-	return string(unpadding(originBytes))
-}
-
-func padding(data []byte, blockSize int) []byte {
-	num := ((len(data)-1)/blockSize+1)*blockSize - len(data)
-	pad := bytes.Repeat([]byte("\x00"), num)
-	return append(data, pad...)
+	return string(unpadding(originBytes)), nil
 }
 
 func unpadding(data []byte) []byte {
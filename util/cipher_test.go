@@ -0,0 +1,157 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setTestCipherKey(t *testing.T, key []byte) {
+	if err := SetCipherKey(key); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cipherLock.Lock()
+		aead = nil
+		cipherLock.Unlock()
+	})
+}
+
+func legacyEncrypt(origin string) string {
+	data := []byte(origin)
+	data = append(data, bytes.Repeat([]byte{0}, blockSize-len(data)%blockSize)...)
+	encryptBytes := make([]byte, len(data))
+	cipher.NewCBCEncrypter(legacyCipher, legacyKey[:blockSize]).CryptBlocks(encryptBytes, data)
+	return base64RawURLEncoding.EncodeToString(encryptBytes)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	setTestCipherKey(t, bytes.Repeat([]byte{1}, 32))
+	tests := []string{"", "a", "influxdb", "p@ss:w0rd/with spaces", strings.Repeat("x", 100)}
+	for _, origin := range tests {
+		encrypt, err := Encrypt(origin)
+		if err != nil {
+			t.Fatalf("%q: encrypt error: %s", origin, err)
+		}
+		if origin != "" && (!strings.HasPrefix(encrypt, cipherVersion) || IsLegacyCiphertext(encrypt)) {
+			t.Errorf("%q: ciphertext %q has no version prefix", origin, encrypt)
+		}
+		decrypt, err := Decrypt(encrypt)
+		if err != nil || decrypt != origin {
+			t.Errorf("%q: decrypt = %q, %v", origin, decrypt, err)
+		}
+	}
+
+	// the nonce is random, so the same text is encrypted differently
+	e1, _ := Encrypt("influxdb")
+	e2, _ := Encrypt("influxdb")
+	if e1 == e2 {
+		t.Error("ciphertexts of the same text should differ")
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	setTestCipherKey(t, bytes.Repeat([]byte{1}, 16))
+	encrypt, err := Encrypt("influxdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := base64RawURLEncoding.DecodeString(encrypt[len(cipherVersion):])
+	sealed[len(sealed)-1] ^= 1
+	tampered := cipherVersion + base64RawURLEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name    string
+		encrypt string
+		err     error
+	}{
+		{name: "tampered", encrypt: tampered, err: ErrInvalidCiphertext},
+		{name: "short", encrypt: cipherVersion + base64RawURLEncoding.EncodeToString([]byte("short")), err: ErrInvalidCiphertext},
+		{name: "version only", encrypt: cipherVersion, err: ErrInvalidCiphertext},
+		{name: "invalid base64", encrypt: cipherVersion + "***", err: ErrInvalidCiphertext},
+		{name: "legacy short", encrypt: base64RawURLEncoding.EncodeToString([]byte("short")), err: ErrInvalidCiphertext},
+	}
+	for _, tt := range tests {
+		if decrypt, err := Decrypt(tt.encrypt); err != tt.err || decrypt != "" {
+			t.Errorf("%s: decrypt = %q, %v, want error %v", tt.name, decrypt, err, tt.err)
+		}
+	}
+
+	setTestCipherKey(t, bytes.Repeat([]byte{2}, 16))
+	if _, err = Decrypt(encrypt); err != ErrInvalidCiphertext {
+		t.Errorf("wrong key: error = %v, want %v", err, ErrInvalidCiphertext)
+	}
+}
+
+func TestDecryptWithoutKey(t *testing.T) {
+	if _, err := Encrypt("influxdb"); err != ErrCipherKeyNotSet {
+		t.Errorf("encrypt: error = %v, want %v", err, ErrCipherKeyNotSet)
+	}
+	if _, err := Decrypt(cipherVersion + "AAAA"); err != ErrCipherKeyNotSet {
+		t.Errorf("decrypt: error = %v, want %v", err, ErrCipherKeyNotSet)
+	}
+	// the legacy ciphertexts are readable without the key
+	encrypt := legacyEncrypt("influxdb")
+	if !IsLegacyCiphertext(encrypt) {
+		t.Errorf("%q should be legacy ciphertext", encrypt)
+	}
+	if decrypt, err := Decrypt(encrypt); err != nil || decrypt != "influxdb" {
+		t.Errorf("legacy: decrypt = %q, %v", decrypt, err)
+	}
+}
+
+func TestLoadCipherKey(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{3}, 24)
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	tests := []struct {
+		name string
+		file string
+		env  string
+		key  []byte
+		err  error
+	}{
+		{name: "file", file: write("key", base64.StdEncoding.EncodeToString(key)+"\n"), key: key},
+		{name: "env", env: base64.StdEncoding.EncodeToString(key), key: key},
+		{name: "file over env", file: write("key2", base64.StdEncoding.EncodeToString(key)), env: "invalid", key: key},
+		{name: "not set"},
+		{name: "invalid base64", env: "***", err: ErrInvalidCipherKey},
+		{name: "invalid length", env: base64.StdEncoding.EncodeToString([]byte("short")), err: ErrInvalidCipherKey},
+	}
+	env, ok := os.LookupEnv(CipherKeyEnv)
+	defer func() {
+		if ok {
+			os.Setenv(CipherKeyEnv, env)
+		} else {
+			os.Unsetenv(CipherKeyEnv)
+		}
+	}()
+	for _, tt := range tests {
+		os.Setenv(CipherKeyEnv, tt.env)
+		got, err := LoadCipherKey(tt.file)
+		if err != tt.err || !bytes.Equal(got, tt.key) {
+			t.Errorf("%s: key = %v, error = %v, want %v, %v", tt.name, got, err, tt.key, tt.err)
+		}
+	}
+	if _, err := LoadCipherKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file: error = nil")
+	}
+	if err := SetCipherKey([]byte("short")); err != ErrInvalidCipherKey {
+		t.Errorf("set short key: error = %v, want %v", err, ErrInvalidCipherKey)
+	}
+}